@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/rs/zerolog"
 	"os"
+	"reflect"
 	"strings"
 	"sync"
 	"time"
@@ -17,11 +18,25 @@ type ClientConfig struct {
 	Logger      *zerolog.Logger
 
 	ShutdownTimeout time.Duration
+
+	OnLifecycleEvent LifecycleCallback // Called on connection loss, reconnection, possible gaps...
+
+	LeaderElection *LeaderElectionConfig // Default to nil -> every client provisions driver objects and dispatches events
+	ConsumerGroup  *ConsumerGroupConfig  // Default to nil -> every client handles all listeners
+
+	Types *TypeRegistry // Default to NewTypeRegistry() -> enums, domains, composites and hstore are decoded
 }
 
 type Client struct {
-	Config    *ClientConfig
-	listeners map[string]*Listener
+	Config         *ClientConfig
+	listeners      map[string]*Listener
+	listenersMutex sync.RWMutex // Listeners are read by the consumer group goroutine, see rebalance
+
+	leaderElection *leaderElection
+	consumerGroup  *consumerGroup
+	provisioned    map[string]bool // key: listenerUid -> driver objects are created by this client
+	groupMutex     sync.Mutex
+	cancel         context.CancelFunc
 }
 
 func NewClient(config *ClientConfig) (*Client, error) {
@@ -41,13 +56,19 @@ func NewClient(config *ClientConfig) (*Client, error) {
 	if config.ShutdownTimeout == time.Duration(0) {
 		config.ShutdownTimeout = 10 * time.Second
 	}
+	if config.Types == nil {
+		config.Types = NewTypeRegistry()
+	}
 	return &Client{
-		Config:    config,
-		listeners: make(map[string]*Listener),
+		Config:      config,
+		listeners:   make(map[string]*Listener),
+		provisioned: make(map[string]bool),
 	}, nil
 }
 
 func (c *Client) Attach(listeners ...*Listener) {
+	c.listenersMutex.Lock()
+	defer c.listenersMutex.Unlock()
 	for _, l := range listeners {
 		listenerUid := c.getUniqueNameForListener(l)
 		c.listeners[listenerUid] = l
@@ -63,7 +84,7 @@ func (c *Client) Init() error {
 
 	// Init listeners (parallel)
 	var wg sync.WaitGroup
-	for lUid, l := range c.listeners {
+	for lUid, l := range c.getListeners() {
 		wg.Add(1)
 
 		listenerUid := lUid // Keep intermediate value to avoid conflict between loop iterations
@@ -73,8 +94,14 @@ func (c *Client) Init() error {
 		go func() {
 			defer wg.Done()
 			err := listener.Init(func(event Operation) error {
+				if !c.isProvisioned(listenerUid) {
+					return nil
+				}
 				return c.Config.Driver.HandleOperationListenStart(listenerUid, listener.Config, event)
 			}, func(event Operation) error {
+				if !c.isProvisioned(listenerUid) {
+					return nil
+				}
 				return c.Config.Driver.HandleOperationListenStop(listenerUid, listener.Config, event)
 			})
 			errChan <- err
@@ -91,13 +118,42 @@ func (c *Client) Init() error {
 }
 
 func (c *Client) Start() error {
+	errChan := make(chan error)
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+
+	// Only the leader provisions driver objects and dispatches events
+	if c.Config.LeaderElection != nil {
+		c.leaderElection = newLeaderElection(c.Config)
+		if err := c.leaderElection.acquire(ctx); err != nil {
+			return err
+		}
+		go c.leaderElection.watch(ctx, errChan)
+	}
+
+	// Only assigned listeners are provisioned, before any driver call
+	if c.Config.ConsumerGroup != nil {
+		c.consumerGroup = newConsumerGroup(c.Config)
+		if err := c.consumerGroup.join(); err != nil {
+			return err
+		}
+		for listenerUid, listener := range c.getListeners() {
+			partitions := c.consumerGroup.assignment(listener.Config)
+			listener.Config.setOwnedPartitions(partitions)
+			c.provisioned[listenerUid] = partitions != nil
+		}
+	}
+
 	err := c.Init()
 	if err != nil {
 		return err
 	}
 
+	if c.consumerGroup != nil {
+		go c.consumerGroup.watch(ctx, c.rebalance, errChan)
+	}
+
 	eventChan := make(DatabaseEventsChan)
-	errChan := make(chan error)
 	go func() {
 		if err := c.Config.Driver.Listen(&eventChan); err != nil {
 			errChan <- err
@@ -107,7 +163,9 @@ func (c *Client) Start() error {
 	for {
 		select {
 		case receivedEvent := <-eventChan:
+			c.listenersMutex.RLock()
 			listener, exists := c.listeners[receivedEvent.ListenerUid]
+			c.listenersMutex.RUnlock()
 			if !exists {
 				return fmt.Errorf("listener %s not found", receivedEvent.ListenerUid) // I think simply can be ignored
 			}
@@ -123,7 +181,7 @@ func (c *Client) Close() error {
 	go func() {
 		//TODO PARALLEL
 		c.Config.Logger.Debug().Msg("Closing listeners")
-		for _, l := range c.listeners {
+		for _, l := range c.getListeners() {
 			if err := l.Close(); err != nil {
 				c.Config.Logger.Error().Err(err).Msg("Error closing listener")
 				errChan <- err
@@ -152,6 +210,105 @@ func (c *Client) Close() error {
 		c.Config.Logger.Error().Msg("timeout reached while closing, some events can be loss")
 	}
 
+	if c.cancel != nil {
+		c.cancel()
+	}
+
+	// Leave the group after driver close, remaining members take over assigned listeners
+	if c.consumerGroup != nil {
+		if err := c.consumerGroup.leave(); err != nil {
+			return err
+		}
+	}
+
+	// Release leadership after driver close, a standby can take over
+	if c.leaderElection != nil {
+		if err := c.leaderElection.release(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getListeners returns a snapshot of attached listeners
+func (c *Client) getListeners() map[string]*Listener {
+	c.listenersMutex.RLock()
+	defer c.listenersMutex.RUnlock()
+
+	listeners := make(map[string]*Listener, len(c.listeners))
+	for listenerUid, listener := range c.listeners {
+		listeners[listenerUid] = listener
+	}
+	return listeners
+}
+
+func (c *Client) isProvisioned(listenerUid string) bool {
+	if c.consumerGroup == nil {
+		return true
+	}
+	c.groupMutex.Lock()
+	defer c.groupMutex.Unlock()
+	return c.provisioned[listenerUid]
+}
+
+// rebalance provisions listeners newly assigned to this client, and releases the others
+func (c *Client) rebalance() error {
+	for listenerUid, listener := range c.getListeners() {
+		if err := c.rebalanceListener(listenerUid, listener); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) rebalanceListener(listenerUid string, listener *Listener) error {
+	listener.Lock()
+	defer listener.Unlock()
+
+	partitions := c.consumerGroup.assignment(listener.Config)
+	wasProvisioned := c.isProvisioned(listenerUid)
+	if wasProvisioned == (partitions != nil) && reflect.DeepEqual(partitions, listener.Config.OwnedPartitions()) {
+		return nil
+	}
+
+	operations := listener.listenedOperations.GetAtomics()
+
+	// Still provisioned: partitions are updated in place, without releasing driver objects where rows would be missed
+	if wasProvisioned && partitions != nil {
+		listener.Config.setOwnedPartitions(partitions)
+		handler, ok := c.Config.Driver.(PartitionsUpdateHandler)
+		if !ok {
+			return nil
+		}
+		for _, operation := range operations {
+			if err := handler.HandlePartitionsUpdate(listenerUid, listener.Config, operation); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if wasProvisioned {
+		for _, operation := range operations {
+			if err := c.Config.Driver.HandleOperationListenStop(listenerUid, listener.Config, operation); err != nil {
+				return err
+			}
+		}
+	}
+
+	c.groupMutex.Lock()
+	listener.Config.setOwnedPartitions(partitions)
+	c.provisioned[listenerUid] = partitions != nil
+	c.groupMutex.Unlock()
+
+	if partitions != nil {
+		for _, operation := range operations {
+			if err := c.Config.Driver.HandleOperationListenStart(listenerUid, listener.Config, operation); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
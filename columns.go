@@ -0,0 +1,103 @@
+package flash
+
+import (
+	"database/sql"
+	"sync"
+)
+
+// ColumnTypes caches the type oid of each column of listened tables.
+// Used by trigger based drivers to decode rows built with to_jsonb, see TypeRegistry.DecodeJSONRow.
+type ColumnTypes struct {
+	sync.RWMutex
+	tables map[string]map[string]uint32 // key: table -> column -> type oid
+}
+
+func NewColumnTypes() *ColumnTypes {
+	return &ColumnTypes{tables: make(map[string]map[string]uint32)}
+}
+
+// Get returns the type oid of each column of the table, queried on first use then cached.
+// The table must be usable as regclass - e.g: "public"."posts"
+func (c *ColumnTypes) Get(conn *sql.DB, table string) (map[string]uint32, error) {
+	c.RLock()
+	columnTypes, exists := c.tables[table]
+	c.RUnlock()
+	if exists {
+		return columnTypes, nil
+	}
+
+	rows, err := conn.Query(getColumnTypesSql(), table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columnTypes = make(map[string]uint32)
+	for rows.Next() {
+		var column string
+		var oid uint32
+		if err := rows.Scan(&column, &oid); err != nil {
+			return nil, err
+		}
+		columnTypes[column] = oid
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	c.tables[table] = columnTypes
+	c.Unlock()
+	return columnTypes, nil
+}
+
+// Forget removes the cached types of the table, queried again on next use - e.g: when a listener starts after a migration
+func (c *ColumnTypes) Forget(table string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.tables, table)
+}
+
+// DecodeRows decodes values of the 'old' and 'new' rows of the payload, depending on the type of each column of the table.
+// Types are queried again once when a row contains a column missing from the cache, e.g: added by a migration.
+func (c *ColumnTypes) DecodeRows(conn *sql.DB, types *TypeRegistry, table string, data map[string]any) error {
+	columnTypes, err := c.Get(conn, table)
+	if err != nil {
+		return err
+	}
+
+	rows := make([]map[string]any, 0, 2)
+	for _, key := range []string{"old", "new"} {
+		if row, ok := data[key].(map[string]any); ok {
+			rows = append(rows, row)
+		}
+	}
+	if hasUnknownColumn(rows, columnTypes) {
+		c.Forget(table)
+		if columnTypes, err = c.Get(conn, table); err != nil {
+			return err
+		}
+	}
+
+	for _, row := range rows {
+		if err := types.DecodeJSONRow(row, columnTypes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasUnknownColumn(rows []map[string]any, columnTypes map[string]uint32) bool {
+	for _, row := range rows {
+		for column := range row {
+			if _, known := columnTypes[column]; !known {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func getColumnTypesSql() string {
+	return `SELECT attname, atttypid FROM pg_attribute WHERE attrelid = $1::regclass AND attnum > 0 AND NOT attisdropped;`
+}
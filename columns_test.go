@@ -0,0 +1,44 @@
+package flash
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestColumnTypesDecodeRows(t *testing.T) {
+	types := NewTypeRegistry()
+	types.Register("hstore", DecodeHstore)
+	types.AddType(&TypeInfo{Oid: 100, Name: "public.hstore", Kind: TypeKindBase})
+
+	// Cached types are used without querying the database
+	columnTypes := NewColumnTypes()
+	columnTypes.tables[`"public"."products"`] = map[string]uint32{"id": int8Oid, "price": 1700, "attributes": 100, "empty": 100}
+
+	var data map[string]any
+	decoder := json.NewDecoder(bytes.NewReader([]byte(`{
+		"old": {"id": 1, "price": 10, "attributes": null, "empty": null},
+		"new": {"id": 1, "price": 12.50, "attributes": "\"color\"=>\"red\"", "empty": null}
+	}`)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+	if err := columnTypes.DecodeRows(nil, types, `"public"."products"`, data); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]any{
+		"old": map[string]any{"id": int64(1), "price": "10", "attributes": nil, "empty": nil},
+		"new": map[string]any{"id": int64(1), "price": "12.50", "attributes": map[string]any{"color": "red"}, "empty": nil},
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("decoded rows = %#v, expected %#v", data, expected)
+	}
+
+	columnTypes.Forget(`"public"."products"`)
+	if _, cached := columnTypes.tables[`"public"."products"`]; cached {
+		t.Error("expected types of the table to be forgotten")
+	}
+}
@@ -0,0 +1,228 @@
+package flash
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github.com/lib/pq"
+	"hash/fnv"
+	"reflect"
+	"time"
+)
+
+type ConsumerGroupConfig struct {
+	Name string // Clients sharing the same name split listeners and partitions between them
+
+	Schema            string        // Default to flash_groups -> schema of the membership table, shared by all groups
+	HeartbeatInterval time.Duration // Default to 5 seconds -> delay between two heartbeats, and membership checks
+	MemberTimeout     time.Duration // Default to 30 seconds -> members without heartbeat are removed, their listeners reassigned
+}
+
+// consumerGroup stores membership in Postgres, and assigns listeners and partitions to alive members.
+// Assignment uses rendezvous hashing, so only units of joining/leaving members move on rebalance.
+type consumerGroup struct {
+	config       *ConsumerGroupConfig
+	clientConfig *ClientConfig
+
+	memberId string
+	members  []string // Alive members, sorted
+	db       *sql.DB
+}
+
+func newConsumerGroup(clientConfig *ClientConfig) *consumerGroup {
+	config := clientConfig.ConsumerGroup
+	if config.Schema == "" {
+		config.Schema = "flash_groups"
+	}
+	if config.HeartbeatInterval == time.Duration(0) {
+		config.HeartbeatInterval = 5 * time.Second
+	}
+	if config.MemberTimeout == time.Duration(0) {
+		config.MemberTimeout = 30 * time.Second
+	}
+
+	memberId := make([]byte, 8)
+	if _, err := rand.Read(memberId); err != nil {
+		panic(err)
+	}
+
+	return &consumerGroup{
+		config:       config,
+		clientConfig: clientConfig,
+		memberId:     hex.EncodeToString(memberId),
+	}
+}
+
+// join registers this member and loads alive members
+func (g *consumerGroup) join() error {
+	connector, err := pq.NewConnector(g.clientConfig.DatabaseCnx)
+	if err != nil {
+		return err
+	}
+	g.db = sql.OpenDB(connector)
+
+	if _, err := g.db.Exec(fmt.Sprintf(`
+		CREATE SCHEMA IF NOT EXISTS "%s";
+		CREATE TABLE IF NOT EXISTS "%s"."members" (
+			group_name TEXT NOT NULL,
+			member_id TEXT NOT NULL,
+			heartbeat_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (group_name, member_id)
+		);`, g.config.Schema, g.config.Schema)); err != nil {
+		return err
+	}
+
+	_, err = g.refresh()
+	return err
+}
+
+// refresh sends a heartbeat, removes expired members and reloads alive members.
+// Returns true when membership changed.
+func (g *consumerGroup) refresh() (bool, error) {
+	tx, err := g.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.Exec(fmt.Sprintf(`INSERT INTO "%s"."members" (group_name, member_id) VALUES ($1, $2)
+		ON CONFLICT (group_name, member_id) DO UPDATE SET heartbeat_at = now();`, g.config.Schema),
+		g.config.Name, g.memberId); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM "%s"."members" WHERE group_name = $1 AND heartbeat_at < now() - $2 * INTERVAL '1 millisecond';`, g.config.Schema),
+		g.config.Name, g.config.MemberTimeout.Milliseconds()); err != nil {
+		return false, err
+	}
+
+	rows, err := tx.Query(fmt.Sprintf(`SELECT member_id FROM "%s"."members" WHERE group_name = $1 ORDER BY member_id;`, g.config.Schema), g.config.Name)
+	if err != nil {
+		return false, err
+	}
+	var members []string
+	for rows.Next() {
+		var memberId string
+		if err := rows.Scan(&memberId); err != nil {
+			_ = rows.Close()
+			return false, err
+		}
+		members = append(members, memberId)
+	}
+	if err := rows.Close(); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	changed := !reflect.DeepEqual(members, g.members)
+	g.members = members
+	return changed, nil
+}
+
+// watch refreshes membership periodically, and calls rebalance when it changes
+func (g *consumerGroup) watch(ctx context.Context, rebalance func() error, errChan chan<- error) {
+	ticker := time.NewTicker(g.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := g.refresh()
+			if err != nil {
+				g.clientConfig.Logger.Warn().Err(err).Str("group", g.config.Name).Msg("could not refresh consumer group membership")
+				continue
+			}
+			if !changed {
+				continue
+			}
+
+			g.clientConfig.Logger.Debug().Str("group", g.config.Name).Strs("members", g.members).Msg("rebalancing consumer group")
+			if err := rebalance(); err != nil {
+				select {
+				case errChan <- err:
+				case <-ctx.Done():
+				}
+				return
+			}
+			g.clientConfig.EmitLifecycleEvent(&LifecycleEvent{Type: LifecycleRebalanced})
+		}
+	}
+}
+
+// owns checks if the unit is assigned to this member
+func (g *consumerGroup) owns(unit string) bool {
+	var owner string
+	var ownerWeight uint64
+	for _, memberId := range g.members {
+		hash := fnv.New64a()
+		_, _ = hash.Write([]byte(memberId + "\x00" + unit))
+		if weight := hash.Sum64(); owner == "" || weight > ownerWeight {
+			owner, ownerWeight = memberId, weight
+		}
+	}
+	return owner == g.memberId
+}
+
+// assignment returns the partitions of the listener assigned to this member.
+// Listeners without PartitionKey are a single unit: nil means not assigned, an empty slice means assigned.
+func (g *consumerGroup) assignment(config *ListenerConfig) []int {
+	key := getListenerGroupKey(config)
+	if config.PartitionKey == "" {
+		if g.owns(key) {
+			return []int{}
+		}
+		return nil
+	}
+
+	var partitions []int
+	for partition := 0; partition < config.Partitions; partition++ {
+		if g.owns(fmt.Sprintf("%s#%d", key, partition)) {
+			partitions = append(partitions, partition)
+		}
+	}
+	return partitions
+}
+
+// leave removes this member, remaining members rebalance on their next heartbeat
+func (g *consumerGroup) leave() error {
+	if g.db == nil {
+		return nil
+	}
+	if _, err := g.db.Exec(fmt.Sprintf(`DELETE FROM "%s"."members" WHERE group_name = $1 AND member_id = $2;`, g.config.Schema),
+		g.config.Name, g.memberId); err != nil {
+		return err
+	}
+	return g.db.Close()
+}
+
+// getListenerGroupKey identifies a listener across members, which must attach the same listeners
+func getListenerGroupKey(config *ListenerConfig) string {
+	key := fmt.Sprintf("%s|%v|%s|%d", config.Table, config.Fields, config.PartitionKey, config.Partitions)
+	if config.MessagePrefix != "" {
+		key = "message|" + config.MessagePrefix
+	}
+	if config.Channel != "" {
+		key = "channel|" + config.Channel
+	}
+	for _, condition := range config.Conditions {
+		key += fmt.Sprintf("|%s=%v", condition.Column, condition.Value)
+	}
+	return key
+}
+
+// PartitionOf returns the partition of a value, for drivers filtering rows in Go.
+// The 32-bit FNV-1a hash of its text is used, drivers filtering rows in SQL use the same hash of the ::TEXT representation,
+// so integer, text, uuid, boolean and numeric keys get the same partition with every driver. Null values are in partition 0.
+func PartitionOf(value any, partitions int) int {
+	if value == nil {
+		return 0
+	}
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(fmt.Sprint(value)))
+	return int(hash.Sum32() % uint32(partitions))
+}
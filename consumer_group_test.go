@@ -0,0 +1,72 @@
+package flash
+
+import (
+	"testing"
+)
+
+func TestConsumerGroupAssignment(t *testing.T) {
+	members := []string{"a", "b", "c"}
+	groups := make([]*consumerGroup, len(members))
+	for i, memberId := range members {
+		groups[i] = &consumerGroup{memberId: memberId, members: members}
+	}
+
+	config := &ListenerConfig{Table: "posts", PartitionKey: "id", Partitions: 16}
+	owners := make(map[int]int)
+	for _, group := range groups {
+		for _, partition := range group.assignment(config) {
+			owners[partition]++
+		}
+	}
+	for partition := 0; partition < config.Partitions; partition++ {
+		if owners[partition] != 1 {
+			t.Errorf("partition %d owned by %d members, expected 1", partition, owners[partition])
+		}
+	}
+
+	listenerOwners := 0
+	for _, group := range groups {
+		if group.assignment(&ListenerConfig{Table: "comments"}) != nil {
+			listenerOwners++
+		}
+	}
+	if listenerOwners != 1 {
+		t.Errorf("listener owned by %d members, expected 1", listenerOwners)
+	}
+}
+
+func TestListenerConfigIncludesRow(t *testing.T) {
+	config := &ListenerConfig{Table: "posts", PartitionKey: "id", Partitions: 4}
+	if !config.IncludesRow(&EventData{"id": 1}) {
+		t.Errorf("expected all rows to be included without assignment")
+	}
+
+	config.setOwnedPartitions([]int{PartitionOf(1, 4)})
+	if !config.IncludesRow(&EventData{"id": 1}) {
+		t.Errorf("expected row of owned partition to be included")
+	}
+	for id := 0; id < 100; id++ {
+		expected := PartitionOf(id, 4) == config.OwnedPartitions()[0]
+		if config.IncludesRow(&EventData{"id": id}) != expected {
+			t.Errorf("id %d: expected IncludesRow = %v", id, expected)
+		}
+	}
+}
+
+func TestPartitionOf(t *testing.T) {
+	// Same text, same partition: SQL drivers hash the ::TEXT representation
+	if PartitionOf(int64(42), 16) != PartitionOf("42", 16) {
+		t.Errorf("expected integers and their text to share the same partition")
+	}
+	// FNV-1a of "42" is 0x87e38583
+	if partition := PartitionOf("42", 1000); partition != 0x87e38583%1000 {
+		t.Errorf("PartitionOf(\"42\", 1000) = %d, expected %d", partition, 0x87e38583%1000)
+	}
+	if PartitionOf(nil, 16) != 0 {
+		t.Errorf("expected null values in partition 0")
+	}
+
+	if _, err := NewListener(&ListenerConfig{Table: "posts", Fields: []string{"slug"}, PartitionKey: "id"}); err == nil {
+		t.Errorf("expected partition key outside of fields to be rejected")
+	}
+}
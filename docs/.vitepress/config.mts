@@ -88,6 +88,7 @@ function sidebarGuide(): DefaultTheme.SidebarItem[] {
             items: [
                 {text: 'Start listening', link: 'start-listening'},
                 {text: 'Advanced Features', link: 'advanced-features'},
+                {text: 'Testing', link: 'testing'},
                 {text: 'Drivers Overview', link: 'drivers/'},
             ]
         },
@@ -99,6 +100,7 @@ function sidebarGuide(): DefaultTheme.SidebarItem[] {
             items: [
                 {text: 'Trigger', link: 'trigger/'},
                 {text: 'WAL Logical', link: 'wal_logical/',},
+                {text: 'Polling', link: 'polling/'},
             ]
         },
 
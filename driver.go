@@ -1,5 +1,10 @@
 package flash
 
+import "errors"
+
+// ErrOperationNotSupported is returned by drivers on listen start of an operation they cannot handle
+var ErrOperationNotSupported = errors.New("operation not supported by this driver")
+
 type DatabaseEvent struct {
 	ListenerUid string
 	Event       Event
@@ -13,3 +18,10 @@ type Driver interface {
 	HandleOperationListenStop(listenerUid string, listenerConfig *ListenerConfig, operation Operation) error
 	Listen(eventsChan *DatabaseEventsChan) error
 }
+
+// PartitionsUpdateHandler is implemented by drivers filtering rows of consumer group members on the database side.
+// HandlePartitionsUpdate is called when the owned partitions of a provisioned listener change, see ListenerConfig.OwnedPartitions.
+// Drivers filtering rows with ListenerConfig.IncludesRow read the new partitions on next change and do not implement it.
+type PartitionsUpdateHandler interface {
+	HandlePartitionsUpdate(listenerUid string, listenerConfig *ListenerConfig, operation Operation) error
+}
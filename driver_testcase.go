@@ -8,6 +8,7 @@ import (
 	"github.com/testcontainers/testcontainers-go/modules/postgres"
 	"io"
 	"os"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -56,8 +57,8 @@ func runTests(t *testing.T, test TestFn, driver Driver, tc *DriverTestConfig, cc
 
 	/* ------------------------------------------- RUNTIME TEST-------------------------------*/
 	_ = driver.Init(cc)
+	eventChan := make(DatabaseEventsChan)
 	go func() {
-		eventChan := make(DatabaseEventsChan)
 		_ = driver.Listen(&eventChan)
 	}()
 	defer driver.Close()
@@ -125,6 +126,118 @@ func runTests(t *testing.T, test TestFn, driver Driver, tc *DriverTestConfig, cc
 		}
 	}
 
+	/* ------------------------------------------- PARTITIONED TABLES TEST-------------------------------*/
+	test(t, "Partitioned table receives changes of its partitions, including partitions attached later", func(t *testing.T) {
+		lc := &ListenerConfig{Table: "events"}
+		if err := driver.HandleOperationListenStart("uid-partitioned", lc, OperationInsert); err != nil {
+			t.Fatalf("HandleOperationListenStart returned an error: %v", err)
+		}
+		defer driver.HandleOperationListenStop("uid-partitioned", lc, OperationInsert)
+		time.Sleep(tc.RegistrationTimeout) // Some drivers register listeners asynchronously
+
+		execSql(t, `
+			CREATE TABLE events_2025 PARTITION OF events FOR VALUES FROM ('2025-01-01') TO ('2026-01-01');
+			INSERT INTO events (name, created_at) VALUES ('attached', '2025-06-01');
+			INSERT INTO events_2024 (name, created_at) VALUES ('direct', '2024-06-01');`)
+
+		var names []any
+		for len(names) < 2 {
+			select {
+			case received := <-eventChan:
+				insertEvent, ok := received.Event.(*InsertEvent)
+				if !ok || received.ListenerUid != "uid-partitioned" {
+					t.Fatalf("unexpected event %T for listener %s", received.Event, received.ListenerUid)
+				}
+				names = append(names, (*insertEvent.New)["name"])
+			case <-time.After(tc.PropagationTimeout):
+				t.Fatalf("received %d events before timeout, expected 2", len(names))
+			}
+		}
+		if names[0] != "attached" || names[1] != "direct" {
+			t.Errorf("received names %v, expected [attached direct]", names)
+		}
+	}, true)
+
+	/* ------------------------------------------- VALUES TEST-------------------------------*/
+	test(t, "Values are decoded to the same Go types by all drivers", func(t *testing.T) {
+		lc := &ListenerConfig{Table: "typed_values"}
+		if err := driver.HandleOperationListenStart("uid-values", lc, OperationInsert); err != nil {
+			t.Fatalf("HandleOperationListenStart returned an error: %v", err)
+		}
+		defer driver.HandleOperationListenStop("uid-values", lc, OperationInsert)
+		time.Sleep(tc.RegistrationTimeout)
+
+		execSql(t, `
+			INSERT INTO typed_values (i2, i4, i8, r, d, n, t, b, by, tz, ts, dt, u, j, ia, ta, m, p, a)
+			VALUES (1, 2, 3, 1.5, 2.25, 12.50, 'hello', true, '\x0102', '2024-01-02 03:04:05.123456+02', '2024-01-02 03:04:05',
+				'2024-01-02', 'a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11', '{"a": 1, "b": [true, null]}', '{1,2}', '{"a b",NULL}',
+				'happy', 5, ROW(7, 'Main Street'));`)
+
+		expected := EventData{
+			"id": int64(1), "i2": int64(1), "i4": int64(2), "i8": int64(3),
+			"r": float64(1.5), "d": float64(2.25), "n": "12.50", "t": "hello", "b": true, "by": []byte{1, 2},
+			"tz": time.Date(2024, 1, 2, 1, 4, 5, 123456000, time.UTC),
+			"ts": time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			"dt": time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+			"u":  "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11",
+			"j":  map[string]any{"a": float64(1), "b": []any{true, nil}},
+			"ia": []any{int64(1), int64(2)}, "ta": []any{"a b", nil},
+			"m": "happy", "p": int64(5), "a": map[string]any{"number": int64(7), "street": "Main Street"},
+		}
+
+		select {
+		case received := <-eventChan:
+			insertEvent, ok := received.Event.(*InsertEvent)
+			if !ok || received.ListenerUid != "uid-values" {
+				t.Fatalf("unexpected event %T for listener %s", received.Event, received.ListenerUid)
+			}
+			if len(*insertEvent.New) != len(expected) {
+				t.Errorf("received %d columns, expected %d", len(*insertEvent.New), len(expected))
+			}
+			for column, expectedValue := range expected {
+				value := (*insertEvent.New)[column]
+				if reflect.TypeOf(value) != reflect.TypeOf(expectedValue) || !ValuesEqual(value, expectedValue) {
+					t.Errorf("column %s = %#v, expected %#v", column, value, expectedValue)
+				}
+			}
+		case <-time.After(tc.PropagationTimeout):
+			t.Fatal("no event received before timeout")
+		}
+	}, true)
+
+	test(t, "Conditions compare values in the same way in all drivers", func(t *testing.T) {
+		lc := &ListenerConfig{Table: "typed_values", Fields: []string{"i4", "t"}, Conditions: []*ListenerCondition{
+			{Column: "i4", Value: 2},
+			{Column: "t", Value: "it's"},
+		}}
+		if err := driver.HandleOperationListenStart("uid-conditions", lc, OperationInsert); err != nil {
+			t.Fatalf("HandleOperationListenStart returned an error: %v", err)
+		}
+		defer driver.HandleOperationListenStop("uid-conditions", lc, OperationInsert)
+		time.Sleep(tc.RegistrationTimeout)
+
+		execSql(t, `
+			INSERT INTO typed_values (i4, t) VALUES (3, 'it''s');
+			INSERT INTO typed_values (i4, t) VALUES (2, 'it''s');`)
+
+		select {
+		case received := <-eventChan:
+			insertEvent, ok := received.Event.(*InsertEvent)
+			if !ok || received.ListenerUid != "uid-conditions" {
+				t.Fatalf("unexpected event %T for listener %s", received.Event, received.ListenerUid)
+			}
+			if (*insertEvent.New)["i4"] != int64(2) || (*insertEvent.New)["t"] != "it's" {
+				t.Errorf("received %v, expected i4=2 and t=it's", *insertEvent.New)
+			}
+		case <-time.After(tc.PropagationTimeout):
+			t.Fatal("no event received before timeout")
+		}
+		select {
+		case received := <-eventChan:
+			t.Errorf("unexpected event %T for listener %s", received.Event, received.ListenerUid)
+		case <-time.After(tc.PropagationTimeout):
+		}
+	}, true)
 }
 
 type DriverTestConfig struct {
@@ -169,7 +282,7 @@ var DefaultDriverTestConfig = &DriverTestConfig{
 	Username: "testuser",
 	Password: "testpasword",
 
-	PropagationTimeout:  time.Second,
+	PropagationTimeout:  2 * time.Second, // Polling driver checks the change log every second
 	RegistrationTimeout: time.Second,
 
 	Parallel: false, // DO NOT WORK
@@ -194,6 +307,7 @@ func RunFlashDriverTestCase[T Driver](t *testing.T, config *DriverTestConfig, ge
 				DatabaseCnx: dbCnx,
 				Driver:      driverInstance,
 				Logger:      &logger,
+				Types:       NewTypeRegistry(),
 			}
 
 			testFn := func(t *testing.T, name string, f func(t *testing.T), restore bool) {
@@ -306,7 +420,43 @@ INSERT INTO posts (slug, active) VALUES
 ('slug17', true),
 ('slug18', false),
 ('slug19', true),
-(NULL, false)
+(NULL, false);
+
+CREATE TABLE events (
+    id SERIAL,
+    name VARCHAR(255),
+    created_at DATE NOT NULL,
+    PRIMARY KEY (id, created_at)
+) PARTITION BY RANGE (created_at);
+
+CREATE TABLE events_2024 PARTITION OF events FOR VALUES FROM ('2024-01-01') TO ('2025-01-01');
+
+CREATE TYPE mood AS ENUM ('happy', 'sad');
+CREATE DOMAIN positive AS INTEGER CHECK (VALUE > 0);
+CREATE TYPE address AS (number INTEGER, street TEXT);
+
+CREATE TABLE typed_values (
+    id SERIAL PRIMARY KEY,
+    i2 SMALLINT,
+    i4 INTEGER,
+    i8 BIGINT,
+    r REAL,
+    d DOUBLE PRECISION,
+    n NUMERIC(10, 2),
+    t TEXT,
+    b BOOLEAN,
+    by BYTEA,
+    tz TIMESTAMPTZ,
+    ts TIMESTAMP,
+    dt DATE,
+    u UUID,
+    j JSONB,
+    ia INTEGER[],
+    ta TEXT[],
+    m mood,
+    p positive,
+    a address
+);
 `
 
 func restoreSnapshot(t *testing.T, container *postgres.PostgresContainer) {
@@ -0,0 +1,358 @@
+package polling
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/quix-labs/flash"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+type DriverConfig struct {
+	Schema       string        // The schema name, can be shared by multiple instances: each instance only drops its own objects
+	PollInterval time.Duration // Default to 1 second -> delay between two polls of the change log
+	BatchSize    int           // Default to 1000 -> maximum rows fetched per query
+}
+
+var (
+	_ flash.Driver = (*Driver)(nil) // Interface implementation
+)
+
+func NewDriver(config *DriverConfig) *Driver {
+	if config == nil {
+		config = &DriverConfig{}
+	}
+	if config.Schema == "" {
+		config.Schema = "flash_polling"
+	}
+	if config.PollInterval == time.Duration(0) {
+		config.PollInterval = time.Second
+	}
+	if config.BatchSize == 0 {
+		config.BatchSize = 1000
+	}
+	return &Driver{
+		Config:         config,
+		activeEvents:   make(map[string]activeEvent),
+		listenerTables: make(map[string]string),
+		columnTypes:    flash.NewColumnTypes(),
+	}
+}
+
+type Driver struct {
+	Config *DriverConfig
+
+	conn     *sql.DB
+	shutdown chan bool
+
+	activeEventsMutex sync.RWMutex
+	activeEvents      map[string]activeEvent // key: listenerUid + operation
+	listenerTables    map[string]string      // key: listenerUid, value: quoted table, guarded by activeEventsMutex
+
+	columnTypes   *flash.ColumnTypes // Types of listened tables, used to decode payloads
+	_clientConfig *flash.ClientConfig
+}
+
+type activeEvent struct {
+	listenerUid string
+	operation   flash.Operation
+}
+
+func (d *Driver) HandleOperationListenStart(listenerUid string, lc *flash.ListenerConfig, operation flash.Operation) error {
+	if operation == flash.OperationMessage || operation == flash.OperationNotification {
+		return fmt.Errorf("%w: %s", flash.ErrOperationNotSupported, operation)
+	}
+	createTriggerSql, err := d.getCreateTriggerSqlForOperation(listenerUid, lc, &operation)
+	if err != nil {
+		return err
+	}
+	if _, err = d.sqlExec(d.conn, createTriggerSql); err != nil {
+		return err
+	}
+
+	// Types are queried again, the table may have changed since previous listeners
+	d.columnTypes.Forget(d.sanitizeTableName(lc.Table))
+
+	d.activeEventsMutex.Lock()
+	defer d.activeEventsMutex.Unlock()
+	d.activeEvents[d.getActiveEventKey(listenerUid, operation)] = activeEvent{listenerUid, operation}
+	d.listenerTables[listenerUid] = d.sanitizeTableName(lc.Table)
+	return nil
+}
+
+func (d *Driver) HandleOperationListenStop(listenerUid string, lc *flash.ListenerConfig, operation flash.Operation) error {
+	if operation == flash.OperationMessage || operation == flash.OperationNotification {
+		return nil // Never started
+	}
+	deleteTriggerSql, err := d.getDeleteTriggerSqlForOperation(listenerUid, &operation)
+	if err != nil {
+		return err
+	}
+	if _, err = d.sqlExec(d.conn, deleteTriggerSql); err != nil {
+		return err
+	}
+
+	d.activeEventsMutex.Lock()
+	defer d.activeEventsMutex.Unlock()
+	delete(d.activeEvents, d.getActiveEventKey(listenerUid, operation))
+	for _, event := range d.activeEvents {
+		if event.listenerUid == listenerUid {
+			return nil
+		}
+	}
+	delete(d.listenerTables, listenerUid)
+	return nil
+}
+
+func (d *Driver) Init(_clientConfig *flash.ClientConfig) error {
+	d._clientConfig = _clientConfig
+
+	parsedCnx, err := url.Parse(d._clientConfig.DatabaseCnx)
+	if err != nil {
+		return err
+	}
+
+	query := parsedCnx.Query()
+	query.Set("application_name", "Flash: polling")
+	parsedCnx.RawQuery = query.Encode()
+
+	connector, err := pq.NewConnector(parsedCnx.String())
+	if err != nil {
+		return err
+	}
+
+	d.conn = sql.OpenDB(connector)
+
+	if err := d._clientConfig.Types.Load(d._clientConfig.DatabaseCnx); err != nil {
+		return err
+	}
+
+	// Create schema and change log if not exists
+	if _, err := d.sqlExec(d.conn, d.getBootstrapSql()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *Driver) Listen(eventsChan *flash.DatabaseEventsChan) error {
+	shutdown := make(chan bool)
+	d.shutdown = shutdown
+
+	ticker := time.NewTicker(d.Config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-shutdown:
+			return nil
+
+		case <-ticker.C:
+			// Keep polling until the change log is drained
+			for {
+				count, err := d.poll(eventsChan)
+				if err != nil {
+					return err
+				}
+				if count < d.Config.BatchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+type changeLogEntry struct {
+	id          int64
+	listenerUid string
+	operation   flash.Operation
+	payload     []byte
+}
+
+// poll consumes one batch of the change log and dispatch all entries, returns the number of consumed rows
+func (d *Driver) poll(eventsChan *flash.DatabaseEventsChan) (int, error) {
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Only changes of listeners of this instance are consumed, other instances may share the schema
+	d.activeEventsMutex.RLock()
+	listenerUids := make([]string, 0, len(d.activeEvents))
+	for _, event := range d.activeEvents {
+		listenerUids = append(listenerUids, event.listenerUid)
+	}
+	d.activeEventsMutex.RUnlock()
+	if len(listenerUids) == 0 {
+		return 0, nil
+	}
+
+	rawSql := d.getConsumeChangesSql()
+	d._clientConfig.Logger.Trace().Str("query", rawSql).Msg("sending sql request")
+	rows, err := tx.Query(rawSql, d.Config.BatchSize, pq.Array(listenerUids))
+	if err != nil {
+		return 0, err
+	}
+
+	var entries []*changeLogEntry
+	for rows.Next() {
+		var rawOperation string
+		var payload sql.NullString
+		entry := &changeLogEntry{}
+		if err := rows.Scan(&entry.id, &entry.listenerUid, &rawOperation, &payload); err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+		if entry.operation, err = flash.OperationFromName(rawOperation); err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+		if payload.Valid {
+			entry.payload = []byte(payload.String)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// DELETE ... RETURNING does not guarantee order
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].id < entries[j].id
+	})
+
+	for _, entry := range entries {
+		d.activeEventsMutex.RLock()
+		_, active := d.activeEvents[d.getActiveEventKey(entry.listenerUid, entry.operation)]
+		table := d.listenerTables[entry.listenerUid]
+		d.activeEventsMutex.RUnlock()
+		if !active {
+			continue
+		}
+		if err := d.dispatch(eventsChan, entry, table); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+func (d *Driver) dispatch(eventsChan *flash.DatabaseEventsChan, entry *changeLogEntry, table string) error {
+	var data map[string]any
+	if entry.payload != nil {
+		// Keep numbers as json.Number, to decode them depending on the column type
+		decoder := json.NewDecoder(bytes.NewReader(entry.payload))
+		decoder.UseNumber()
+		if err := decoder.Decode(&data); err != nil {
+			return err
+		}
+		if err := d.columnTypes.DecodeRows(d.conn, d._clientConfig.Types, table, data); err != nil {
+			return err
+		}
+	}
+	var newData, oldData *flash.EventData = nil, nil
+	if data != nil {
+		if nd, exists := data["new"]; exists && nd != nil {
+			typedData := flash.EventData(nd.(map[string]any))
+			newData = &typedData
+		}
+		if od, exists := data["old"]; exists && od != nil {
+			typedData := flash.EventData(od.(map[string]any))
+			oldData = &typedData
+		}
+	}
+
+	switch entry.operation {
+	case flash.OperationInsert:
+		*eventsChan <- &flash.DatabaseEvent{
+			ListenerUid: entry.listenerUid,
+			Event:       &flash.InsertEvent{New: newData},
+		}
+	case flash.OperationUpdate:
+		// Custom conditions if update to handle soft deletes
+		var previouslyMatch, newlyMatch bool = true, true
+		if nc, exists := data["new_condition"]; exists && nc != nil {
+			newlyMatch = nc.(bool)
+		}
+		if oc, exists := data["old_condition"]; exists && oc != nil {
+			previouslyMatch = oc.(bool)
+		}
+
+		if !previouslyMatch && newlyMatch {
+			*eventsChan <- &flash.DatabaseEvent{
+				ListenerUid: entry.listenerUid,
+				Event:       &flash.InsertEvent{New: newData},
+			}
+		} else if previouslyMatch && !newlyMatch {
+			*eventsChan <- &flash.DatabaseEvent{
+				ListenerUid: entry.listenerUid,
+				Event:       &flash.DeleteEvent{Old: oldData},
+			}
+		} else if previouslyMatch && newlyMatch {
+			*eventsChan <- &flash.DatabaseEvent{
+				ListenerUid: entry.listenerUid,
+				Event:       &flash.UpdateEvent{New: newData, Old: oldData},
+			}
+		}
+	case flash.OperationDelete:
+		*eventsChan <- &flash.DatabaseEvent{
+			ListenerUid: entry.listenerUid,
+			Event:       &flash.DeleteEvent{Old: oldData},
+		}
+	case flash.OperationTruncate:
+		*eventsChan <- &flash.DatabaseEvent{
+			ListenerUid: entry.listenerUid,
+			Event:       &flash.TruncateEvent{},
+		}
+	default:
+		return fmt.Errorf("unknown operation: %d", entry.operation)
+	}
+	return nil
+}
+
+func (d *Driver) Close() error {
+	if d.shutdown != nil {
+		close(d.shutdown)
+		d.shutdown = nil
+	}
+
+	if d.conn == nil {
+		return nil
+	}
+
+	// Drop triggers and pending changes of this instance only, the schema may be used by other instances
+	d.activeEventsMutex.Lock()
+	var deleteTriggersSql string
+	for _, event := range d.activeEvents {
+		deleteTriggerSql, err := d.getDeleteTriggerSqlForOperation(event.listenerUid, &event.operation)
+		if err != nil {
+			d.activeEventsMutex.Unlock()
+			return err
+		}
+		deleteTriggersSql += deleteTriggerSql
+	}
+	d.activeEvents = make(map[string]activeEvent)
+	d.listenerTables = make(map[string]string)
+	d.activeEventsMutex.Unlock()
+
+	if deleteTriggersSql != "" {
+		if _, err := d.sqlExec(d.conn, deleteTriggersSql); err != nil {
+			return err
+		}
+	}
+
+	// Close active connection
+	if err := d.conn.Close(); err != nil {
+		return err
+	}
+	d.conn = nil
+	return nil
+}
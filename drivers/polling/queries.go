@@ -0,0 +1,227 @@
+package polling
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/quix-labs/flash"
+	"strings"
+)
+
+func (d *Driver) getBootstrapSql() string {
+	return fmt.Sprintf(`
+		CREATE SCHEMA IF NOT EXISTS "%s";
+		CREATE TABLE IF NOT EXISTS "%s"."changes" (
+			id BIGSERIAL PRIMARY KEY,
+			listener_uid TEXT NOT NULL,
+			operation TEXT NOT NULL,
+			payload JSONB
+		);`, d.Config.Schema, d.Config.Schema)
+}
+
+// getConsumeChangesSql returns a query which removes a batch of the change log of the given listeners and returns removed rows.
+// SKIP LOCKED allows running multiple pollers without blocking each other.
+func (d *Driver) getConsumeChangesSql() string {
+	return fmt.Sprintf(`
+		DELETE FROM "%s"."changes" WHERE id IN (
+			SELECT id FROM "%s"."changes" WHERE listener_uid = ANY($2) ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED
+		) RETURNING id, listener_uid, operation, payload::TEXT;`, d.Config.Schema, d.Config.Schema)
+}
+
+func (d *Driver) getCreateTriggerSqlForOperation(listenerUid string, l *flash.ListenerConfig, e *flash.Operation) (string, error) {
+	uniqueName, err := d.getUniqueIdentifierForListenerEvent(listenerUid, e)
+	if err != nil {
+		return "", err
+	}
+
+	operation, err := e.StrictName()
+	if err != nil {
+		return "", err
+	}
+
+	triggerName := uniqueName + "_trigger"
+	triggerFnName := uniqueName + "_fn"
+
+	var rawFields, rawConditionSql string
+	if len(l.Fields) == 0 {
+		rawFields = `JSONB_BUILD_OBJECT('old',to_jsonb(OLD),'new',to_jsonb(NEW))`
+
+		switch operation {
+		case "DELETE":
+			if len(l.Conditions) > 0 {
+				if rawConditionSql, err = flash.ConditionsSql(l.Conditions, "OLD"); err != nil {
+					return "", err
+				}
+			}
+		case "INSERT":
+			if len(l.Conditions) > 0 {
+				if rawConditionSql, err = flash.ConditionsSql(l.Conditions, "NEW"); err != nil {
+					return "", err
+				}
+			}
+		case "UPDATE":
+			if len(l.Conditions) > 0 {
+				oldConditionsSql, err := flash.ConditionsSql(l.Conditions, "OLD")
+				if err != nil {
+					return "", err
+				}
+				newConditionsSql, err := flash.ConditionsSql(l.Conditions, "NEW")
+				if err != nil {
+					return "", err
+				}
+				rawConditionSql = fmt.Sprintf(`(%s) OR (%s)`, oldConditionsSql, newConditionsSql)
+				rawFields = fmt.Sprintf(
+					`JSONB_BUILD_OBJECT('old',to_jsonb(OLD),'new',to_jsonb(NEW),'old_condition',%s,'new_condition',%s)`,
+					oldConditionsSql,
+					newConditionsSql,
+				)
+			}
+		}
+	} else {
+		switch operation {
+		case "TRUNCATE":
+			rawFields = "null"
+		case "DELETE":
+			if len(l.Conditions) > 0 {
+				if rawConditionSql, err = flash.ConditionsSql(l.Conditions, "OLD"); err != nil {
+					return "", err
+				}
+			}
+			rawFields = fmt.Sprintf(`JSONB_BUILD_OBJECT('old',JSONB_BUILD_OBJECT(%s))`, d.getJsonFieldsSql(l.Fields, "OLD"))
+		case "INSERT":
+			if len(l.Conditions) > 0 {
+				if rawConditionSql, err = flash.ConditionsSql(l.Conditions, "NEW"); err != nil {
+					return "", err
+				}
+			}
+			rawFields = fmt.Sprintf(`JSONB_BUILD_OBJECT('new',JSONB_BUILD_OBJECT(%s))`, d.getJsonFieldsSql(l.Fields, "NEW"))
+		case "UPDATE":
+			// Build raw conditions for field updates
+			rawConditions := make([]string, len(l.Fields))
+			for i, field := range l.Fields {
+				rawConditions[i] = fmt.Sprintf(`(OLD."%s" IS DISTINCT FROM NEW."%s")`, field, field)
+			}
+			rawConditionSql = strings.Join(rawConditions, " OR ")
+
+			// Build conditions for soft delete check
+			var oldConditionsSql, newConditionsSql string = "null", "null"
+			if len(l.Conditions) > 0 {
+				if oldConditionsSql, err = flash.ConditionsSql(l.Conditions, "OLD"); err != nil {
+					return "", err
+				}
+				if newConditionsSql, err = flash.ConditionsSql(l.Conditions, "NEW"); err != nil {
+					return "", err
+				}
+
+				// Combine update conditions with soft delete conditions
+				rawConditionSql = fmt.Sprintf(`((%s)!=(%s)) OR ((%s) AND (%s))`, oldConditionsSql, newConditionsSql, newConditionsSql, rawConditionSql)
+			}
+
+			rawFields = fmt.Sprintf(
+				`JSONB_BUILD_OBJECT('old',JSONB_BUILD_OBJECT(%s),'new',JSONB_BUILD_OBJECT(%s),'old_condition',%s,'new_condition',%s)`,
+				d.getJsonFieldsSql(l.Fields, "OLD"),
+				d.getJsonFieldsSql(l.Fields, "NEW"),
+				oldConditionsSql,
+				newConditionsSql,
+			)
+		}
+	}
+
+	insertSql := fmt.Sprintf(
+		`INSERT INTO "%s"."changes" (listener_uid, operation, payload) VALUES ('%s', '%s', %s);`,
+		d.Config.Schema, listenerUid, strings.ToLower(operation), rawFields,
+	)
+
+	var statement string
+	if rawConditionSql == "" {
+		statement = fmt.Sprintf(`
+			CREATE OR REPLACE FUNCTION "%s"."%s"() RETURNS trigger AS $trigger$
+			BEGIN
+				%s
+				RETURN COALESCE(NEW, OLD);
+			END;
+			$trigger$ LANGUAGE plpgsql VOLATILE;`,
+			d.Config.Schema, triggerFnName, insertSql)
+	} else {
+		statement = fmt.Sprintf(`
+			CREATE OR REPLACE FUNCTION "%s"."%s"() RETURNS trigger AS $trigger$
+			BEGIN
+				IF %s THEN
+					%s
+				END IF;
+				RETURN COALESCE(NEW, OLD);
+			END;
+			$trigger$ LANGUAGE plpgsql VOLATILE;`,
+			d.Config.Schema, triggerFnName, rawConditionSql, insertSql)
+	}
+
+	if operation != "TRUNCATE" {
+		// Keep drop + create instead of 'create or replace' for Pgsql13 compatibility
+		statement += fmt.Sprintf(`
+			DROP TRIGGER IF EXISTS "%s" ON %s;
+			CREATE TRIGGER "%s" AFTER %s ON %s FOR EACH ROW EXECUTE PROCEDURE "%s"."%s"();`,
+			triggerName, d.sanitizeTableName(l.Table), triggerName, operation, d.sanitizeTableName(l.Table), d.Config.Schema, triggerFnName)
+	} else {
+		// Keep drop + create instead of 'create or replace' for Pgsql13 compatibility
+		statement += fmt.Sprintf(`
+			DROP TRIGGER IF EXISTS "%s" ON %s;
+			CREATE TRIGGER "%s" BEFORE TRUNCATE ON %s FOR EACH STATEMENT EXECUTE PROCEDURE "%s"."%s"();`,
+			triggerName, d.sanitizeTableName(l.Table), triggerName, d.sanitizeTableName(l.Table), d.Config.Schema, triggerFnName)
+	}
+
+	return statement, nil
+}
+
+func (d *Driver) getDeleteTriggerSqlForOperation(listenerUid string, e *flash.Operation) (string, error) {
+	uniqueName, err := d.getUniqueIdentifierForListenerEvent(listenerUid, e)
+	if err != nil {
+		return "", err
+	}
+	operationName, err := e.StrictName()
+	if err != nil {
+		return "", err
+	}
+
+	// Changes not consumed yet are no longer consumed by any poller
+	return fmt.Sprintf(`
+		DROP FUNCTION IF EXISTS "%s"."%s" CASCADE;
+		DELETE FROM "%s"."changes" WHERE listener_uid = %s AND operation = %s;`,
+		d.Config.Schema, uniqueName+"_fn",
+		d.Config.Schema, pq.QuoteLiteral(listenerUid), pq.QuoteLiteral(strings.ToLower(operationName))), nil
+}
+
+func (d *Driver) getUniqueIdentifierForListenerEvent(listenerUid string, e *flash.Operation) (string, error) {
+	operationName, err := e.StrictName()
+	if err != nil {
+		return "", err
+	}
+	return strings.Join([]string{
+		listenerUid,
+		strings.ToLower(operationName),
+	}, "_"), nil
+}
+
+func (d *Driver) getActiveEventKey(listenerUid string, operation flash.Operation) string {
+	return listenerUid + "_" + operation.String()
+}
+
+func (d *Driver) getJsonFieldsSql(fields []string, table string) string {
+	jsonFields := make([]string, len(fields))
+	for i, field := range fields {
+		jsonFields[i] = fmt.Sprintf(`'%s', %s."%s"`, field, table, field)
+	}
+	return strings.Join(jsonFields, ",")
+}
+
+func (d *Driver) sanitizeTableName(tableName string) string {
+	segments := strings.Split(tableName, ".")
+	for i, segment := range segments {
+		segments[i] = `"` + strings.ReplaceAll(segment, `"`, "") + `"`
+	}
+	return strings.Join(segments, ".")
+}
+
+func (d *Driver) sqlExec(conn *sql.DB, query string) (sql.Result, error) {
+	d._clientConfig.Logger.Trace().Str("query", query).Msg("sending sql request")
+	return conn.Exec(query)
+}
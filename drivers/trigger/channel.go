@@ -0,0 +1,51 @@
+package trigger
+
+// Custom channels are listened on the same connection as generated ones, without any trigger.
+// The LISTEN is shared by all listeners of a channel.
+
+func (d *Driver) startChannelListener(listenerUid string, channel string) error {
+	d.tableListenersMutex.Lock()
+	defer d.tableListenersMutex.Unlock()
+
+	d.channelsMutex.Lock()
+	if _, exists := d.channelListeners[channel]; !exists {
+		d.channelListeners[channel] = make(map[string]bool)
+	}
+	d.channelListeners[channel][listenerUid] = true
+	first := len(d.channelListeners[channel]) == 1
+	d.channelsMutex.Unlock()
+
+	if !first {
+		return nil
+	}
+	return d.addEventToListened(channel)
+}
+
+func (d *Driver) stopChannelListener(listenerUid string, channel string) error {
+	d.tableListenersMutex.Lock()
+	defer d.tableListenersMutex.Unlock()
+
+	d.channelsMutex.Lock()
+	delete(d.channelListeners[channel], listenerUid)
+	last := len(d.channelListeners[channel]) == 0
+	if last {
+		delete(d.channelListeners, channel)
+	}
+	d.channelsMutex.Unlock()
+
+	if !last {
+		return nil
+	}
+	return d.removeEventToListened(channel)
+}
+
+func (d *Driver) getChannelListeners(channel string) []string {
+	d.channelsMutex.RLock()
+	defer d.channelsMutex.RUnlock()
+
+	listenerUids := make([]string, 0, len(d.channelListeners[channel]))
+	for listenerUid := range d.channelListeners[channel] {
+		listenerUids = append(listenerUids, listenerUid)
+	}
+	return listenerUids
+}
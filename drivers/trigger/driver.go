@@ -3,19 +3,34 @@ package trigger
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/lib/pq"
 	"github.com/quix-labs/flash"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 )
 
 type DriverConfig struct {
-	Schema string // The schema name, which should be unique across all instances
+	Schema string // The schema name, shared by all instances: objects are registered with their owner instance and collected when it dies
+
+	MinReconnectInterval time.Duration // Default to 1 second -> first delay before reconnecting, doubled on each failure
+	MaxReconnectInterval time.Duration // Default to 1 minute -> maximum delay between two reconnection attempts
+	MaxReconnectAttempts int           // Default to 0 (infinite) -> Listen returns an error after N consecutive failures
+
+	StatementLevelTriggers bool // Default to false -> use FOR EACH STATEMENT triggers sending batched payloads
+
+	HeartbeatInterval time.Duration // Default to 10 seconds -> delay between two heartbeats of this instance
+	InstanceTimeout   time.Duration // Default to 1 minute -> objects of instances without heartbeat for this duration are removed
+
+	PayloadRetention time.Duration // Default to 1 hour -> stored payloads never fetched, e.g: notification lost, are removed after this duration
 }
 
 var (
-	_ flash.Driver = (*Driver)(nil) // Interface implementation
+	_ flash.Driver                  = (*Driver)(nil) // Interface implementation
+	_ flash.PartitionsUpdateHandler = (*Driver)(nil)
 )
 
 func NewDriver(config *DriverConfig) *Driver {
@@ -25,12 +40,45 @@ func NewDriver(config *DriverConfig) *Driver {
 	if config.Schema == "" {
 		config.Schema = "flash"
 	}
+	if config.MinReconnectInterval == time.Duration(0) {
+		config.MinReconnectInterval = time.Second
+	}
+	if config.MaxReconnectInterval == time.Duration(0) {
+		config.MaxReconnectInterval = time.Minute
+	}
+	if config.HeartbeatInterval == time.Duration(0) {
+		config.HeartbeatInterval = 10 * time.Second
+	}
+	if config.InstanceTimeout == time.Duration(0) {
+		config.InstanceTimeout = time.Minute
+	}
+	if config.PayloadRetention == time.Duration(0) {
+		config.PayloadRetention = time.Hour
+	}
 	return &Driver{
-		Config:       config,
-		activeEvents: make(map[string]bool),
+		Config:           config,
+		instanceId:       generateInstanceId(),
+		activeEvents:     make(map[string]bool),
+		tableListeners:   make(map[tableOperation]map[string]*flash.ListenerConfig),
+		channels:         make(map[string]*channelTarget),
+		channelListeners: make(map[string]map[string]bool),
+		lastSequences:    make(map[string]int64),
+		pendingGapChecks: make(map[string]bool),
+		columnTypes:      flash.NewColumnTypes(),
 	}
 }
 
+type tableOperation struct {
+	table     string
+	operation flash.Operation
+}
+
+type channelTarget struct {
+	listenerUid string
+	operation   flash.Operation
+	table       string // Quoted table, used to decode payloads
+}
+
 type Driver struct {
 	Config *DriverConfig
 
@@ -41,39 +89,130 @@ type Driver struct {
 	unsubChan chan string
 	shutdown  chan bool
 
-	activeEvents  map[string]bool
-	_clientConfig *flash.ClientConfig
+	instanceId        string
+	heartbeatShutdown chan struct{}
+
+	activeEvents        map[string]bool // key: eventName, written by listener handlers and read by the Listen goroutine
+	activeEventsMutex   sync.RWMutex
+	tableListeners      map[tableOperation]map[string]*flash.ListenerConfig // Listeners sharing the same trigger
+	tableListenersMutex sync.Mutex
+	channels            map[string]*channelTarget  // key: eventName -> listener, operation and table, cache of the channels table
+	channelListeners    map[string]map[string]bool // key 1: custom channel -> key 2: listenerUid, see flash.NewChannelListener
+	channelsMutex       sync.RWMutex
+	lastSequences       map[string]int64   // key: eventName -> last received sequence number
+	pendingGapChecks    map[string]bool    // key: eventName -> check sequence continuity on next notification
+	columnTypes         *flash.ColumnTypes // Types of listened tables, used to decode payloads
+	_clientConfig       *flash.ClientConfig
 }
 
 func (d *Driver) HandleOperationListenStart(listenerUid string, lc *flash.ListenerConfig, operation flash.Operation) error {
-	createTriggerSql, eventName, err := d.getCreateTriggerSqlForOperation(listenerUid, lc, &operation)
+	if operation == flash.OperationMessage {
+		return fmt.Errorf("%w: %s requires logical replication", flash.ErrOperationNotSupported, operation)
+	}
+	if operation == flash.OperationNotification {
+		return d.startChannelListener(listenerUid, lc.Channel)
+	}
+	d.tableListenersMutex.Lock()
+	defer d.tableListenersMutex.Unlock()
+
+	// Types are queried again, the table may have changed since previous listeners
+	d.columnTypes.Forget(d.sanitizeTableName(lc.Table))
+
+	key := tableOperation{table: lc.Table, operation: operation}
+	listeners := make(map[string]*flash.ListenerConfig, len(d.tableListeners[key])+1)
+	for uid, config := range d.tableListeners[key] {
+		listeners[uid] = config
+	}
+	listeners[listenerUid] = lc
+
+	createTriggerSql, err := d.getTableTriggerSql(lc.Table, &operation, listeners)
 	if err != nil {
 		return err
 	}
-	_, err = d.sqlExec(d.conn, createTriggerSql)
+	registerSql, eventName, err := d.getRegisterListenerSql(listenerUid, &operation, d.sanitizeTableName(lc.Table))
 	if err != nil {
 		return err
 	}
+	if _, err = d.sqlExec(d.conn, registerSql+createTriggerSql); err != nil {
+		return err
+	}
+	d.tableListeners[key] = listeners
+
+	d.channelsMutex.Lock()
+	d.channels[eventName] = &channelTarget{listenerUid: listenerUid, operation: operation, table: d.sanitizeTableName(lc.Table)}
+	d.channelsMutex.Unlock()
 
 	return d.addEventToListened(eventName)
 }
 
-func (d *Driver) HandleOperationListenStop(listenerUid string, lc *flash.ListenerConfig, event flash.Operation) error {
-	createTriggerSql, eventName, err := d.getDeleteTriggerSqlForEvent(listenerUid, lc, &event)
+func (d *Driver) HandleOperationListenStop(listenerUid string, lc *flash.ListenerConfig, operation flash.Operation) error {
+	if operation == flash.OperationMessage {
+		return nil // Never started
+	}
+	if operation == flash.OperationNotification {
+		return d.stopChannelListener(listenerUid, lc.Channel)
+	}
+	d.tableListenersMutex.Lock()
+	defer d.tableListenersMutex.Unlock()
+
+	key := tableOperation{table: lc.Table, operation: operation}
+	delete(d.tableListeners[key], listenerUid)
+
+	// Regenerate shared trigger without this listener, or remove it if unused
+	var triggerSql string
+	var err error
+	if len(d.tableListeners[key]) == 0 {
+		delete(d.tableListeners, key)
+		triggerSql, err = d.getDropTableTriggerSql(lc.Table, &operation)
+	} else {
+		triggerSql, err = d.getTableTriggerSql(lc.Table, &operation, d.tableListeners[key])
+	}
 	if err != nil {
 		return err
 	}
-	_, err = d.sqlExec(d.conn, createTriggerSql)
+
+	unregisterSql, eventName, err := d.getUnregisterListenerSql(listenerUid, &operation)
 	if err != nil {
 		return err
 	}
+	if _, err = d.sqlExec(d.conn, triggerSql+unregisterSql); err != nil {
+		return err
+	}
+
+	d.channelsMutex.Lock()
+	delete(d.channels, eventName)
+	d.channelsMutex.Unlock()
 
 	return d.removeEventToListened(eventName)
 }
 
+// HandlePartitionsUpdate regenerates the shared trigger of the table, rows are filtered by owned partitions in its function
+func (d *Driver) HandlePartitionsUpdate(listenerUid string, lc *flash.ListenerConfig, operation flash.Operation) error {
+	if operation == flash.OperationMessage || operation == flash.OperationNotification {
+		return nil
+	}
+	d.tableListenersMutex.Lock()
+	defer d.tableListenersMutex.Unlock()
+
+	key := tableOperation{table: lc.Table, operation: operation}
+	if _, exists := d.tableListeners[key][listenerUid]; !exists {
+		return nil
+	}
+	triggerSql, err := d.getTableTriggerSql(lc.Table, &operation, d.tableListeners[key])
+	if err != nil {
+		return err
+	}
+	_, err = d.sqlExec(d.conn, triggerSql)
+	return err
+}
+
 func (d *Driver) Init(_clientConfig *flash.ClientConfig) error {
 	d._clientConfig = _clientConfig
 
+	if err := d._clientConfig.Types.Load(d._clientConfig.DatabaseCnx); err != nil {
+		return err
+	}
+
 	parsedCnx, err := url.Parse(d._clientConfig.DatabaseCnx)
 	if err != nil {
 		return err
@@ -89,23 +228,26 @@ func (d *Driver) Init(_clientConfig *flash.ClientConfig) error {
 	}
 
 	d.conn = sql.OpenDB(connector)
-	// Create schema if not exists
-	if _, err := d.sqlExec(d.conn, "CREATE SCHEMA IF NOT EXISTS \""+d.Config.Schema+"\";"); err != nil {
+	// Create schema and metadata tables if not exists, register this instance
+	if _, err := d.sqlExec(d.conn, d.getBootstrapSql()); err != nil {
 		return err
 	}
+	d.collectGarbage()
+
+	d.heartbeatShutdown = make(chan struct{})
+	go d.startHeartbeat(d.heartbeatShutdown)
 	return nil
 }
 
-func (d *Driver) Listen(eventsChan *flash.DatabaseEventsChan) error {
-	errChan := make(chan error)
-	d.subChan = make(chan string, len(d.activeEvents))
+func (d *Driver) Listen(eventsChan *flash.DatabaseEventsChan) (err error) {
+	activeEvents := d.getActiveEvents()
+	listenerEventsChan := make(chan *listenerEvent, 1)
+	d.subChan = make(chan string, len(activeEvents))
 	d.unsubChan = make(chan string, 1)
 	d.shutdown = make(chan bool)
 
 	reportProblem := func(ev pq.ListenerEventType, err error) {
-		if err != nil {
-			errChan <- err
-		}
+		listenerEventsChan <- &listenerEvent{eventType: ev, err: err}
 	}
 
 	parsedCnx, err := url.Parse(d._clientConfig.DatabaseCnx)
@@ -117,126 +259,317 @@ func (d *Driver) Listen(eventsChan *flash.DatabaseEventsChan) error {
 	query.Set("application_name", "test_listen")
 	parsedCnx.RawQuery = query.Encode()
 
-	d.pgListener = pq.NewListener(parsedCnx.String(), 1*time.Second, time.Minute, reportProblem)
+	d.pgListener = pq.NewListener(parsedCnx.String(), d.Config.MinReconnectInterval, d.Config.MaxReconnectInterval, reportProblem)
+	defer func() {
+		if closeErr := d.pgListener.Close(); err == nil {
+			err = closeErr
+		}
+	}()
 
 	// Initialize subChan with activeEvents in queue
 	go func() {
-		for eventName := range d.activeEvents {
+		for _, eventName := range activeEvents {
 			d.subChan <- eventName
 		}
 	}()
 
+	failedAttempts := 0
 	for {
 		select {
 
 		case <-d.shutdown:
-			return d.pgListener.Close()
+			return nil
 
-		case err := <-errChan:
-			return err
+		case ev := <-listenerEventsChan:
+			switch ev.eventType {
+			case pq.ListenerEventConnected:
+				failedAttempts = 0
+
+			case pq.ListenerEventDisconnected:
+				d._clientConfig.EmitLifecycleEvent(&flash.LifecycleEvent{Type: flash.LifecycleDisconnected, Err: ev.err})
+
+			case pq.ListenerEventConnectionAttemptFailed:
+				failedAttempts++
+				d._clientConfig.Logger.Warn().Err(ev.err).Int("attempt", failedAttempts).Msg("reconnection attempt failed")
+				if d.Config.MaxReconnectAttempts > 0 && failedAttempts >= d.Config.MaxReconnectAttempts {
+					return fmt.Errorf("could not reconnect after %d attempts: %w", failedAttempts, ev.err)
+				}
+
+			case pq.ListenerEventReconnected:
+				failedAttempts = 0
+				if err := d.handleReconnection(); err != nil {
+					return err
+				}
+			}
 
 		case eventName := <-d.unsubChan:
 			d._clientConfig.Logger.Trace().Str("query", fmt.Sprintf(`UNLISTEN "%s"`, eventName)).Msg("sending sql request")
 			if err := d.pgListener.Unlisten(eventName); err != nil {
 				return err
 			}
+			delete(d.lastSequences, eventName)
 			continue
 
 		case eventName := <-d.subChan:
 			d._clientConfig.Logger.Trace().Str("query", fmt.Sprintf(`LISTEN "%s"`, eventName)).Msg("sending sql request")
-			if err := d.pgListener.Listen(eventName); err != nil {
+			if err := d.pgListener.Listen(eventName); err != nil && !errors.Is(err, pq.ErrChannelAlreadyOpen) {
 				return err
 			}
 			continue
 
 		case notification := <-d.pgListener.Notify:
-			listenerUid, operation, err := d.parseEventName(notification.Channel)
-			if err != nil {
-				errChan <- err
+			// A nil notification is sent after reconnection, handled by reportProblem
+			if notification == nil {
 				continue
 			}
+			if err := d.handleNotification(eventsChan, notification); err != nil {
+				return err
+			}
+		}
+	}
+}
 
-			var data map[string]any
-			if notification.Extra != "" {
-				data = make(map[string]any)
-				if err := json.Unmarshal([]byte(notification.Extra), &data); err != nil {
-					errChan <- err
-					continue
-				}
+type listenerEvent struct {
+	eventType pq.ListenerEventType
+	err       error
+}
+
+// handleReconnection re-issues LISTEN for all active events, notifications sent while disconnected are lost.
+func (d *Driver) handleReconnection() error {
+	for _, eventName := range d.getActiveEvents() {
+		d._clientConfig.Logger.Trace().Str("query", fmt.Sprintf(`LISTEN "%s"`, eventName)).Msg("sending sql request")
+		if err := d.pgListener.Listen(eventName); err != nil && !errors.Is(err, pq.ErrChannelAlreadyOpen) {
+			return err
+		}
+		// Check sequence continuity on next notification
+		d.pendingGapChecks[eventName] = true
+	}
+
+	d._clientConfig.EmitLifecycleEvent(&flash.LifecycleEvent{Type: flash.LifecycleReconnected})
+	return nil
+}
+
+// checkSequence compares the sequence number of the notification with the last received one.
+// The check is only done for the first notification after a reconnection,
+// because rolled back transactions also consume sequence numbers.
+func (d *Driver) checkSequence(eventName string, listenerUid string, operation flash.Operation, data map[string]any) {
+	rawSeq, exists := data["seq"]
+	if !exists {
+		return
+	}
+	rawSeqNumber, ok := rawSeq.(json.Number)
+	if !ok {
+		return
+	}
+	seq, err := rawSeqNumber.Int64()
+	if err != nil {
+		return
+	}
+
+	lastSeq, known := d.lastSequences[eventName]
+	if known && d.pendingGapChecks[eventName] && seq > lastSeq+1 {
+		d._clientConfig.EmitLifecycleEvent(&flash.LifecycleEvent{
+			Type:        flash.LifecycleGapDetected,
+			ListenerUid: listenerUid,
+			Operation:   operation,
+			Err:         fmt.Errorf("possible gap of %d events", seq-lastSeq-1),
+		})
+	}
+	delete(d.pendingGapChecks, eventName)
+	d.lastSequences[eventName] = seq
+}
+
+func (d *Driver) handleNotification(eventsChan *flash.DatabaseEventsChan, notification *pq.Notification) error {
+	if listenerUids := d.getChannelListeners(notification.Channel); len(listenerUids) > 0 {
+		event := &flash.NotificationEvent{Channel: notification.Channel, Payload: notification.Extra}
+		for _, listenerUid := range listenerUids {
+			*eventsChan <- &flash.DatabaseEvent{ListenerUid: listenerUid, Event: event}
+		}
+		return nil
+	}
+
+	target, err := d.resolveChannel(notification.Channel)
+	if err != nil {
+		// Notifications may still be received for a listener which just stopped listening
+		d._clientConfig.Logger.Warn().Err(err).Str("channel", notification.Channel).Msg("ignoring notification")
+		return nil
+	}
+	listenerUid, operation := target.listenerUid, target.operation
+
+	data, err := d.parseNotificationPayload(notification.Extra)
+	if errors.Is(err, sql.ErrNoRows) {
+		// The stored payload was removed before being fetched, e.g: after PayloadRetention, the event is lost
+		d._clientConfig.EmitLifecycleEvent(&flash.LifecycleEvent{
+			Type:        flash.LifecycleGapDetected,
+			ListenerUid: listenerUid,
+			Operation:   operation,
+			Err:         err,
+		})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	d.checkSequence(notification.Channel, listenerUid, operation, data)
+
+	// Statement level triggers send multiple rows in a single notification
+	if rawBatch, exists := data["batch"]; exists {
+		batch, ok := rawBatch.([]any)
+		if !ok {
+			return fmt.Errorf("invalid batch payload: %v", rawBatch)
+		}
+		for _, rawRow := range batch {
+			row, ok := rawRow.(map[string]any)
+			if !ok {
+				return fmt.Errorf("invalid batch row: %v", rawRow)
 			}
-			var newData, oldData *flash.EventData = nil, nil
-			if data != nil {
-				if nd, exists := data["new"]; exists && nd != nil {
-					typedData := flash.EventData(nd.(map[string]any))
-					newData = &typedData
-				}
-				if od, exists := data["old"]; exists && od != nil {
-					typedData := flash.EventData(od.(map[string]any))
-					oldData = &typedData
-				}
+			if err := d.dispatchRow(eventsChan, listenerUid, operation, row, target.table); err != nil {
+				return err
 			}
+		}
+		return nil
+	}
 
-			// Custom conditions if update to handle soft deletes
-			if operation == flash.OperationUpdate {
-				var previouslyMatch, newlyMatch bool = true, true
-				/* Extract condition match */
-				if nc, exists := data["new_condition"]; exists && nc != nil {
-					newlyMatch = nc.(bool)
-				}
-				if oc, exists := data["old_condition"]; exists && oc != nil {
-					previouslyMatch = oc.(bool)
-				}
+	return d.dispatchRow(eventsChan, listenerUid, operation, data, target.table)
+}
 
-				// Send insert signal
-				if !previouslyMatch && newlyMatch {
-					*eventsChan <- &flash.DatabaseEvent{
-						ListenerUid: listenerUid,
-						Event:       &flash.InsertEvent{New: newData},
-					}
-				} else if previouslyMatch && !newlyMatch {
-					*eventsChan <- &flash.DatabaseEvent{
-						ListenerUid: listenerUid,
-						Event:       &flash.DeleteEvent{Old: oldData},
-					}
-				} else if previouslyMatch && newlyMatch {
-					*eventsChan <- &flash.DatabaseEvent{
-						ListenerUid: listenerUid,
-						Event:       &flash.UpdateEvent{New: newData, Old: oldData},
-					}
-				}
-				continue
-			}
+// dispatchRow sends the event corresponding to a single row payload
+func (d *Driver) dispatchRow(eventsChan *flash.DatabaseEventsChan, listenerUid string, operation flash.Operation, data map[string]any, table string) error {
+	// Truncate payloads are null
+	if data != nil {
+		if err := d.columnTypes.DecodeRows(d.conn, d._clientConfig.Types, table, data); err != nil {
+			return err
+		}
+	}
 
-			switch operation {
-			case flash.OperationInsert:
-				*eventsChan <- &flash.DatabaseEvent{
-					ListenerUid: listenerUid,
-					Event:       &flash.InsertEvent{New: newData},
-				}
-			case flash.OperationUpdate:
-				*eventsChan <- &flash.DatabaseEvent{
-					ListenerUid: listenerUid,
-					Event:       &flash.UpdateEvent{New: newData, Old: oldData},
-				}
-			case flash.OperationDelete:
-				*eventsChan <- &flash.DatabaseEvent{
-					ListenerUid: listenerUid,
-					Event:       &flash.DeleteEvent{Old: oldData},
-				}
-			case flash.OperationTruncate:
-				*eventsChan <- &flash.DatabaseEvent{
-					ListenerUid: listenerUid,
-					Event:       &flash.TruncateEvent{},
-				}
-			default:
-				return fmt.Errorf("unknown operation: %d", operation)
+	var newData, oldData *flash.EventData = nil, nil
+	if data != nil {
+		if nd, exists := data["new"]; exists && nd != nil {
+			typedData := flash.EventData(nd.(map[string]any))
+			newData = &typedData
+		}
+		if od, exists := data["old"]; exists && od != nil {
+			typedData := flash.EventData(od.(map[string]any))
+			oldData = &typedData
+		}
+	}
+
+	// Custom conditions if update to handle soft deletes
+	if operation == flash.OperationUpdate {
+		var previouslyMatch, newlyMatch bool = true, true
+		/* Extract condition match */
+		if nc, exists := data["new_condition"]; exists && nc != nil {
+			newlyMatch = nc.(bool)
+		}
+		if oc, exists := data["old_condition"]; exists && oc != nil {
+			previouslyMatch = oc.(bool)
+		}
+
+		// Send insert signal
+		if !previouslyMatch && newlyMatch {
+			*eventsChan <- &flash.DatabaseEvent{
+				ListenerUid: listenerUid,
+				Event:       &flash.InsertEvent{New: newData},
+			}
+		} else if previouslyMatch && !newlyMatch {
+			*eventsChan <- &flash.DatabaseEvent{
+				ListenerUid: listenerUid,
+				Event:       &flash.DeleteEvent{Old: oldData},
 			}
+		} else if previouslyMatch && newlyMatch {
+			*eventsChan <- &flash.DatabaseEvent{
+				ListenerUid: listenerUid,
+				Event:       &flash.UpdateEvent{New: newData, Old: oldData},
+			}
+		}
+		return nil
+	}
+
+	switch operation {
+	case flash.OperationInsert:
+		*eventsChan <- &flash.DatabaseEvent{
+			ListenerUid: listenerUid,
+			Event:       &flash.InsertEvent{New: newData},
+		}
+	case flash.OperationDelete:
+		*eventsChan <- &flash.DatabaseEvent{
+			ListenerUid: listenerUid,
+			Event:       &flash.DeleteEvent{Old: oldData},
+		}
+	case flash.OperationTruncate:
+		*eventsChan <- &flash.DatabaseEvent{
+			ListenerUid: listenerUid,
+			Event:       &flash.TruncateEvent{},
 		}
+	default:
+		return fmt.Errorf("unknown operation: %d", operation)
+	}
+	return nil
+}
+
+// parseNotificationPayload decodes the payload, fetching it from the payloads table when only a reference was sent
+func (d *Driver) parseNotificationPayload(rawPayload string) (map[string]any, error) {
+	if rawPayload == "" {
+		return nil, nil
+	}
+
+	data, err := unmarshalPayload(rawPayload)
+	if err != nil {
+		return nil, err
+	}
+
+	rawPayloadRef, exists := data["payload_ref"]
+	if !exists {
+		return data, nil
 	}
+	typedPayloadRef, ok := rawPayloadRef.(json.Number)
+	if !ok {
+		return nil, fmt.Errorf("invalid payload reference: %v", rawPayloadRef)
+	}
+	payloadRef, err := typedPayloadRef.Int64()
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload reference: %w", err)
+	}
+
+	query := d.getConsumePayloadSql()
+	d._clientConfig.Logger.Trace().Str("query", query).Int64("args", payloadRef).Msg("sending sql request")
+
+	var storedPayload string
+	if err := d.conn.QueryRow(query, payloadRef).Scan(&storedPayload); err != nil {
+		return nil, fmt.Errorf("could not fetch payload %v: %w", payloadRef, err)
+	}
+
+	return unmarshalPayload(storedPayload)
+}
+
+// unmarshalPayload keeps numbers as json.Number, to decode them depending on the column type
+func unmarshalPayload(rawPayload string) (map[string]any, error) {
+	decoder := json.NewDecoder(strings.NewReader(rawPayload))
+	decoder.UseNumber()
+
+	data := make(map[string]any)
+	if err := decoder.Decode(&data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// getActiveEvents returns a snapshot of listened events
+func (d *Driver) getActiveEvents() []string {
+	d.activeEventsMutex.RLock()
+	defer d.activeEventsMutex.RUnlock()
+
+	eventNames := make([]string, 0, len(d.activeEvents))
+	for eventName := range d.activeEvents {
+		eventNames = append(eventNames, eventName)
+	}
+	return eventNames
 }
 
 func (d *Driver) addEventToListened(eventName string) error {
+	d.activeEventsMutex.Lock()
 	d.activeEvents[eventName] = true
+	d.activeEventsMutex.Unlock()
 
 	if d.pgListener == nil {
 		return nil
@@ -248,7 +581,9 @@ func (d *Driver) addEventToListened(eventName string) error {
 }
 
 func (d *Driver) removeEventToListened(eventName string) error {
+	d.activeEventsMutex.Lock()
 	delete(d.activeEvents, eventName)
+	d.activeEventsMutex.Unlock()
 
 	if d.pgListener == nil {
 		return nil
@@ -263,13 +598,18 @@ func (d *Driver) Close() error {
 		d.shutdown <- true
 	}
 
-	// Drop created schema
-	if _, err := d.sqlExec(d.conn, "DROP SCHEMA IF EXISTS \""+d.Config.Schema+"\" CASCADE;"); err != nil {
-		return err
+	if d.heartbeatShutdown != nil {
+		close(d.heartbeatShutdown)
+		d.heartbeatShutdown = nil
 	}
 
 	// Close active connection
 	if d.conn != nil {
+		// Drop objects of this instance, other instances sharing the schema keep their own
+		if _, err := d.sqlExec(d.conn, d.getUnregisterInstanceSql()); err != nil {
+			return err
+		}
+
 		if err := d.conn.Close(); err != nil {
 			return err
 		}
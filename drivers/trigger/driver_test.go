@@ -1,7 +1,15 @@
 package trigger
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/lib/pq"
 	"github.com/quix-labs/flash"
+	"github.com/rs/zerolog"
+	"io"
+	"strings"
 	"testing"
 )
 
@@ -10,3 +18,121 @@ func TestDriver(t *testing.T) {
 		return NewDriver(&DriverConfig{})
 	})
 }
+
+func TestDriverStatementLevelTriggers(t *testing.T) {
+	flash.RunFlashDriverTestCase(t, flash.DefaultDriverTestConfig, func() *Driver {
+		return NewDriver(&DriverConfig{StatementLevelTriggers: true})
+	})
+}
+
+func TestUniqueIdentifiers(t *testing.T) {
+	driver := NewDriver(&DriverConfig{Schema: "flash_prod"})
+	otherDriver := NewDriver(&DriverConfig{Schema: "flash_staging"})
+
+	seen := make(map[string]bool)
+	for _, listenerUid := range []string{"a", "a_b", strings.Repeat("x", 100)} {
+		for _, operation := range []flash.Operation{flash.OperationInsert, flash.OperationUpdate, flash.OperationDelete, flash.OperationTruncate} {
+			for _, d := range []*Driver{driver, otherDriver} {
+				uniqueName, err := d.getUniqueIdentifierForListenerEvent(listenerUid, &operation)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(uniqueName+"_trigger") > 63 {
+					t.Errorf("identifier %s exceeds 63 bytes", uniqueName)
+				}
+				if seen[uniqueName] {
+					t.Errorf("duplicate identifier %s", uniqueName)
+				}
+				seen[uniqueName] = true
+			}
+		}
+	}
+}
+
+func TestChannelListenerNotifications(t *testing.T) {
+	driver := NewDriver(&DriverConfig{})
+	if err := driver.HandleOperationListenStart("listener1", &flash.ListenerConfig{Channel: "invoice_ready"}, flash.OperationNotification); err != nil {
+		t.Fatal(err)
+	}
+	if !driver.activeEvents["invoice_ready"] {
+		t.Fatalf("expected channel to be listened")
+	}
+
+	eventsChan := make(flash.DatabaseEventsChan, 1)
+	if err := driver.handleNotification(&eventsChan, &pq.Notification{Channel: "invoice_ready", Extra: `{"id":1}`}); err != nil {
+		t.Fatal(err)
+	}
+	received := <-eventsChan
+	event, ok := received.Event.(*flash.NotificationEvent)
+	if received.ListenerUid != "listener1" || !ok || event.Payload != `{"id":1}` {
+		t.Errorf("unexpected event: %+v", received)
+	}
+
+	if err := driver.HandleOperationListenStop("listener1", &flash.ListenerConfig{Channel: "invoice_ready"}, flash.OperationNotification); err != nil {
+		t.Fatal(err)
+	}
+	if driver.activeEvents["invoice_ready"] {
+		t.Errorf("expected channel to be unlistened")
+	}
+}
+
+func TestPurgedPayloadEmitsGap(t *testing.T) {
+	var lifecycleEvents []*flash.LifecycleEvent
+	logger := zerolog.Nop()
+	d := NewDriver(&DriverConfig{})
+	d._clientConfig = &flash.ClientConfig{
+		Logger: &logger,
+		Types:  flash.NewTypeRegistry(),
+		OnLifecycleEvent: func(event *flash.LifecycleEvent) {
+			lifecycleEvents = append(lifecycleEvents, event)
+		},
+	}
+	d.conn = sql.OpenDB(purgedPayloadsConnector{})
+	defer d.conn.Close()
+	d.channels["flash_insert_abc"] = &channelTarget{listenerUid: "listener1", operation: flash.OperationInsert, table: `"public"."posts"`}
+
+	eventsChan := make(flash.DatabaseEventsChan, 1)
+	err := d.handleNotification(&eventsChan, &pq.Notification{Channel: "flash_insert_abc", Extra: `{"payload_ref":42}`})
+	if err != nil {
+		t.Fatalf("expected the notification to be skipped, got %v", err)
+	}
+	if len(eventsChan) != 0 {
+		t.Errorf("unexpected event: %+v", <-eventsChan)
+	}
+	if len(lifecycleEvents) != 1 {
+		t.Fatalf("expected one lifecycle event, got %d", len(lifecycleEvents))
+	}
+	event := lifecycleEvents[0]
+	if event.Type != flash.LifecycleGapDetected || event.ListenerUid != "listener1" || event.Operation != flash.OperationInsert {
+		t.Errorf("unexpected lifecycle event: %+v", event)
+	}
+}
+
+// purgedPayloadsConnector opens connections whose queries return no rows, as if stored payloads were already purged
+type purgedPayloadsConnector struct{}
+
+func (c purgedPayloadsConnector) Connect(context.Context) (driver.Conn, error) {
+	return purgedPayloadsConn{}, nil
+}
+func (c purgedPayloadsConnector) Driver() driver.Driver { return nil }
+
+type purgedPayloadsConn struct{}
+
+func (c purgedPayloadsConn) Prepare(string) (driver.Stmt, error) { return purgedPayloadsStmt{}, nil }
+func (c purgedPayloadsConn) Close() error                        { return nil }
+func (c purgedPayloadsConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+type purgedPayloadsStmt struct{}
+
+func (s purgedPayloadsStmt) Close() error  { return nil }
+func (s purgedPayloadsStmt) NumInput() int { return -1 }
+func (s purgedPayloadsStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+func (s purgedPayloadsStmt) Query([]driver.Value) (driver.Rows, error) { return emptyRows{}, nil }
+
+type emptyRows struct{}
+
+func (r emptyRows) Columns() []string         { return []string{"payload"} }
+func (r emptyRows) Close() error              { return nil }
+func (r emptyRows) Next([]driver.Value) error { return io.EOF }
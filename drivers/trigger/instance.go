@@ -0,0 +1,127 @@
+package trigger
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/quix-labs/flash"
+	"time"
+)
+
+func generateInstanceId() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// startHeartbeat keeps this instance registered as alive, and periodically removes objects of dead instances
+func (d *Driver) startHeartbeat(shutdown chan struct{}) {
+	ticker := time.NewTicker(d.Config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-ticker.C:
+			if err := d.refreshHeartbeat(); err != nil {
+				d._clientConfig.Logger.Warn().Err(err).Msg("could not refresh heartbeat")
+			}
+			d.collectGarbage()
+			if err := d.refreshPartitionTriggers(); err != nil {
+				d._clientConfig.Logger.Warn().Err(err).Msg("could not create triggers of attached partitions")
+			}
+		}
+	}
+}
+
+// refreshPartitionTriggers creates statement-level triggers on partitions attached since their creation
+func (d *Driver) refreshPartitionTriggers() error {
+	if !d.Config.StatementLevelTriggers {
+		return nil // Row triggers are cloned by PostgreSQL
+	}
+
+	d.tableListenersMutex.Lock()
+	defer d.tableListenersMutex.Unlock()
+
+	statement := ""
+	for key := range d.tableListeners {
+		if key.operation == flash.OperationTruncate {
+			continue
+		}
+		uniqueName, err := d.getUniqueIdentifierForTableEvent(key.table, &key.operation)
+		if err != nil {
+			return err
+		}
+		operation, err := key.operation.StrictName()
+		if err != nil {
+			return err
+		}
+		statementLevel, _, err := d.usesStatementTrigger(key.table, operation)
+		if err != nil {
+			return err
+		}
+		if !statementLevel {
+			continue // UPDATE of tables without key
+		}
+		statement += d.getPartitionTriggersSql(key.table, uniqueName+"_trigger", uniqueName+"_fn", operation)
+	}
+	if statement == "" {
+		return nil
+	}
+	_, err := d.sqlExec(d.conn, statement)
+	return err
+}
+
+func (d *Driver) refreshHeartbeat() error {
+	result, err := d.sqlExec(d.conn, d.getRefreshHeartbeatSql())
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil || affected > 0 {
+		return err
+	}
+
+	// This instance was considered dead by another one, and its objects removed
+	d._clientConfig.EmitLifecycleEvent(&flash.LifecycleEvent{
+		Type: flash.LifecycleGapDetected,
+		Err:  errors.New("instance objects were collected after missed heartbeats"),
+	})
+	return d.restoreObjects()
+}
+
+// restoreObjects registers this instance again and recreates triggers of all active listeners
+func (d *Driver) restoreObjects() error {
+	d.tableListenersMutex.Lock()
+	defer d.tableListenersMutex.Unlock()
+
+	statement := d.getBootstrapSql()
+	for key, listeners := range d.tableListeners {
+		for listenerUid := range listeners {
+			registerSql, _, err := d.getRegisterListenerSql(listenerUid, &key.operation, d.sanitizeTableName(key.table))
+			if err != nil {
+				return err
+			}
+			statement += registerSql
+		}
+
+		createTriggerSql, err := d.getTableTriggerSql(key.table, &key.operation, listeners)
+		if err != nil {
+			return err
+		}
+		statement += createTriggerSql
+	}
+
+	_, err := d.sqlExec(d.conn, statement)
+	return err
+}
+
+// collectGarbage removes objects owned by instances without recent heartbeat
+func (d *Driver) collectGarbage() {
+	if _, err := d.sqlExec(d.conn, d.getCollectGarbageSql()); err != nil {
+		d._clientConfig.Logger.Warn().Err(err).Msg("could not collect objects of dead instances")
+	}
+}
@@ -1,164 +1,582 @@
 package trigger
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"github.com/lib/pq"
 	"github.com/quix-labs/flash"
+	"sort"
+	"strconv"
 	"strings"
-	"time"
 )
 
-func (d *Driver) getCreateTriggerSqlForOperation(listenerUid string, l *flash.ListenerConfig, e *flash.Operation) (string, string, error) {
-	uniqueName, err := d.getUniqueIdentifierForListenerEvent(listenerUid, e)
+const (
+	maxNotifyPayloadSize = 8000                       // pg_notify payloads must be shorter than 8000 bytes
+	maxBatchPayloadSize  = maxNotifyPayloadSize - 100 // Keep room for the sequence number and batch wrapper
+)
+
+// getTableTriggerSql returns the statement (re)creating the trigger shared by all listeners of a table for an operation.
+// The generated function evaluates conditions and fields of every listener, and notifies each matching listener.
+func (d *Driver) getTableTriggerSql(table string, e *flash.Operation, listeners map[string]*flash.ListenerConfig) (string, error) {
+	uniqueName, err := d.getUniqueIdentifierForTableEvent(table, e)
 	if err != nil {
-		return "", "", err
+		return "", err
 	}
 
 	operation, err := e.StrictName()
 	if err != nil {
-		return "", "", err
+		return "", err
 	}
 
 	triggerName := uniqueName + "_trigger"
 	triggerFnName := uniqueName + "_fn"
-	eventName := uniqueName + "_event"
 
-	var statement string
-	if len(l.Fields) == 0 {
-		statement = fmt.Sprintf(`
-			CREATE OR REPLACE FUNCTION "%s"."%s"() RETURNS trigger AS $trigger$
-			BEGIN 
-				PERFORM pg_notify('%s', JSONB_BUILD_OBJECT('old',to_jsonb(OLD),'new',to_jsonb(NEW))::TEXT);
-				RETURN COALESCE(NEW, OLD);
-			END;
-			$trigger$ LANGUAGE plpgsql VOLATILE;`,
-			d.Config.Schema, triggerFnName, eventName)
-	} else {
-		var rawFields, rawConditionSql string
+	codecColumns, err := d.getCodecColumns(table)
+	if err != nil {
+		return "", err
+	}
+	statementLevel, keyColumns, err := d.usesStatementTrigger(table, operation)
+	if err != nil {
+		return "", err
+	}
+	if d.Config.StatementLevelTriggers && operation == "UPDATE" && !statementLevel {
+		d._clientConfig.Logger.Warn().Str("table", table).Msg("table without primary key, using row-level trigger for UPDATE")
+	}
 
+	// Keep generated function stable across calls
+	listenerUids := make([]string, 0, len(listeners))
+	for listenerUid := range listeners {
+		listenerUids = append(listenerUids, listenerUid)
+	}
+	sort.Strings(listenerUids)
+
+	statement := ""
+	notifyBlocks := make([]string, len(listenerUids))
+	for i, listenerUid := range listenerUids {
+		listenerUniqueName, err := d.getUniqueIdentifierForListenerEvent(listenerUid, e)
+		if err != nil {
+			return "", err
+		}
+		statement += fmt.Sprintf(`CREATE SEQUENCE IF NOT EXISTS "%s"."%s";`, d.Config.Schema, listenerUniqueName+"_seq")
+
+		notifyBlocks[i], err = d.getListenerNotifySql(listenerUniqueName, listeners[listenerUid], operation, codecColumns, statementLevel, keyColumns)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	declarations := `
+			payload TEXT;
+			payload_ref BIGINT;`
+	body := strings.Join(notifyBlocks, "\n")
+	if statementLevel {
+		declarations += `
+			flash_row JSONB;
+			flash_batch JSONB;
+			flash_batch_size INT;`
+	}
+
+	statement += fmt.Sprintf(`
+		INSERT INTO "%s"."triggers" (function_name, instance_id) VALUES (%s, %s) ON CONFLICT (function_name) DO NOTHING;`,
+		d.Config.Schema, pq.QuoteLiteral(triggerFnName), pq.QuoteLiteral(d.instanceId))
+	statement += fmt.Sprintf(`
+		CREATE OR REPLACE FUNCTION "%s"."%s"() RETURNS trigger AS $trigger$
+		DECLARE%s
+		BEGIN
+			%s
+			RETURN NULL;
+		END;
+		$trigger$ LANGUAGE plpgsql VOLATILE;`,
+		d.Config.Schema, triggerFnName, declarations, body)
+
+	// Keep drop + create instead of 'create or replace' for Pgsql13 compatibility
+	statement += fmt.Sprintf(`
+		DROP TRIGGER IF EXISTS "%s" ON %s;`, triggerName, d.sanitizeTableName(table))
+	switch {
+	case operation == "TRUNCATE":
+		statement += fmt.Sprintf(`
+		CREATE TRIGGER "%s" BEFORE TRUNCATE ON %s FOR EACH STATEMENT EXECUTE PROCEDURE "%s"."%s"();`,
+			triggerName, d.sanitizeTableName(table), d.Config.Schema, triggerFnName)
+	case statementLevel:
+		statement += fmt.Sprintf(`
+		CREATE TRIGGER "%s" AFTER %s ON %s %s FOR EACH STATEMENT EXECUTE PROCEDURE "%s"."%s"();`,
+			triggerName, operation, d.sanitizeTableName(table), getTransitionTablesSql(operation), d.Config.Schema, triggerFnName)
+		statement += d.getPartitionTriggersSql(table, triggerName, triggerFnName, operation)
+	default:
+		// Row triggers of partitioned tables are cloned by PostgreSQL to all partitions, including partitions attached later
+		statement += fmt.Sprintf(`
+		CREATE TRIGGER "%s" AFTER %s ON %s FOR EACH ROW EXECUTE PROCEDURE "%s"."%s"();`,
+			triggerName, operation, d.sanitizeTableName(table), d.Config.Schema, triggerFnName)
+	}
+
+	return statement, nil
+}
+
+// getPartitionTriggersSql returns the statement creating the statement-level trigger on partitions of the table missing it, recursively.
+// Statement-level triggers only fire for the table named in the statement, so statements targeting a partition directly
+// are reported by its own trigger, without duplicate. Row triggers and TRUNCATE triggers are not concerned.
+func (d *Driver) getPartitionTriggersSql(table string, triggerName string, triggerFnName string, operation string) string {
+	return fmt.Sprintf(`
+		DO $partitions$
+		DECLARE
+			partition_oid OID;
+		BEGIN
+			FOR partition_oid IN
+				WITH RECURSIVE partitions AS (
+					SELECT inhrelid FROM pg_inherits WHERE inhparent = %s::regclass
+					UNION ALL
+					SELECT i.inhrelid FROM pg_inherits i JOIN partitions p ON i.inhparent = p.inhrelid
+				)
+				SELECT inhrelid FROM partitions
+			LOOP
+				IF NOT EXISTS (SELECT FROM pg_trigger WHERE tgrelid = partition_oid AND tgname = %s) THEN
+					EXECUTE format('CREATE TRIGGER %%I AFTER %s ON %%s %s FOR EACH STATEMENT EXECUTE PROCEDURE %%I.%%I()',
+						%s, partition_oid::regclass, %s, %s);
+				END IF;
+			END LOOP;
+		END;
+		$partitions$;`,
+		pq.QuoteLiteral(d.sanitizeTableName(table)), pq.QuoteLiteral(triggerName), operation, getTransitionTablesSql(operation),
+		pq.QuoteLiteral(triggerName), pq.QuoteLiteral(d.Config.Schema), pq.QuoteLiteral(triggerFnName))
+}
+
+// getListenerNotifySql returns the plpgsql block notifying a single listener, if the row matches its conditions
+// keyColumns are used to pair updated rows of statement-level triggers, see getStatementNotifySql.
+func (d *Driver) getListenerNotifySql(listenerUniqueName string, l *flash.ListenerConfig, operation string, codecColumns map[string]uint32, statementLevel bool, keyColumns []string) (string, error) {
+	if operation == "TRUNCATE" {
+		return d.getNotifySql(listenerUniqueName, "null"), nil
+	}
+
+	if statementLevel {
+		return d.getStatementNotifySql(listenerUniqueName, l, operation, codecColumns, keyColumns)
+	}
+
+	rawPayload, rawConditionSql, err := d.getRowPayloadSql(l, operation, "OLD", "NEW", codecColumns)
+	if err != nil {
+		return "", err
+	}
+	rawPayload = fmt.Sprintf(`(%s)::TEXT`, rawPayload)
+	if rawConditionSql == "" {
+		return d.getNotifySql(listenerUniqueName, rawPayload), nil
+	}
+	return fmt.Sprintf(`
+		IF %s THEN
+			%s
+		END IF;`, rawConditionSql, d.getNotifySql(listenerUniqueName, rawPayload)), nil
+}
+
+// getStatementNotifySql returns the plpgsql block reading transition tables of a FOR EACH STATEMENT trigger.
+// Rows affected by the statement are sent as {"batch": [...]} payloads, chunked under the pg_notify size limit.
+// Updated rows are paired using keyColumns, rows whose key changed are sent with a null old or new row.
+// Requires flash_row, flash_batch and flash_batch_size variables to be declared.
+func (d *Driver) getStatementNotifySql(listenerUniqueName string, l *flash.ListenerConfig, operation string, codecColumns map[string]uint32, keyColumns []string) (string, error) {
+	var oldRef, newRef, fromSql string
+	switch operation {
+	case "INSERT":
+		newRef = "flash_new"
+		fromSql = `flash_new_rows AS flash_new`
+	case "DELETE":
+		oldRef = "flash_old"
+		fromSql = `flash_old_rows AS flash_old`
+	case "UPDATE":
+		if len(keyColumns) == 0 {
+			return "", errors.New("statement level triggers require key columns for UPDATE")
+		}
+		joinConditions := make([]string, len(keyColumns))
+		for i, column := range keyColumns {
+			joinConditions[i] = fmt.Sprintf(`flash_old."%s" = flash_new."%s"`, column, column)
+		}
+		oldRef, newRef = "flash_old", "flash_new"
+		fromSql = `flash_old_rows AS flash_old FULL JOIN flash_new_rows AS flash_new ON ` + strings.Join(joinConditions, " AND ")
+	default:
+		return "", fmt.Errorf("statement level triggers are not supported for %s", operation)
+	}
+
+	rawPayload, rawConditionSql, err := d.getRowPayloadSql(l, operation, oldRef, newRef, codecColumns)
+	if err != nil {
+		return "", err
+	}
+	if rawConditionSql == "" {
+		rawConditionSql = "TRUE"
+	}
+
+	notifyBatchSql := d.getNotifySql(listenerUniqueName, `JSONB_BUILD_OBJECT('batch', flash_batch)::TEXT`)
+	return fmt.Sprintf(`
+		flash_batch := '[]'::JSONB;
+		flash_batch_size := 0;
+		FOR flash_row IN SELECT %s FROM %s WHERE %s LOOP
+			IF flash_batch_size > 0 AND flash_batch_size + octet_length(flash_row::TEXT) >= %d THEN
+				%s
+				flash_batch := '[]'::JSONB;
+				flash_batch_size := 0;
+			END IF;
+			flash_batch := flash_batch || JSONB_BUILD_ARRAY(flash_row);
+			flash_batch_size := flash_batch_size + octet_length(flash_row::TEXT) + 2;
+		END LOOP;
+		IF flash_batch_size > 0 THEN
+			%s
+		END IF;`,
+		rawPayload, fromSql, rawConditionSql, maxBatchPayloadSize, notifyBatchSql, notifyBatchSql), nil
+}
+
+func getTransitionTablesSql(operation string) string {
+	switch operation {
+	case "INSERT":
+		return `REFERENCING NEW TABLE AS flash_new_rows`
+	case "DELETE":
+		return `REFERENCING OLD TABLE AS flash_old_rows`
+	default:
+		return `REFERENCING OLD TABLE AS flash_old_rows NEW TABLE AS flash_new_rows`
+	}
+}
+
+// getRowPayloadSql returns the JSONB payload expression of a single row and its optional filter condition.
+// oldRef and newRef are the SQL references to the OLD and NEW rows.
+// Columns having a codec are sent as text, see getCodecColumns.
+func (d *Driver) getRowPayloadSql(l *flash.ListenerConfig, operation string, oldRef string, newRef string, codecColumns map[string]uint32) (string, string, error) {
+	rawFields, rawConditionSql, err := d.getRowFieldsSql(l, operation, oldRef, newRef, codecColumns)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Only rows of partitions owned by this consumer group member are sent
+	if l.PartitionKey != "" && l.OwnedPartitions() != nil {
+		rowRef := newRef
+		if operation == "DELETE" {
+			rowRef = oldRef
+		}
+		ownedPartitions := make([]string, len(l.OwnedPartitions()))
+		for i, partition := range l.OwnedPartitions() {
+			ownedPartitions[i] = strconv.Itoa(partition)
+		}
+		partitionSql := fmt.Sprintf(`"%s"."partition_of"((%s."%s")::TEXT, %d) IN (%s)`,
+			d.Config.Schema, rowRef, l.PartitionKey, l.Partitions, strings.Join(ownedPartitions, ","))
+
+		if rawConditionSql == "" {
+			rawConditionSql = partitionSql
+		} else {
+			rawConditionSql = fmt.Sprintf(`(%s) AND (%s)`, partitionSql, rawConditionSql)
+		}
+	}
+
+	return rawFields, rawConditionSql, nil
+}
+
+func (d *Driver) getRowFieldsSql(l *flash.ListenerConfig, operation string, oldRef string, newRef string, codecColumns map[string]uint32) (string, string, error) {
+	if len(l.Fields) == 0 {
 		switch operation {
-		case "TRUNCATE":
-			rawFields = "null"
+		case "INSERT":
+			return fmt.Sprintf(`JSONB_BUILD_OBJECT('new',%s)`, getRowJsonSql(newRef, codecColumns)), "", nil
 		case "DELETE":
+			return fmt.Sprintf(`JSONB_BUILD_OBJECT('old',%s)`, getRowJsonSql(oldRef, codecColumns)), "", nil
+		default:
+			return fmt.Sprintf(`JSONB_BUILD_OBJECT('old',%s,'new',%s)`, getRowJsonSql(oldRef, codecColumns), getRowJsonSql(newRef, codecColumns)), "", nil
+		}
+	}
 
-			if len(l.Conditions) > 0 {
-				rawConditionSql, err = d.getConditionsSql(l.Conditions, "OLD")
-				if err != nil {
-					return "", "", err
-				}
-			}
+	var rawFields, rawConditionSql string
+	var err error
 
-			jsonFields := make([]string, len(l.Fields))
-			for i, field := range l.Fields {
-				jsonFields[i] = fmt.Sprintf(`'%s', OLD."%s"`, field, field)
-			}
-			rawFields = fmt.Sprintf(`JSONB_BUILD_OBJECT('old',JSONB_BUILD_OBJECT(%s))::TEXT`, strings.Join(jsonFields, ","))
-		case "INSERT":
+	switch operation {
+	case "DELETE":
 
-			if len(l.Conditions) > 0 {
-				rawConditionSql, err = d.getConditionsSql(l.Conditions, "NEW")
-				if err != nil {
-					return "", "", err
-				}
+		if len(l.Conditions) > 0 {
+			rawConditionSql, err = flash.ConditionsSql(l.Conditions, oldRef)
+			if err != nil {
+				return "", "", err
 			}
+		}
 
-			jsonFields := make([]string, len(l.Fields))
-			for i, field := range l.Fields {
-				jsonFields[i] = fmt.Sprintf(`'%s', NEW."%s"`, field, field)
-			}
-			rawFields = fmt.Sprintf(`JSONB_BUILD_OBJECT('new',JSONB_BUILD_OBJECT(%s))::TEXT`, strings.Join(jsonFields, ","))
-		case "UPDATE":
-			oldJsonFields := make([]string, len(l.Fields))
-			newJsonFields := make([]string, len(l.Fields))
-			for i, field := range l.Fields {
-				oldJsonFields[i] = fmt.Sprintf(`'%s', OLD."%s"`, field, field)
-				newJsonFields[i] = fmt.Sprintf(`'%s', NEW."%s"`, field, field)
+		jsonFields := make([]string, len(l.Fields))
+		for i, field := range l.Fields {
+			jsonFields[i] = getFieldJsonSql(oldRef, field, codecColumns)
+		}
+		rawFields = fmt.Sprintf(`JSONB_BUILD_OBJECT('old',JSONB_BUILD_OBJECT(%s))`, strings.Join(jsonFields, ","))
+	case "INSERT":
+
+		if len(l.Conditions) > 0 {
+			rawConditionSql, err = flash.ConditionsSql(l.Conditions, newRef)
+			if err != nil {
+				return "", "", err
 			}
+		}
+
+		jsonFields := make([]string, len(l.Fields))
+		for i, field := range l.Fields {
+			jsonFields[i] = getFieldJsonSql(newRef, field, codecColumns)
+		}
+		rawFields = fmt.Sprintf(`JSONB_BUILD_OBJECT('new',JSONB_BUILD_OBJECT(%s))`, strings.Join(jsonFields, ","))
+	case "UPDATE":
+		oldJsonFields := make([]string, len(l.Fields))
+		newJsonFields := make([]string, len(l.Fields))
+		for i, field := range l.Fields {
+			oldJsonFields[i] = getFieldJsonSql(oldRef, field, codecColumns)
+			newJsonFields[i] = getFieldJsonSql(newRef, field, codecColumns)
+		}
+
+		// Build raw conditions for field updates
+		rawConditions := make([]string, len(l.Fields))
+		for i, field := range l.Fields {
+			rawConditions[i] = fmt.Sprintf(`(%s."%s" IS DISTINCT FROM %s."%s")`, oldRef, field, newRef, field)
+		}
+		rawConditionSql = strings.Join(rawConditions, " OR ")
 
-			// Build raw conditions for field updates
-			rawConditions := make([]string, len(l.Fields))
-			for i, field := range l.Fields {
-				rawConditions[i] = fmt.Sprintf(`(OLD."%s" IS DISTINCT FROM NEW."%s")`, field, field)
+		// Build conditions for soft delete check
+		var oldConditionsSql, newConditionsSql string = "null", "null"
+		if len(l.Conditions) > 0 {
+			oldConditionsSql, err = flash.ConditionsSql(l.Conditions, oldRef)
+			if err != nil {
+				return "", "", err
 			}
-			rawConditionSql = strings.Join(rawConditions, " OR ")
-
-			// Build conditions for soft delete check
-			var oldConditionsSql, newConditionsSql string = "null", "null"
-			if len(l.Conditions) > 0 {
-				oldConditionsSql, err = d.getConditionsSql(l.Conditions, "OLD")
-				if err != nil {
-					return "", "", err
-				}
-				newConditionsSql, err = d.getConditionsSql(l.Conditions, "NEW")
-				if err != nil {
-					return "", "", err
-				}
-
-				// Combine update conditions with soft delete conditions
-				rawConditionSql = fmt.Sprintf(`((%s)!=(%s)) OR (%s)`, oldConditionsSql, newConditionsSql, rawConditionSql)
+			newConditionsSql, err = flash.ConditionsSql(l.Conditions, newRef)
+			if err != nil {
+				return "", "", err
 			}
 
-			rawFields = fmt.Sprintf(
-				`JSONB_BUILD_OBJECT('old',JSONB_BUILD_OBJECT(%s),'new',JSONB_BUILD_OBJECT(%s),'old_condition',%s,'new_condition',%s)::TEXT`,
-				strings.Join(oldJsonFields, ","),
-				strings.Join(newJsonFields, ","),
-				oldConditionsSql,
-				newConditionsSql,
-			)
+			// Combine update conditions with soft delete conditions
+			rawConditionSql = fmt.Sprintf(`((%s)!=(%s)) OR (%s)`, oldConditionsSql, newConditionsSql, rawConditionSql)
 		}
 
-		if rawConditionSql == "" {
+		rawFields = fmt.Sprintf(
+			`JSONB_BUILD_OBJECT('old',JSONB_BUILD_OBJECT(%s),'new',JSONB_BUILD_OBJECT(%s),'old_condition',%s,'new_condition',%s)`,
+			strings.Join(oldJsonFields, ","),
+			strings.Join(newJsonFields, ","),
+			oldConditionsSql,
+			newConditionsSql,
+		)
+	}
 
-			statement = fmt.Sprintf(`
-				CREATE OR REPLACE FUNCTION "%s"."%s"() RETURNS trigger AS $trigger$
-				BEGIN 
-					PERFORM pg_notify('%s', %s);
-					RETURN COALESCE(NEW, OLD);
-				END;
-				$trigger$ LANGUAGE plpgsql VOLATILE;`,
-				d.Config.Schema, triggerFnName, eventName, rawFields)
-		} else {
-			statement = fmt.Sprintf(`
-				CREATE OR REPLACE FUNCTION "%s"."%s"() RETURNS trigger AS $trigger$
-				BEGIN
-					IF %s THEN
-						PERFORM pg_notify('%s', %s);
-					END IF;
-					RETURN COALESCE(NEW, OLD);
-				END;
-				$trigger$ LANGUAGE plpgsql VOLATILE;`,
-				d.Config.Schema, triggerFnName, rawConditionSql, eventName, rawFields)
-		}
+	return rawFields, rawConditionSql, nil
+}
+
+// getRowJsonSql returns the JSONB representation of the whole row, columns having a codec are replaced by their text representation
+func getRowJsonSql(rowRef string, codecColumns map[string]uint32) string {
+	if len(codecColumns) == 0 {
+		return fmt.Sprintf(`to_jsonb(%s)`, rowRef)
+	}
+	columns := make([]string, 0, len(codecColumns))
+	for column := range codecColumns {
+		columns = append(columns, column)
 	}
+	sort.Strings(columns) // Keep generated function stable across calls
 
-	if operation != "TRUNCATE" {
-		// Keep drop + create instead of 'create or replace' for Pgsql13 compatibility
-		statement += fmt.Sprintf(`
-			DROP TRIGGER IF EXISTS "%s" ON %s;
-			CREATE TRIGGER "%s" AFTER %s ON %s FOR EACH ROW EXECUTE PROCEDURE "%s"."%s"();`,
-			triggerName, d.sanitizeTableName(l.Table), triggerName, operation, d.sanitizeTableName(l.Table), d.Config.Schema, triggerFnName)
-	} else {
-		// Keep drop + create instead of 'create or replace' for Pgsql13 compatibility
-		statement += fmt.Sprintf(`
-			DROP TRIGGER IF EXISTS "%s" ON %s;
-			CREATE TRIGGER "%s" BEFORE TRUNCATE ON %s FOR EACH STATEMENT EXECUTE PROCEDURE "%s"."%s"();`,
-			triggerName, d.sanitizeTableName(l.Table), triggerName, d.sanitizeTableName(l.Table), d.Config.Schema, triggerFnName)
+	jsonFields := make([]string, len(columns))
+	for i, column := range columns {
+		jsonFields[i] = getFieldJsonSql(rowRef, column, codecColumns)
+	}
+	return fmt.Sprintf(`(to_jsonb(%s) || JSONB_BUILD_OBJECT(%s))`, rowRef, strings.Join(jsonFields, ","))
+}
+
+// getFieldJsonSql returns the key and value of a field for JSONB_BUILD_OBJECT
+func getFieldJsonSql(rowRef string, field string, codecColumns map[string]uint32) string {
+	if _, hasCodec := codecColumns[field]; hasCodec {
+		return fmt.Sprintf(`'%s', %s."%s"::TEXT`, field, rowRef, field)
+	}
+	return fmt.Sprintf(`'%s', %s."%s"`, field, rowRef, field)
+}
+
+// getNotifySql returns plpgsql statements sending rawPayload to the listener channel.
+// A sequence number is added to the payload to detect possible gaps after reconnection.
+// pg_notify payloads must be shorter than 8000 bytes, bigger payloads are stored in the payloads table,
+// and only their reference is sent.
+// Requires payload and payload_ref variables to be declared.
+func (d *Driver) getNotifySql(uniqueName string, rawPayload string) string {
+	eventName := uniqueName + "_event"
+	sequenceName := uniqueName + "_seq"
+
+	return fmt.Sprintf(`
+		payload := (COALESCE((%s)::JSONB, '{}'::JSONB) || JSONB_BUILD_OBJECT('seq', nextval('"%s"."%s"')))::TEXT;
+		IF octet_length(payload) >= %d THEN
+			INSERT INTO "%s"."payloads" (payload) VALUES (payload) RETURNING id INTO payload_ref;
+			PERFORM pg_notify('%s', JSONB_BUILD_OBJECT('payload_ref', payload_ref)::TEXT);
+		ELSE
+			PERFORM pg_notify('%s', payload);
+		END IF;`,
+		rawPayload, d.Config.Schema, sequenceName, maxNotifyPayloadSize, d.Config.Schema, eventName, eventName)
+}
+
+// getBootstrapSql returns the statement creating the driver schema and registering this instance
+func (d *Driver) getBootstrapSql() string {
+	return fmt.Sprintf(`
+		CREATE SCHEMA IF NOT EXISTS "%s";
+		CREATE TABLE IF NOT EXISTS "%s"."payloads" (
+			id BIGSERIAL PRIMARY KEY,
+			payload TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		ALTER TABLE "%s"."payloads" ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+		CREATE TABLE IF NOT EXISTS "%s"."instances" (
+			id TEXT PRIMARY KEY,
+			heartbeat_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE TABLE IF NOT EXISTS "%s"."channels" (
+			channel TEXT PRIMARY KEY,
+			listener_uid TEXT NOT NULL,
+			operation TEXT NOT NULL,
+			table_name TEXT NOT NULL DEFAULT '',
+			sequence_name TEXT NOT NULL,
+			instance_id TEXT NOT NULL
+		);
+		ALTER TABLE "%s"."channels" ADD COLUMN IF NOT EXISTS table_name TEXT NOT NULL DEFAULT '';
+		CREATE TABLE IF NOT EXISTS "%s"."triggers" (
+			function_name TEXT PRIMARY KEY,
+			instance_id TEXT NOT NULL
+		);
+		%s
+		%s`, d.Config.Schema, d.Config.Schema, d.Config.Schema, d.Config.Schema, d.Config.Schema, d.Config.Schema, d.Config.Schema,
+		d.getPartitionFunctionSql(), d.getHeartbeatSql())
+}
+
+// getPartitionFunctionSql returns the statement creating the function computing row partitions, see flash.PartitionOf.
+// The 32-bit FNV-1a hash is computed with BIGINT arithmetic to avoid overflows.
+func (d *Driver) getPartitionFunctionSql() string {
+	return fmt.Sprintf(`
+		CREATE OR REPLACE FUNCTION "%s"."partition_of"(value TEXT, partitions INT) RETURNS INT AS $partition$
+		DECLARE
+			bytes BYTEA := convert_to(value, 'UTF8');
+			hash BIGINT := 2166136261;
+		BEGIN
+			IF value IS NULL THEN
+				RETURN 0;
+			END IF;
+			FOR i IN 0..length(bytes) - 1 LOOP
+				hash := ((hash # get_byte(bytes, i)) * 16777619) %% 4294967296;
+			END LOOP;
+			RETURN hash %% partitions;
+		END;
+		$partition$ LANGUAGE plpgsql IMMUTABLE;`, d.Config.Schema)
+}
+
+// getHeartbeatSql returns the statement registering this instance as alive
+func (d *Driver) getHeartbeatSql() string {
+	return fmt.Sprintf(`INSERT INTO "%s"."instances" (id) VALUES (%s) ON CONFLICT (id) DO UPDATE SET heartbeat_at = now();`,
+		d.Config.Schema, pq.QuoteLiteral(d.instanceId))
+}
+
+func (d *Driver) getRefreshHeartbeatSql() string {
+	return fmt.Sprintf(`UPDATE "%s"."instances" SET heartbeat_at = now() WHERE id = %s;`, d.Config.Schema, pq.QuoteLiteral(d.instanceId))
+}
+
+// getDropInstancesSql returns the statement removing instances matching the condition, with all their objects.
+// Rows are locked to avoid concurrent collectors dropping the same objects.
+func (d *Driver) getDropInstancesSql(rawConditionSql string) string {
+	return fmt.Sprintf(`
+		DO $collect$
+		DECLARE
+			target_instance_id TEXT;
+			object_name TEXT;
+		BEGIN
+			FOR target_instance_id IN SELECT id FROM "%s"."instances" WHERE %s FOR UPDATE SKIP LOCKED LOOP
+				FOR object_name IN DELETE FROM "%s"."triggers" t WHERE t.instance_id = target_instance_id RETURNING function_name LOOP
+					EXECUTE format('DROP FUNCTION IF EXISTS %%I.%%I CASCADE', %s, object_name);
+				END LOOP;
+				FOR object_name IN DELETE FROM "%s"."channels" c WHERE c.instance_id = target_instance_id RETURNING sequence_name LOOP
+					EXECUTE format('DROP SEQUENCE IF EXISTS %%I.%%I', %s, object_name);
+				END LOOP;
+				DELETE FROM "%s"."instances" WHERE id = target_instance_id;
+			END LOOP;
+		END;
+		$collect$;`,
+		d.Config.Schema, rawConditionSql,
+		d.Config.Schema, pq.QuoteLiteral(d.Config.Schema),
+		d.Config.Schema, pq.QuoteLiteral(d.Config.Schema),
+		d.Config.Schema)
+}
+
+// getCollectGarbageSql returns the statement removing objects of instances without recent heartbeat, and expired payloads
+func (d *Driver) getCollectGarbageSql() string {
+	return d.getDropInstancesSql(fmt.Sprintf(`heartbeat_at < now() - INTERVAL '%d milliseconds' AND id <> %s`,
+		d.Config.InstanceTimeout.Milliseconds(), pq.QuoteLiteral(d.instanceId))) + d.getPurgePayloadsSql()
+}
+
+// getPurgePayloadsSql returns the statement removing stored payloads whose notification was never consumed
+func (d *Driver) getPurgePayloadsSql() string {
+	return fmt.Sprintf(`DELETE FROM "%s"."payloads" WHERE created_at < now() - INTERVAL '%d milliseconds';`,
+		d.Config.Schema, d.Config.PayloadRetention.Milliseconds())
+}
+
+// getUnregisterInstanceSql returns the statement removing objects of this instance,
+// the schema is dropped when no other instance uses it.
+func (d *Driver) getUnregisterInstanceSql() string {
+	return d.getDropInstancesSql(fmt.Sprintf(`id = %s`, pq.QuoteLiteral(d.instanceId))) + d.getPurgePayloadsSql() + fmt.Sprintf(`
+		DO $drop$
+		BEGIN
+			LOCK TABLE "%s"."instances" IN ACCESS EXCLUSIVE MODE;
+			IF NOT EXISTS (SELECT FROM "%s"."instances") THEN
+				DROP SCHEMA "%s" CASCADE;
+			END IF;
+		END;
+		$drop$;`, d.Config.Schema, d.Config.Schema, d.Config.Schema)
+}
+
+func (d *Driver) getConsumePayloadSql() string {
+	return fmt.Sprintf(`DELETE FROM "%s"."payloads" WHERE id = $1 RETURNING payload;`, d.Config.Schema)
+}
+
+// getKeyColumnsSql returns the columns of the primary key, or of the replica identity index, in index order
+func (d *Driver) getKeyColumnsSql() string {
+	return `
+		SELECT a.attname FROM pg_index i
+		JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+		WHERE i.indexrelid = (
+			SELECT indexrelid FROM pg_index WHERE indrelid = $1::regclass AND (indisprimary OR indisreplident)
+			ORDER BY indisprimary DESC LIMIT 1
+		)
+		ORDER BY array_position(i.indkey::INT2[], a.attnum);`
+}
+
+func (d *Driver) getResolveChannelSql() string {
+	return fmt.Sprintf(`SELECT listener_uid, operation, table_name FROM "%s"."channels" WHERE channel = $1;`, d.Config.Schema)
+}
+
+// getRegisterListenerSql returns the statement mapping the listener channel to its listener, operation and table
+func (d *Driver) getRegisterListenerSql(listenerUid string, e *flash.Operation, table string) (string, string, error) {
+	uniqueName, err := d.getUniqueIdentifierForListenerEvent(listenerUid, e)
+	if err != nil {
+		return "", "", err
+	}
+	operationName, err := e.StrictName()
+	if err != nil {
+		return "", "", err
 	}
 
-	return statement, eventName, nil
+	eventName := uniqueName + "_event"
+	return fmt.Sprintf(`INSERT INTO "%s"."channels" (channel, listener_uid, operation, table_name, sequence_name, instance_id) VALUES (%s, %s, %s, %s, %s, %s) ON CONFLICT (channel) DO NOTHING;`,
+		d.Config.Schema, pq.QuoteLiteral(eventName), pq.QuoteLiteral(listenerUid), pq.QuoteLiteral(operationName), pq.QuoteLiteral(table),
+		pq.QuoteLiteral(uniqueName+"_seq"), pq.QuoteLiteral(d.instanceId)), eventName, nil
 }
 
-func (d *Driver) getDeleteTriggerSqlForEvent(listenerUid string, l *flash.ListenerConfig, e *flash.Operation) (string, string, error) {
+// getUnregisterListenerSql returns the statement removing the listener sequence and channel mapping
+func (d *Driver) getUnregisterListenerSql(listenerUid string, e *flash.Operation) (string, string, error) {
 	uniqueName, err := d.getUniqueIdentifierForListenerEvent(listenerUid, e)
 	if err != nil {
 		return "", "", err
 	}
 
-	triggerFnName := uniqueName + "_fn"
 	eventName := uniqueName + "_event"
+	return fmt.Sprintf(`DROP SEQUENCE IF EXISTS "%s"."%s";DELETE FROM "%s"."channels" WHERE channel = %s;`,
+		d.Config.Schema, uniqueName+"_seq", d.Config.Schema, pq.QuoteLiteral(eventName)), eventName, nil
+}
+
+// getDropTableTriggerSql returns the statement removing the trigger shared by all listeners of a table for an operation
+func (d *Driver) getDropTableTriggerSql(table string, e *flash.Operation) (string, error) {
+	uniqueName, err := d.getUniqueIdentifierForTableEvent(table, e)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`DROP FUNCTION IF EXISTS "%s"."%s" CASCADE;DELETE FROM "%s"."triggers" WHERE function_name = %s;`,
+		d.Config.Schema, uniqueName+"_fn", d.Config.Schema, pq.QuoteLiteral(uniqueName+"_fn")), nil
+}
 
-	return fmt.Sprintf(`DROP FUNCTION IF EXISTS "%s"."%s" CASCADE;`, d.Config.Schema, triggerFnName), eventName, nil
+func (d *Driver) getUniqueIdentifierForTableEvent(table string, e *flash.Operation) (string, error) {
+	operationName, err := e.StrictName()
+	if err != nil {
+		return "", err
+	}
+	return d.getHashedIdentifier(strings.ToLower(operationName), "table", d.instanceId, table), nil
 }
 
 func (d *Driver) getUniqueIdentifierForListenerEvent(listenerUid string, e *flash.Operation) (string, error) {
@@ -166,27 +584,49 @@ func (d *Driver) getUniqueIdentifierForListenerEvent(listenerUid string, e *flas
 	if err != nil {
 		return "", err
 	}
-	return strings.Join([]string{
-		d.Config.Schema,
-		listenerUid,
-		strings.ToLower(operationName),
-	}, "_"), nil
+	return d.getHashedIdentifier(strings.ToLower(operationName), "listener", d.instanceId, listenerUid), nil
 }
-func (d *Driver) parseEventName(channel string) (string, flash.Operation, error) {
-	parts := strings.Split(channel, "_")
-	if len(parts) != 4 {
-		return "", 0, errors.New("could not determine unique identifier")
+
+// getHashedIdentifier returns a collision-safe identifier as flash_<prefix>_<hash>.
+// The schema and instance are part of the hash, because notification channels are shared by the whole database.
+// Identifiers stay under the 63 bytes Postgres limit, even with the _trigger suffix.
+func (d *Driver) getHashedIdentifier(prefix string, parts ...string) string {
+	hash := sha256.Sum256([]byte(strings.Join(append([]string{d.Config.Schema}, parts...), "\x00")))
+	return "flash_" + prefix + "_" + hex.EncodeToString(hash[:12])
+}
+
+// resolveChannel returns the listener, operation and table of a notification channel.
+// Channels are cached when registered, the channels table is used as fallback.
+func (d *Driver) resolveChannel(channel string) (*channelTarget, error) {
+	d.channelsMutex.RLock()
+	target, exists := d.channels[channel]
+	d.channelsMutex.RUnlock()
+	if exists {
+		return target, nil
 	}
 
-	listenerUid := parts[1]
-	operation, err := flash.OperationFromName(parts[2])
+	query := d.getResolveChannelSql()
+	d._clientConfig.Logger.Trace().Str("query", query).Str("args", channel).Msg("sending sql request")
+
+	var listenerUid, operationName, table string
+	if err := d.conn.QueryRow(query, channel).Scan(&listenerUid, &operationName, &table); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("unknown channel %s", channel)
+		}
+		return nil, err
+	}
+	operation, err := flash.OperationFromName(operationName)
 	if err != nil {
-		return "", 0, err
+		return nil, err
 	}
 
-	return listenerUid, operation, nil
-
+	target = &channelTarget{listenerUid: listenerUid, operation: operation, table: table}
+	d.channelsMutex.Lock()
+	d.channels[channel] = target
+	d.channelsMutex.Unlock()
+	return target, nil
 }
+
 func (d *Driver) sanitizeTableName(tableName string) string {
 	segments := strings.Split(tableName, ".")
 	for i, segment := range segments {
@@ -198,36 +638,3 @@ func (d *Driver) sqlExec(conn *sql.DB, query string) (sql.Result, error) {
 	d._clientConfig.Logger.Trace().Str("query", query).Msg("sending sql request")
 	return conn.Exec(query)
 }
-
-func (d *Driver) getConditionsSql(conditions []*flash.ListenerCondition, table string) (string, error) {
-	rawConditions := make([]string, len(conditions))
-
-	for i, condition := range conditions {
-		operator := " IS "
-		valueRepr := ""
-		// TODO MULTI OPERATOR
-
-		switch condition.Value.(type) {
-		case nil:
-			valueRepr = "NULL"
-		case bool:
-			if condition.Value.(bool) == true {
-				valueRepr = "TRUE"
-			} else {
-				valueRepr = "FALSE"
-			}
-		case string, time.Time:
-			valueRepr = fmt.Sprintf(`'%s'`, condition.Value)
-		case float32, float64:
-			valueRepr = fmt.Sprintf(`%f`, condition.Value)
-		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
-			valueRepr = fmt.Sprintf(`%d`, condition.Value)
-		default:
-			return "", errors.New("could not convert condition value to sql")
-		}
-
-		rawConditions[i] = fmt.Sprintf(`%s."%s"%s%s`, table, condition.Column, operator, valueRepr)
-
-	}
-	return strings.Join(rawConditions, " AND "), nil
-}
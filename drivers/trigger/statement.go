@@ -0,0 +1,41 @@
+package trigger
+
+// usesStatementTrigger checks if the table is listened using a statement-level trigger for the operation.
+// Updated rows are paired using the key columns of the table, returned for UPDATE.
+// Tables without primary key nor replica identity index fall back to row-level triggers for UPDATE.
+func (d *Driver) usesStatementTrigger(table string, operation string) (bool, []string, error) {
+	if !d.Config.StatementLevelTriggers || operation == "TRUNCATE" {
+		return false, nil, nil
+	}
+	if operation != "UPDATE" {
+		return true, nil, nil
+	}
+
+	keyColumns, err := d.getKeyColumns(table)
+	if err != nil {
+		return false, nil, err
+	}
+	return len(keyColumns) > 0, keyColumns, nil
+}
+
+// getKeyColumns returns the columns of the primary key of the table, or of its replica identity index
+func (d *Driver) getKeyColumns(table string) ([]string, error) {
+	query := d.getKeyColumnsSql()
+	d._clientConfig.Logger.Trace().Str("query", query).Str("args", table).Msg("sending sql request")
+
+	rows, err := d.conn.Query(query, d.sanitizeTableName(table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keyColumns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		keyColumns = append(keyColumns, column)
+	}
+	return keyColumns, rows.Err()
+}
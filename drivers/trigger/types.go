@@ -0,0 +1,21 @@
+package trigger
+
+// getCodecColumns returns the columns of the table whose type has a codec in the registry of the client, with their type oid.
+// Values of these columns are sent as text, other values keep their JSON representation.
+func (d *Driver) getCodecColumns(table string) (map[string]uint32, error) {
+	codecColumns := make(map[string]uint32)
+	if d._clientConfig.Types == nil {
+		return codecColumns, nil
+	}
+
+	columnTypes, err := d.columnTypes.Get(d.conn, d.sanitizeTableName(table))
+	if err != nil {
+		return nil, err
+	}
+	for column, oid := range columnTypes {
+		if _, hasCodec := d._clientConfig.Types.Codec(oid); hasCodec {
+			codecColumns[column] = oid
+		}
+	}
+	return codecColumns, nil
+}
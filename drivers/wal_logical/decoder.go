@@ -0,0 +1,296 @@
+package wal_logical
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/quix-labs/flash"
+	"math"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Change is a row change decoded from the replication stream, independent of the output plugin
+type Change struct {
+	Operation flash.Operation  // Zero for transaction outcomes
+	Table     string           // Format: schema.table - e.g: public.posts
+	Old       *flash.EventData // Nil for insert and truncate
+	New       *flash.EventData // Nil for delete and truncate
+
+	Message  *flash.MessageEvent // Set with OperationMessage, Table is empty
+	Prepared string              // Global identifier of the prepared transaction, when decoded at prepare time
+	Origin   string              // Replication origin of the transaction, empty for local changes or when not reported
+	Outcome  *TransactionOutcome // Set alone when a transaction decoded at prepare time is committed or rolled back
+}
+
+// TransactionOutcome is only decoded when PluginOptions.TwoPhase is enabled
+type TransactionOutcome struct {
+	Gid       string
+	Committed bool
+}
+
+type ChangeHandler func(change *Change) error
+
+type PluginOptions struct {
+	Publications []string // Publications created by the driver
+	Streaming    bool     // See DriverConfig.UseStreaming
+	Binary       bool     // Binary tuples can be requested, see DriverConfig.UseBinaryTuples
+	TwoPhase     bool     // Decode prepared transactions at prepare time, see DriverConfig.UseTwoPhase
+
+	OnlyLocalOrigin bool // Skip changes having a replication origin when supported, see DriverConfig.OnlyLocalChanges
+
+	StreamMemoryLimit int64  // Size of streamed transactions kept in memory before spilling to disk, see DriverConfig.StreamMemoryLimit
+	StreamSpillDir    string // See DriverConfig.StreamSpillDir
+
+	ServerVersion int // Major version of the server, e.g: 16
+}
+
+// OutputDecoder translates the output of a logical decoding plugin into Changes
+type OutputDecoder interface {
+	// Init is called by the driver before replication starts, then after each reconnection.
+	// State of partially received transactions must be discarded, they are sent again by the server.
+	Init(clientConfig *flash.ClientConfig) error
+
+	// PluginName returns the output plugin used to create the replication slot
+	PluginName() string
+
+	// PluginArgs returns the options sent to the output plugin on START_REPLICATION
+	PluginArgs(options *PluginOptions) []string
+
+	// Decode parses received WAL data and calls handle for each decoded change, in commit order.
+	// Returns true when the end of a transaction is reached and the position can be flushed.
+	Decode(xld *pglogrepl.XLogData, handle ChangeHandler) (bool, error)
+}
+
+// decodeTextColumnData decodes text values following the value model shared by all drivers, see flash.TypeRegistry.DecodeText
+func decodeTextColumnData(types *flash.TypeRegistry, data []byte, dataType uint32) (interface{}, error) {
+	return types.DecodeText(dataType, string(data))
+}
+
+// decodeBinaryColumnData decodes binary tuples using pgtype codecs, enums are sent as their label.
+// PostgreSQL sends binary for every type having a send function, so types without pgtype codec (e.g: money, pg_lsn, PostGIS geometry)
+// return an error instead of decoding raw bytes, binary tuples are opt-in for this reason.
+// Domains share the binary representation of their base type, see TypeRegistry.TextFormatRequiredBy for other registry types.
+// Decoded values are converted to the value model of decodeTextColumnData.
+func decodeBinaryColumnData(typeMap *pgtype.Map, types *flash.TypeRegistry, data []byte, dataType uint32) (interface{}, error) {
+	for info, ok := types.Type(dataType); ok && info.Kind == flash.TypeKindDomain; info, ok = types.Type(dataType) {
+		dataType = info.BaseOid
+	}
+	if dt, ok := typeMap.TypeForOID(dataType); ok && dt.Codec.FormatSupported(pgtype.BinaryFormatCode) {
+		value, err := dt.Codec.DecodeValue(typeMap, dataType, pgtype.BinaryFormatCode, data)
+		if err != nil {
+			return nil, err
+		}
+		return normalizeBinaryValue(typeMap, dataType, value), nil
+	}
+	if info, ok := types.Type(dataType); ok && info.Kind == flash.TypeKindEnum {
+		return string(data), nil
+	}
+	if dataType == pgtype.TimetzOID && len(data) == 12 {
+		// Not supported by pgtype: microseconds since midnight, then zone offset in seconds west of UTC
+		return formatTime(int64(binary.BigEndian.Uint64(data))) + formatZoneOffset(-int32(binary.BigEndian.Uint32(data[8:]))), nil
+	}
+	return nil, fmt.Errorf("no binary codec for type %d, disable DriverConfig.UseBinaryTuples", dataType)
+}
+
+// normalizeBinaryValue converts values decoded by pgtype to the value model of decodeTextColumnData
+func normalizeBinaryValue(typeMap *pgtype.Map, dataType uint32, value any) any {
+	switch typedValue := value.(type) {
+	case int16:
+		return int64(typedValue)
+	case int32:
+		return int64(typedValue)
+	case uint32:
+		return int64(typedValue)
+	case float32:
+		// Shortest representation, as sent in text format: float32(1.1) -> 1.1 instead of 1.100000023841858
+		float, _ := strconv.ParseFloat(strconv.FormatFloat(float64(typedValue), 'g', -1, 32), 64)
+		return float
+	case time.Time:
+		return typedValue.UTC()
+	case pgtype.InfinityModifier:
+		return typedValue.String()
+	case pgtype.Numeric:
+		return formatNumeric(typedValue)
+	case pgtype.Time:
+		return formatTime(typedValue.Microseconds)
+	case pgtype.Interval:
+		return formatInterval(typedValue)
+	case [16]byte:
+		return fmt.Sprintf("%x-%x-%x-%x-%x", typedValue[0:4], typedValue[4:6], typedValue[6:8], typedValue[8:10], typedValue[10:16])
+	case netip.Prefix:
+		if dataType == pgtype.InetOID && typedValue.IsSingleIP() {
+			return typedValue.Addr().String()
+		}
+		return typedValue.String()
+	case net.HardwareAddr:
+		return typedValue.String()
+	case pgtype.Bits:
+		return formatBits(typedValue)
+	case pgtype.TID:
+		return fmt.Sprintf("(%d,%d)", typedValue.BlockNumber, typedValue.OffsetNumber)
+	case pgtype.Point:
+		return formatPoints(typedValue.P)
+	case pgtype.Line:
+		return "{" + formatFloat(typedValue.A) + "," + formatFloat(typedValue.B) + "," + formatFloat(typedValue.C) + "}"
+	case pgtype.Lseg:
+		return "[" + formatPoints(typedValue.P[:]...) + "]"
+	case pgtype.Box:
+		return formatPoints(typedValue.P[:]...)
+	case pgtype.Path:
+		if typedValue.Closed {
+			return "(" + formatPoints(typedValue.P...) + ")"
+		}
+		return "[" + formatPoints(typedValue.P...) + "]"
+	case pgtype.Polygon:
+		return "(" + formatPoints(typedValue.P...) + ")"
+	case pgtype.Circle:
+		return "<" + formatPoints(typedValue.P) + "," + formatFloat(typedValue.R) + ">"
+	case []any:
+		elementType := uint32(0)
+		if dt, ok := typeMap.TypeForOID(dataType); ok {
+			if arrayCodec, ok := dt.Codec.(*pgtype.ArrayCodec); ok {
+				elementType = arrayCodec.ElementType.OID
+			}
+		}
+		for i, element := range typedValue {
+			typedValue[i] = normalizeBinaryValue(typeMap, elementType, element)
+		}
+	}
+	return value
+}
+
+// formatNumeric returns the text representation of numeric values, keeping their scale - e.g: 12.50
+func formatNumeric(numeric pgtype.Numeric) string {
+	switch {
+	case numeric.NaN:
+		return "NaN"
+	case numeric.InfinityModifier == pgtype.Infinity:
+		return "Infinity"
+	case numeric.InfinityModifier == pgtype.NegativeInfinity:
+		return "-Infinity"
+	}
+
+	digits := numeric.Int.String()
+	sign := ""
+	if strings.HasPrefix(digits, "-") {
+		sign, digits = "-", digits[1:]
+	}
+	if numeric.Exp >= 0 {
+		if digits == "0" {
+			return "0"
+		}
+		return sign + digits + strings.Repeat("0", int(numeric.Exp))
+	}
+	scale := int(-numeric.Exp)
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+}
+
+// formatTime returns the text representation of time values - e.g: 03:04:05.5
+func formatTime(microseconds int64) string {
+	hours := microseconds / 3_600_000_000
+	minutes := microseconds / 60_000_000 % 60
+	return fmt.Sprintf("%02d:%02d:%s", hours, minutes, formatSeconds(microseconds%60_000_000))
+}
+
+// formatInterval returns the text representation of interval values, using the default postgres IntervalStyle - e.g: -1 days +02:00:00
+func formatInterval(interval pgtype.Interval) string {
+	var parts []string
+	negativeBefore := false
+	addPart := func(value int64, unit string) {
+		if value == 0 {
+			return
+		}
+		part := fmt.Sprintf("%d %s", value, unit)
+		if value != 1 {
+			part += "s"
+		}
+		if negativeBefore && value > 0 {
+			part = "+" + part
+		}
+		parts = append(parts, part)
+		negativeBefore = value < 0
+	}
+	addPart(int64(interval.Months/12), "year")
+	addPart(int64(interval.Months%12), "mon")
+	addPart(int64(interval.Days), "day")
+
+	if microseconds := interval.Microseconds; microseconds != 0 || len(parts) == 0 {
+		sign := ""
+		if microseconds < 0 {
+			sign, microseconds = "-", -microseconds
+		} else if negativeBefore {
+			sign = "+"
+		}
+		parts = append(parts, sign+formatTime(microseconds))
+	}
+	return strings.Join(parts, " ")
+}
+
+// formatZoneOffset returns the text representation of zone offsets of timetz values - e.g: +02, -05:30
+func formatZoneOffset(seconds int32) string {
+	sign := "+"
+	if seconds < 0 {
+		sign, seconds = "-", -seconds
+	}
+	offset := fmt.Sprintf("%s%02d", sign, seconds/3600)
+	if seconds%3600 != 0 {
+		offset += fmt.Sprintf(":%02d", seconds/60%60)
+	}
+	if seconds%60 != 0 {
+		offset += fmt.Sprintf(":%02d", seconds%60)
+	}
+	return offset
+}
+
+// formatBits returns the text representation of bit and varbit values - e.g: 10110
+func formatBits(bits pgtype.Bits) string {
+	var builder strings.Builder
+	for i := int32(0); i < bits.Len; i++ {
+		if bits.Bytes[i/8]&(0x80>>(i%8)) != 0 {
+			builder.WriteByte('1')
+		} else {
+			builder.WriteByte('0')
+		}
+	}
+	return builder.String()
+}
+
+// formatPoints returns the text representation of points of geometric values, separated by commas - e.g: (1,2),(3.5,4)
+func formatPoints(points ...pgtype.Vec2) string {
+	formatted := make([]string, len(points))
+	for i, point := range points {
+		formatted[i] = "(" + formatFloat(point.X) + "," + formatFloat(point.Y) + ")"
+	}
+	return strings.Join(formatted, ",")
+}
+
+// formatFloat returns the shortest representation of float8 values, using exponents as postgres does - e.g: 1.5, 1e+20
+func formatFloat(float float64) string {
+	switch {
+	case math.IsInf(float, 1):
+		return "Infinity"
+	case math.IsInf(float, -1):
+		return "-Infinity"
+	}
+	if exponent := math.Floor(math.Log10(math.Abs(float))); float != 0 && (exponent < -4 || exponent >= 15) {
+		return strconv.FormatFloat(float, 'e', -1, 64)
+	}
+	return strconv.FormatFloat(float, 'f', -1, 64)
+}
+
+// formatSeconds returns seconds with at least 2 digits, and without trailing zeros in the fractional part
+func formatSeconds(microseconds int64) string {
+	seconds := fmt.Sprintf("%02d", microseconds/1_000_000)
+	if fraction := microseconds % 1_000_000; fraction != 0 {
+		seconds += "." + strings.TrimRight(fmt.Sprintf("%06d", fraction), "0")
+	}
+	return seconds
+}
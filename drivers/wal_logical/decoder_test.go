@@ -0,0 +1,199 @@
+package wal_logical
+
+import (
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/quix-labs/flash"
+	"math"
+	"math/big"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var decoderTestValues = []struct {
+	name     string
+	dataType uint32
+	value    any
+}{
+	{"Int8", pgtype.Int8OID, int64(123456789)},
+	{"Numeric", pgtype.NumericOID, 123456.789},
+	{"Timestamptz", pgtype.TimestamptzOID, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+	{"Bytea", pgtype.ByteaOID, []byte("some binary content")},
+	{"Text", pgtype.TextOID, "some text content"},
+	{"Int4", pgtype.Int4OID, int32(-42)},
+	{"Float4", pgtype.Float4OID, float32(1.1)},
+	{"Date", pgtype.DateOID, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+	{"UUID", pgtype.UUIDOID, [16]byte{0x12, 0x3e, 0x45, 0x67, 0xe8, 0x9b, 0x12, 0xd3, 0xa4, 0x56, 0x42, 0x66, 0x14, 0x17, 0x40, 0x00}},
+	{"Int4Array", pgtype.Int4ArrayOID, []int32{1, 2, 3}},
+	{"Point", pgtype.PointOID, pgtype.Point{P: pgtype.Vec2{X: 1.5, Y: -2}, Valid: true}},
+	{"Lseg", pgtype.LsegOID, pgtype.Lseg{P: [2]pgtype.Vec2{{X: 1, Y: 2}, {X: 3.25, Y: 4}}, Valid: true}},
+	{"Box", pgtype.BoxOID, pgtype.Box{P: [2]pgtype.Vec2{{X: 3, Y: 4}, {X: 1, Y: 2}}, Valid: true}},
+	{"Path", pgtype.PathOID, pgtype.Path{P: []pgtype.Vec2{{X: 1, Y: 2}, {X: 3, Y: 4}}, Valid: true}},
+	{"Closed Path", pgtype.PathOID, pgtype.Path{P: []pgtype.Vec2{{X: 1, Y: 2}, {X: 3, Y: 4}, {X: 5, Y: 0}}, Closed: true, Valid: true}},
+	{"Polygon", pgtype.PolygonOID, pgtype.Polygon{P: []pgtype.Vec2{{X: 0, Y: 0}, {X: 0, Y: 1}, {X: 1, Y: 0}}, Valid: true}},
+	{"Circle", pgtype.CircleOID, pgtype.Circle{P: pgtype.Vec2{X: 1, Y: 2}, R: 0.5, Valid: true}},
+	{"Macaddr", pgtype.MacaddrOID, net.HardwareAddr{0x08, 0x00, 0x2b, 0x01, 0x02, 0x03}},
+	{"Bit", pgtype.BitOID, pgtype.Bits{Bytes: []byte{0xb0}, Len: 4, Valid: true}},
+	{"Varbit", pgtype.VarbitOID, pgtype.Bits{Bytes: []byte{0xa5, 0x80}, Len: 10, Valid: true}},
+	{"TID", pgtype.TIDOID, pgtype.TID{BlockNumber: 12, OffsetNumber: 3, Valid: true}},
+}
+
+func encodeTestValue(tb testing.TB, typeMap *pgtype.Map, dataType uint32, format int16, value any) []byte {
+	tb.Helper()
+	data, err := typeMap.Encode(dataType, format, value, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+func TestDecodeBinaryColumnData(t *testing.T) {
+	typeMap := pgtype.NewMap()
+	for _, test := range decoderTestValues {
+		t.Run(test.name, func(t *testing.T) {
+			textValue, err := decodeTextColumnData(nil, encodeTestValue(t, typeMap, test.dataType, pgtype.TextFormatCode, test.value), test.dataType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			binaryValue, err := decodeBinaryColumnData(typeMap, nil, encodeTestValue(t, typeMap, test.dataType, pgtype.BinaryFormatCode, test.value), test.dataType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Same instant, location may differ
+			if textTime, ok := textValue.(time.Time); ok && textTime.Equal(binaryValue.(time.Time)) {
+				return
+			}
+			if !reflect.DeepEqual(textValue, binaryValue) {
+				t.Errorf("binary value %#v differs from text value %#v", binaryValue, textValue)
+			}
+		})
+	}
+
+	// Types without codec are rejected instead of returning raw bytes, e.g: money 123.45 is sent as int64 12345
+	const moneyOid = 790
+	if value, err := decodeBinaryColumnData(typeMap, nil, []byte{0, 0, 0, 0, 0, 0, 0x30, 0x39}, moneyOid); err == nil {
+		t.Errorf("expected binary money to be rejected, got %#v", value)
+	}
+
+	// timetz has no pgtype codec, 03:04:05.5 in zone -05:30
+	timetzData := []byte{0, 0, 0, 0x02, 0x92, 0x5c, 0xf4, 0x60, 0, 0, 0x4d, 0x58}
+	if value, err := decodeBinaryColumnData(typeMap, nil, timetzData, pgtype.TimetzOID); err != nil || value != "03:04:05.5-05:30" {
+		t.Errorf("binary timetz decoded as %#v (%v), expected 03:04:05.5-05:30", value, err)
+	}
+}
+
+func TestDecodeColumnDataWithTypeRegistry(t *testing.T) {
+	typeMap := pgtype.NewMap()
+	types := flash.NewTypeRegistry()
+	types.AddType(&flash.TypeInfo{Oid: 100, Name: "public.mood", Kind: flash.TypeKindEnum})
+	types.AddType(&flash.TypeInfo{Oid: 101, Name: "public.amount", Kind: flash.TypeKindDomain, BaseOid: pgtype.Int8OID})
+	types.AddType(&flash.TypeInfo{Oid: 102, Name: "public.item", Kind: flash.TypeKindComposite, Fields: []*flash.TypeField{
+		{Name: "amount", Oid: 101},
+		{Name: "mood", Oid: 100},
+		{Name: "created_at", Oid: pgtype.TimestamptzOID},
+	}})
+
+	value, err := decodeTextColumnData(types, []byte(`(12,happy,"2024-01-02 03:04:05+00")`), 102)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]any{"amount": int64(12), "mood": "happy", "created_at": time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	item := value.(map[string]any)
+	if createdAt, ok := item["created_at"].(time.Time); ok && createdAt.Equal(expected["created_at"].(time.Time)) {
+		item["created_at"] = expected["created_at"]
+	}
+	if !reflect.DeepEqual(item, expected) {
+		t.Errorf("composite decoded as %#v, expected %#v", item, expected)
+	}
+
+	// Domains share the binary representation of their base type
+	value, err = decodeBinaryColumnData(typeMap, types, encodeTestValue(t, typeMap, pgtype.Int8OID, pgtype.BinaryFormatCode, int64(12)), 101)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != int64(12) {
+		t.Errorf("binary domain decoded as %#v, expected int64(12)", value)
+	}
+
+	// Enums are sent as their label
+	value, err = decodeBinaryColumnData(typeMap, types, []byte("happy"), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "happy" {
+		t.Errorf("binary enum decoded as %#v, expected happy", value)
+	}
+}
+
+func TestNormalizeBinaryValue(t *testing.T) {
+	typeMap := pgtype.NewMap()
+	tests := []struct {
+		name     string
+		dataType uint32
+		value    any
+		expected any
+	}{
+		{"Numeric", pgtype.NumericOID, pgtype.Numeric{Int: big.NewInt(1250), Exp: -2, Valid: true}, "12.50"},
+		{"Numeric Small", pgtype.NumericOID, pgtype.Numeric{Int: big.NewInt(-5), Exp: -3, Valid: true}, "-0.005"},
+		{"Numeric Exponent", pgtype.NumericOID, pgtype.Numeric{Int: big.NewInt(12), Exp: 2, Valid: true}, "1200"},
+		{"Numeric NaN", pgtype.NumericOID, pgtype.Numeric{NaN: true, Valid: true}, "NaN"},
+		{"Time", pgtype.TimeOID, pgtype.Time{Microseconds: 3*3_600_000_000 + 4*60_000_000 + 5_500_000, Valid: true}, "03:04:05.5"},
+		{"Interval", pgtype.IntervalOID, pgtype.Interval{Months: 14, Days: 3, Microseconds: 3_600_000_000, Valid: true}, "1 year 2 mons 3 days 01:00:00"},
+		{"Interval Mixed Signs", pgtype.IntervalOID, pgtype.Interval{Days: -1, Microseconds: 7_200_000_000, Valid: true}, "-1 days +02:00:00"},
+		{"Interval Zero", pgtype.IntervalOID, pgtype.Interval{Valid: true}, "00:00:00"},
+		{"Inet Host", pgtype.InetOID, netip.MustParsePrefix("192.168.0.1/32"), "192.168.0.1"},
+		{"Inet Network", pgtype.InetOID, netip.MustParsePrefix("192.168.0.1/24"), "192.168.0.1/24"},
+		{"Cidr", pgtype.CIDROID, netip.MustParsePrefix("192.168.0.0/32"), "192.168.0.0/32"},
+		{"Timestamp Infinity", pgtype.TimestamptzOID, pgtype.Infinity, "infinity"},
+		{"Point Exponent", pgtype.PointOID, pgtype.Point{P: pgtype.Vec2{X: 1e20, Y: 0.00001}, Valid: true}, "(1e+20,1e-05)"},
+		{"Line", pgtype.LineOID, pgtype.Line{A: 1, B: -1, C: 0.5, Valid: true}, "{1,-1,0.5}"},
+		{"Circle Infinity", pgtype.CircleOID, pgtype.Circle{P: pgtype.Vec2{X: math.Inf(1)}, R: 1, Valid: true}, "<(Infinity,0),1>"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if value := normalizeBinaryValue(typeMap, test.dataType, test.value); !reflect.DeepEqual(value, test.expected) {
+				t.Errorf("normalizeBinaryValue() = %#v, expected %#v", value, test.expected)
+			}
+		})
+	}
+}
+
+func TestParseServerVersion(t *testing.T) {
+	tests := map[string]int{
+		"16.2 (Debian 16.2-1.pgdg120+2)": 16,
+		"14.0":                           14,
+		"17beta1":                        17,
+		"9.6.24":                         9,
+		"":                               0,
+	}
+	for version, expected := range tests {
+		if major := parseServerVersion(version); major != expected {
+			t.Errorf("parseServerVersion(%q) = %d, expected %d", version, major, expected)
+		}
+	}
+}
+
+func BenchmarkDecodeColumnData(b *testing.B) {
+	typeMap := pgtype.NewMap()
+	for _, test := range decoderTestValues {
+		textData := encodeTestValue(b, typeMap, test.dataType, pgtype.TextFormatCode, test.value)
+		binaryData := encodeTestValue(b, typeMap, test.dataType, pgtype.BinaryFormatCode, test.value)
+
+		b.Run(test.name+"/Text", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := decodeTextColumnData(nil, textData, test.dataType); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(test.name+"/Binary", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := decodeBinaryColumnData(typeMap, nil, binaryData, test.dataType); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
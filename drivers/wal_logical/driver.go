@@ -1,16 +1,52 @@
 package wal_logical
 
 import (
+	"fmt"
 	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/quix-labs/flash"
+	"io"
+	"sync"
+	"time"
 )
 
 type DriverConfig struct {
 	PublicationSlotPrefix string // Default to flash_publication -> Must be unique across all your instances
 	ReplicationSlot       string // Default to flash_replication -> Must be unique across all your instances
-	UseStreaming          bool   // Default to false -> allow usage of stream for big transaction, can have big memory impact
+	UseStreaming          bool   // Default to false -> allow usage of stream for big transaction, buffered until commit
+	StreamMemoryLimit     int64  // Default to 64 MiB, negative for no limit -> buffered streamed transactions beyond this size are spilled to disk
+	StreamSpillDir        string // Default to os.TempDir() -> directory of spilled streamed transactions
+	UseBinaryTuples       bool   // Default to false -> request binary tuples on PostgreSQL 14+, faster to decode, see decodeBinaryColumnData
+	UseTwoPhase           bool   // Default to false -> deliver prepared transactions at prepare time, requires PostgreSQL 15+
+	OnlyLocalChanges      bool   // Default to false -> skip changes having a replication origin, filtered by the server on PostgreSQL 16+
+
+	OutputDecoder OutputDecoder // Default to pgoutput -> see NewPgOutputDecoder and NewWal2JsonDecoder
+	ToastStrategy ToastStrategy // Default to ToastCarryOver -> how unchanged TOAST columns of updated rows are resolved
+
+	ReplicaIdentityPolicy ReplicaIdentityPolicy // Default to ReplicaIdentityTemporaryFull -> how the replica identity of listened tables is handled
+
+	MetadataSchema    string        // Default to flash_wal_logical -> shared by all instances, tracks objects owned by each instance
+	HeartbeatInterval time.Duration // Default to 10 seconds -> delay between two heartbeats of this instance
+	InstanceTimeout   time.Duration // Default to 1 minute -> objects of instances without heartbeat for this duration are removed
+
+	MinReconnectInterval time.Duration // Default to 1 second -> first delay before reconnecting, doubled on each failure
+	MaxReconnectInterval time.Duration // Default to 1 minute -> maximum delay between two reconnection attempts
+	MaxReconnectAttempts int           // Default to 0 (infinite) -> Listen returns an error after N consecutive failures
+
+	MaxLagBytes     uint64                        // Default to 0 (no limit) -> max retained WAL or flush lag, see Driver.Health
+	MaxMessageDelay time.Duration                 // Default to 0 (no limit) -> max delay without message from the server, see Driver.Health
+	OnLagExceeded   func(stats *Stats, err error) // Default to nil -> called every HeartbeatInterval while Driver.Health fails
 }
 
+// ReplicaIdentityPolicy defines which columns are sent in old rows of updates and deletes
+type ReplicaIdentityPolicy uint8
+
+const (
+	ReplicaIdentityTemporaryFull ReplicaIdentityPolicy = iota // Set FULL while listened, the original identity is restored on unlisten and Close
+	ReplicaIdentityKeep                                       // Keep the existing identity, old rows only contain identity columns
+	ReplicaIdentityRequireFull                                // Keep the existing identity, Listen fails if a listened table is not FULL
+)
+
 var (
 	_ flash.Driver = (*Driver)(nil) // Interface implementation
 )
@@ -25,9 +61,36 @@ func NewDriver(config *DriverConfig) *Driver {
 	if config.ReplicationSlot == "" {
 		config.ReplicationSlot = "flash_replication"
 	}
+	if config.StreamMemoryLimit == 0 {
+		config.StreamMemoryLimit = 64 << 20
+	}
+	if config.OutputDecoder == nil {
+		config.OutputDecoder = NewPgOutputDecoder()
+	}
+	if config.MetadataSchema == "" {
+		config.MetadataSchema = "flash_wal_logical"
+	}
+	if config.HeartbeatInterval == time.Duration(0) {
+		config.HeartbeatInterval = 10 * time.Second
+	}
+	if config.InstanceTimeout == time.Duration(0) {
+		config.InstanceTimeout = time.Minute
+	}
+	if config.MinReconnectInterval == time.Duration(0) {
+		config.MinReconnectInterval = time.Second
+	}
+	if config.MaxReconnectInterval == time.Duration(0) {
+		config.MaxReconnectInterval = time.Minute
+	}
 	return &Driver{
-		Config:          config,
-		activeListeners: make(map[string]map[string]*flash.ListenerConfig),
+		Config:           config,
+		instanceId:       generateInstanceId(),
+		activeListeners:  make(map[string]map[string]*activeListener),
+		messageListeners: make(map[string]*flash.ListenerConfig),
+		partitionRoots:   make(map[string]string),
+		typeMap:          pgtype.NewMap(),
+		primaryKeys:      make(map[string][]*keyColumn),
+		shutdown:         make(chan struct{}),
 	}
 }
 
@@ -43,24 +106,38 @@ type PublicationState map[string]*struct {
 type Driver struct {
 	Config *DriverConfig
 
-	queryConn *pgconn.PgConn
+	queryConn  *pgconn.PgConn
+	instanceId string
 
 	// Replication handling
 	replicationConn *pgconn.PgConn
 
-	replicationState   *replicationState
-	activePublications map[string]bool
-	activeListeners    map[string]map[string]*flash.ListenerConfig // key 1: tableName -> key 2: listenerUid
+	replicationState     *replicationState
+	activePublications   map[string]bool
+	activeListeners      map[string]map[string]*activeListener // key 1: tableName -> key 2: listenerUid
+	messageListeners     map[string]*flash.ListenerConfig      // key: listenerUid -> messages are always streamed, no publication needed
+	partitionRoots       map[string]string                     // key: partition -> published partitioned table, see refreshPartitions
+	activeListenersMutex sync.RWMutex
 
 	eventsChan *flash.DatabaseEventsChan
 
+	// Unchanged TOAST handling, only used by the replication goroutine
+	fetchConn   *pgconn.PgConn
+	typeMap     *pgtype.Map
+	primaryKeys map[string][]*keyColumn // key: tableName
+
 	subscriptionState *subscriptionState
+	shutdown          chan struct{} // Closed by Close, stops reconnection attempts
 	_clientConfig     *flash.ClientConfig
 }
 
 func (d *Driver) Init(clientConfig *flash.ClientConfig) error {
 	d._clientConfig = clientConfig
 
+	if err := d._clientConfig.Types.Load(d._clientConfig.DatabaseCnx); err != nil {
+		return err
+	}
+
 	if err := d.initQuerying(); err != nil {
 		return err
 	}
@@ -73,12 +150,27 @@ func (d *Driver) Init(clientConfig *flash.ClientConfig) error {
 }
 
 func (d *Driver) HandleOperationListenStart(listenerUid string, listenerConfig *flash.ListenerConfig, event flash.Operation) error {
+	if event == flash.OperationNotification {
+		return fmt.Errorf("%w: %s requires LISTEN, use the trigger driver", flash.ErrOperationNotSupported, event)
+	}
+	if event == flash.OperationMessage {
+		d.activeListenersMutex.Lock()
+		d.messageListeners[listenerUid] = listenerConfig
+		d.activeListenersMutex.Unlock()
+		return nil
+	}
+
 	tableName := d.sanitizeTableName(listenerConfig.Table, false)
 
-	//TODO ALTER PUBLICATION noinsert SET (publish = 'update, delete');
+	d.activeListenersMutex.Lock()
 	if _, exists := d.activeListeners[tableName]; !exists {
-		d.activeListeners[tableName] = make(map[string]*flash.ListenerConfig)
+		d.activeListeners[tableName] = make(map[string]*activeListener)
 	}
+	if _, exists := d.activeListeners[tableName][listenerUid]; !exists {
+		d.activeListeners[tableName][listenerUid] = &activeListener{config: listenerConfig}
+	}
+	d.activeListeners[tableName][listenerUid].operations |= event
+	d.activeListenersMutex.Unlock()
 
 	// Keep in goroutine because channel is listened on start
 	go func() {
@@ -89,13 +181,34 @@ func (d *Driver) HandleOperationListenStart(listenerUid string, listenerConfig *
 		}
 	}()
 
-	d.activeListeners[tableName][listenerUid] = listenerConfig //TODO MORE PERFORMANT STRUCTURE
 	return nil
 }
 
 func (d *Driver) HandleOperationListenStop(listenerUid string, listenerConfig *flash.ListenerConfig, event flash.Operation) error {
+	if event == flash.OperationNotification {
+		return nil // Never started
+	}
+	if event == flash.OperationMessage {
+		d.activeListenersMutex.Lock()
+		delete(d.messageListeners, listenerUid)
+		d.activeListenersMutex.Unlock()
+		return nil
+	}
+
 	tableName := d.sanitizeTableName(listenerConfig.Table, false)
 
+	d.activeListenersMutex.Lock()
+	if listener, exists := d.activeListeners[tableName][listenerUid]; exists {
+		listener.operations &= ^event
+		if listener.operations == 0 {
+			delete(d.activeListeners[tableName], listenerUid)
+		}
+	}
+	if len(d.activeListeners[tableName]) == 0 {
+		delete(d.activeListeners, tableName)
+	}
+	d.activeListenersMutex.Unlock()
+
 	// Keep in goroutine because channel is listened on start
 	go func() {
 		d.subscriptionState.unsubChan <- &subscriptionClaim{
@@ -105,7 +218,6 @@ func (d *Driver) HandleOperationListenStop(listenerUid string, listenerConfig *f
 		}
 	}()
 
-	delete(d.activeListeners[tableName], listenerUid) //TODO MORE PERFORMANT STRUCTURE
 	return nil
 }
 
@@ -134,18 +246,33 @@ func (d *Driver) Listen(eventsChan *flash.DatabaseEventsChan) error {
 		}
 	}()
 
-	for {
-		select {
-		case err := <-errChan:
-			return err
-		}
+	select {
+	case err := <-errChan:
+		return err
+	case <-d.shutdown:
+		return nil
 	}
 }
 
 func (d *Driver) Close() error {
+	select {
+	case <-d.shutdown:
+	default:
+		close(d.shutdown)
+	}
+
 	err := d.closeQuerying()
 	if err != nil {
 		return err
 	}
+	if err := d.closeFetching(); err != nil {
+		return err
+	}
+	// Remove files of spilled streamed transactions
+	if closer, ok := d.Config.OutputDecoder.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
 	return d.closeReplicator()
 }
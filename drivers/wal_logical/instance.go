@@ -0,0 +1,65 @@
+package wal_logical
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/quix-labs/flash"
+)
+
+func generateInstanceId() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+func (d *Driver) refreshHeartbeat() error {
+	results, err := d.sqlExec(d.queryConn, d.getRefreshHeartbeatSql())
+	if err != nil {
+		return err
+	}
+	if len(results) > 0 && results[0].CommandTag.RowsAffected() > 0 {
+		return nil
+	}
+
+	// This instance was considered dead by another one, and its objects removed
+	d._clientConfig.EmitLifecycleEvent(&flash.LifecycleEvent{
+		Type: flash.LifecycleGapDetected,
+		Err:  errors.New("instance objects were collected after missed heartbeats"),
+	})
+	return d.restoreObjects()
+}
+
+// restoreObjects registers this instance again, recreates the publication with all published tables, then registers the replication slot.
+// An inactive slot was dropped, the replicator creates it again on reconnection.
+func (d *Driver) restoreObjects() error {
+	publicationName := d.getPublicationName()
+	statement := d.getBootstrapSql() +
+		d.getCreatePublicationSql(publicationName, parseServerVersion(d.queryConn.ParameterStatus("server_version"))) +
+		d.getRegisterReplicationSlotSql()
+	for tableName := range d.subscriptionState.publishedTables {
+		statement += d.getAddPublicationTableSql(tableName)
+	}
+	if _, err := d.sqlExec(d.queryConn, statement); err != nil {
+		return err
+	}
+	d.activePublications[publicationName] = true
+
+	// Replica identities of partitions were restored by the collector, they are applied again
+	for tableName := range d.subscriptionState.publishedTables {
+		delete(d.subscriptionState.partitions, tableName)
+		if err := d.refreshPartitions(tableName, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectGarbage removes objects owned by instances without recent heartbeat
+func (d *Driver) collectGarbage() {
+	if _, err := d.sqlExec(d.queryConn, d.getCollectGarbageSql()); err != nil {
+		d._clientConfig.Logger.Warn().Err(err).Msg("could not collect objects of dead instances")
+	}
+}
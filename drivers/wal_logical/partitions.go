@@ -0,0 +1,104 @@
+package wal_logical
+
+import (
+	"fmt"
+)
+
+// refreshPartitions lists partitions of the published table, recursively.
+// Partitions attached since the last call are mapped to the table, and get REPLICA IDENTITY FULL with ReplicaIdentityTemporaryFull.
+// Partitions detached since the last call are released.
+// With ReplicaIdentityRequireFull, an error is returned in strict mode if a partition is not FULL, otherwise it is logged.
+func (d *Driver) refreshPartitions(tableName string, strict bool) error {
+	results, err := d.sqlExec(d.queryConn, d.getPartitionsSql(tableName))
+	if err != nil {
+		return err
+	}
+
+	partitions := make(map[string]bool)
+	if len(results) > 0 {
+		for _, row := range results[0].Rows {
+			partitions[string(row[0])] = string(row[1]) == "r" // Only leaf partitions contain rows
+		}
+	}
+	known := d.subscriptionState.partitions[tableName]
+
+	statement := ""
+	for partition, isLeaf := range partitions {
+		if _, exists := known[partition]; exists || !isLeaf {
+			continue
+		}
+		switch d.Config.ReplicaIdentityPolicy {
+		case ReplicaIdentityTemporaryFull:
+			quotedPartition := d.sanitizeTableName(partition, true)
+			statement += d.getSaveReplicaIdentitySql(quotedPartition) + fmt.Sprintf(`ALTER TABLE %s REPLICA IDENTITY FULL;`, quotedPartition)
+		case ReplicaIdentityRequireFull:
+			if err := d.checkReplicaIdentity(partition); err != nil {
+				if strict {
+					return err
+				}
+				d._clientConfig.Logger.Warn().Err(err).Str("table", tableName).Msg("partition does not use REPLICA IDENTITY FULL")
+			}
+		}
+	}
+	for partition := range known {
+		if _, exists := partitions[partition]; !exists {
+			statement += d.getReleasePartitionSql(partition)
+		}
+	}
+	if statement != "" {
+		if _, err := d.sqlExec(d.queryConn, statement); err != nil {
+			return err
+		}
+	}
+
+	d.activeListenersMutex.Lock()
+	for partition := range known {
+		delete(d.partitionRoots, partition)
+	}
+	for partition := range partitions {
+		d.partitionRoots[partition] = tableName
+	}
+	d.activeListenersMutex.Unlock()
+
+	if len(partitions) == 0 {
+		delete(d.subscriptionState.partitions, tableName)
+	} else {
+		d.subscriptionState.partitions[tableName] = partitions
+	}
+	return nil
+}
+
+// getReleasePartitionsSql returns the statement releasing all known partitions of the table, which is no longer published
+func (d *Driver) getReleasePartitionsSql(tableName string) string {
+	statement := ""
+	d.activeListenersMutex.Lock()
+	for partition := range d.subscriptionState.partitions[tableName] {
+		statement += d.getReleasePartitionSql(partition)
+		delete(d.partitionRoots, partition)
+	}
+	d.activeListenersMutex.Unlock()
+	delete(d.subscriptionState.partitions, tableName)
+	return statement
+}
+
+func (d *Driver) getReleasePartitionSql(partition string) string {
+	if d.Config.ReplicaIdentityPolicy != ReplicaIdentityTemporaryFull {
+		return ""
+	}
+	return d.getRestoreReplicaIdentitySql(d.sanitizeTableName(partition, true))
+}
+
+// resolvePartition returns the listened partitioned table of a partition, or the table itself.
+// Only needed when changes are reported under the partition name: wal2json, or pgoutput without publish_via_partition_root.
+func (d *Driver) resolvePartition(tableName string) string {
+	d.activeListenersMutex.RLock()
+	defer d.activeListenersMutex.RUnlock()
+
+	if _, listened := d.activeListeners[tableName]; listened {
+		return tableName
+	}
+	if root, isPartition := d.partitionRoots[tableName]; isPartition {
+		return root
+	}
+	return tableName
+}
@@ -0,0 +1,26 @@
+package wal_logical
+
+import (
+	"github.com/quix-labs/flash"
+	"testing"
+)
+
+func TestResolvePartition(t *testing.T) {
+	driver := NewDriver(nil)
+	driver.activeListeners["public.events"] = map[string]*activeListener{"uid": {config: &flash.ListenerConfig{Table: "events"}, operations: flash.OperationInsert}}
+	driver.activeListeners["public.events_2025"] = map[string]*activeListener{"uid": {config: &flash.ListenerConfig{Table: "events_2025"}, operations: flash.OperationInsert}}
+	driver.partitionRoots["public.events_2024"] = "public.events"
+	driver.partitionRoots["public.events_2025"] = "public.events"
+
+	tests := map[string]string{
+		"public.events_2024": "public.events",      // Reported under the partition name
+		"public.events_2025": "public.events_2025", // Listened directly
+		"public.events":      "public.events",
+		"public.posts":       "public.posts",
+	}
+	for table, expected := range tests {
+		if resolved := driver.resolvePartition(table); resolved != expected {
+			t.Errorf("resolvePartition(%q) = %q, expected %q", table, resolved, expected)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package wal_logical
+
+import (
+	"fmt"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/quix-labs/flash"
+	"strings"
+	"sync"
+)
+
+var (
+	_ OutputDecoder = (*PgOutputDecoder)(nil) // Interface implementation
+)
+
+// PgOutputDecoder decodes the binary protocol of the built-in pgoutput plugin
+type PgOutputDecoder struct {
+	lastCommitLSN pglogrepl.LSN
+
+	typeMap   *pgtype.Map
+	relations map[uint32]*pglogrepl.RelationMessageV2
+
+	processMessages bool
+	preparing       string // Gid of the transaction decoded at prepare time, see PluginOptions.TwoPhase
+	origin          string // Replication origin of the current transaction, empty for local changes
+	inStream        bool
+	streamXid       uint32
+	streamQueues    map[uint32]*streamQueue // key: xid -> messages of in-progress streamed transactions
+	queuesMutex     sync.Mutex              // Queues are read by StreamQueueSizes from other goroutines
+	queuedBytes     int64                   // Size of messages kept in memory by all queues
+	memoryLimit     int64                   // See PluginOptions.StreamMemoryLimit
+	spillDir        string                  // See PluginOptions.StreamSpillDir
+	streamOrigins   map[uint32]string
+
+	_clientConfig *flash.ClientConfig
+}
+
+func NewPgOutputDecoder() *PgOutputDecoder {
+	return &PgOutputDecoder{
+		relations:     make(map[uint32]*pglogrepl.RelationMessageV2),
+		typeMap:       pgtype.NewMap(),
+		streamQueues:  make(map[uint32]*streamQueue),
+		streamOrigins: make(map[uint32]string),
+	}
+}
+
+func (p *PgOutputDecoder) Init(clientConfig *flash.ClientConfig) error {
+	p._clientConfig = clientConfig
+
+	// Discard partially received transactions of a previous connection, relations are sent again by the server
+	p.relations = make(map[uint32]*pglogrepl.RelationMessageV2)
+	p.processMessages, p.preparing, p.origin, p.inStream, p.streamXid = false, "", "", false, 0
+	if err := p.Close(); err != nil {
+		return err
+	}
+	p.streamOrigins = make(map[uint32]string)
+	return nil
+}
+
+func (p *PgOutputDecoder) PluginName() string {
+	return "pgoutput"
+}
+
+func (p *PgOutputDecoder) PluginArgs(options *PluginOptions) []string {
+	p.memoryLimit, p.spillDir = options.StreamMemoryLimit, options.StreamSpillDir
+
+	// Version 3 adds two-phase commit (PostgreSQL 15), version 4 adds parallel streaming (PostgreSQL 16)
+	protoVersion := 2
+	if options.ServerVersion >= 16 {
+		protoVersion = 4
+	} else if options.ServerVersion >= 15 {
+		protoVersion = 3
+	}
+
+	args := []string{
+		fmt.Sprintf("proto_version '%d'", protoVersion),
+		"publication_names '" + strings.Join(options.Publications, ", ") + "'",
+		"messages 'true'",
+	}
+	if options.Streaming && protoVersion >= 4 {
+		args = append(args, "streaming 'parallel'")
+	} else if options.Streaming {
+		args = append(args, "streaming 'true'")
+	}
+	if options.TwoPhase && protoVersion >= 3 {
+		args = append(args, "two_phase 'on'")
+	}
+	if options.OnlyLocalOrigin && options.ServerVersion >= 16 {
+		args = append(args, "origin 'none'")
+	}
+	if options.Binary {
+		args = append(args, "binary 'true'")
+	}
+	return args
+}
+
+func (p *PgOutputDecoder) Decode(xld *pglogrepl.XLogData, handle ChangeHandler) (bool, error) {
+	if isTwoPhaseMessage(xld.WALData) {
+		twoPhaseMsg, err := parseTwoPhaseMessage(xld.WALData)
+		if err != nil {
+			return false, err
+		}
+		return p.processMessage(xld.WALData, twoPhaseMsg, false, handle)
+	}
+
+	logicalMsg, err := pglogrepl.ParseV2(xld.WALData, p.inStream)
+	if err != nil {
+		return false, err
+	}
+	return p.processMessage(xld.WALData, logicalMsg, false, handle)
+}
+
+// processMessage handles a parsed message, data is only kept when the message is queued for a streamed transaction
+func (p *PgOutputDecoder) processMessage(data []byte, logicalMsg pglogrepl.Message, fromQueue bool, handle ChangeHandler) (bool, error) {
+	switch typedLogicalMsg := logicalMsg.(type) {
+	case *pglogrepl.RelationMessageV2:
+		p.relations[typedLogicalMsg.RelationID] = typedLogicalMsg
+
+	case *pglogrepl.BeginMessage:
+		if p.lastCommitLSN > typedLogicalMsg.FinalLSN {
+			p._clientConfig.Logger.Trace().Msgf("Received stale message, ignoring. Last written LSN: %s Message LSN: %s", p.lastCommitLSN, typedLogicalMsg.FinalLSN)
+			p.processMessages = false
+			break
+		}
+		p.processMessages = true
+		p.origin = ""
+
+	case *pglogrepl.CommitMessage:
+		p.processMessages = false
+		p.origin = ""
+		p.lastCommitLSN = typedLogicalMsg.TransactionEndLSN
+		return true, nil
+
+	case *twoPhaseMessage:
+		return p.processTwoPhaseMessage(typedLogicalMsg, handle)
+
+	case *pglogrepl.InsertMessageV2:
+		// If we are in stream, append message to memory to run/delete after stream commit/abort
+		if p.inStream && !fromQueue {
+			if err := p.enqueue(p.streamXid, typedLogicalMsg.Xid, data); err != nil {
+				return false, err
+			}
+			break
+		}
+
+		if !p.processMessages && !fromQueue {
+			// Stale message
+			break
+		}
+
+		tableName, err := p.getRelationTableName(typedLogicalMsg.RelationID)
+		if err != nil {
+			return false, err
+		}
+		newData, err := p.parseTuple(typedLogicalMsg.RelationID, typedLogicalMsg.Tuple)
+		if err != nil {
+			return false, err
+		}
+		if err := handle(&Change{Operation: flash.OperationInsert, Table: tableName, New: newData, Prepared: p.preparing, Origin: p.origin}); err != nil {
+			return false, err
+		}
+
+	case *pglogrepl.UpdateMessageV2:
+		// If we are in stream, append message to memory to run/delete after stream commit/abort
+		if p.inStream && !fromQueue {
+			if err := p.enqueue(p.streamXid, typedLogicalMsg.Xid, data); err != nil {
+				return false, err
+			}
+			break
+		}
+
+		if !p.processMessages && !fromQueue {
+			// Stale message
+			break
+		}
+
+		tableName, err := p.getRelationTableName(typedLogicalMsg.RelationID)
+		if err != nil {
+			return false, err
+		}
+		newData, err := p.parseTuple(typedLogicalMsg.RelationID, typedLogicalMsg.NewTuple)
+		if err != nil {
+			return false, err
+		}
+		oldData, err := p.parseTuple(typedLogicalMsg.RelationID, typedLogicalMsg.OldTuple)
+		if err != nil {
+			return false, err
+		}
+		if err := handle(&Change{Operation: flash.OperationUpdate, Table: tableName, Old: oldData, New: newData, Prepared: p.preparing, Origin: p.origin}); err != nil {
+			return false, err
+		}
+
+	case *pglogrepl.DeleteMessageV2:
+		// If we are in stream, append message to memory to run/delete after stream commit/abort
+		if p.inStream && !fromQueue {
+			if err := p.enqueue(p.streamXid, typedLogicalMsg.Xid, data); err != nil {
+				return false, err
+			}
+			break
+		}
+
+		if !p.processMessages && !fromQueue {
+			// Stale message
+			break
+		}
+
+		tableName, err := p.getRelationTableName(typedLogicalMsg.RelationID)
+		if err != nil {
+			return false, err
+		}
+		oldData, err := p.parseTuple(typedLogicalMsg.RelationID, typedLogicalMsg.OldTuple)
+		if err != nil {
+			return false, err
+		}
+		if err := handle(&Change{Operation: flash.OperationDelete, Table: tableName, Old: oldData, Prepared: p.preparing, Origin: p.origin}); err != nil {
+			return false, err
+		}
+
+	case *pglogrepl.TruncateMessageV2:
+		// If we are in stream, append message to memory to run/delete after stream commit/abort
+		if p.inStream && !fromQueue {
+			if err := p.enqueue(p.streamXid, typedLogicalMsg.Xid, data); err != nil {
+				return false, err
+			}
+			break
+		}
+
+		if !p.processMessages && !fromQueue {
+			// Stale message
+			break
+		}
+
+		for _, relId := range typedLogicalMsg.RelationIDs {
+			tableName, err := p.getRelationTableName(relId)
+			if err != nil {
+				return false, err
+			}
+			if err := handle(&Change{Operation: flash.OperationTruncate, Table: tableName, Prepared: p.preparing, Origin: p.origin}); err != nil {
+				return false, err
+			}
+		}
+
+	case *pglogrepl.TypeMessageV2:
+		p._clientConfig.Logger.Trace().Msgf("typeMessage for xid %d\n", typedLogicalMsg.Xid)
+	case *pglogrepl.OriginMessage:
+		p._clientConfig.Logger.Trace().Msgf("originMessage for xid %s\n", typedLogicalMsg.Name)
+		// Sent after begin, or after the first stream start of a streamed transaction
+		if p.inStream {
+			p.streamOrigins[p.streamXid] = typedLogicalMsg.Name
+			break
+		}
+		p.origin = typedLogicalMsg.Name
+	case *pglogrepl.LogicalDecodingMessageV2:
+		p._clientConfig.Logger.Trace().Msgf("Logical decoding message: %q, %q, %d", typedLogicalMsg.Prefix, typedLogicalMsg.Content, typedLogicalMsg.Xid)
+
+		// Non-transactional messages are sent immediately, outside of transactions
+		if typedLogicalMsg.Transactional {
+			// If we are in stream, append message to memory to run/delete after stream commit/abort
+			if p.inStream && !fromQueue {
+				if err := p.enqueue(p.streamXid, typedLogicalMsg.Xid, data); err != nil {
+					return false, err
+				}
+				break
+			}
+
+			if !p.processMessages && !fromQueue {
+				// Stale message
+				break
+			}
+		}
+
+		message := &flash.MessageEvent{
+			Prefix:        typedLogicalMsg.Prefix,
+			Content:       typedLogicalMsg.Content,
+			Transactional: typedLogicalMsg.Transactional,
+			LSN:           uint64(typedLogicalMsg.LSN),
+		}
+		if typedLogicalMsg.Transactional {
+			message.Prepared = p.preparing
+		}
+		change := &Change{Operation: flash.OperationMessage, Message: message, Prepared: message.Prepared}
+		if typedLogicalMsg.Transactional {
+			change.Origin = p.origin
+		}
+		if err := handle(change); err != nil {
+			return false, err
+		}
+
+	case *pglogrepl.StreamStartMessageV2:
+		p.inStream = true
+		p.streamXid = typedLogicalMsg.Xid
+		p._clientConfig.Logger.Trace().Msgf("Stream start message: xid %d, first segment? %d", typedLogicalMsg.Xid, typedLogicalMsg.FirstSegment)
+
+	case *pglogrepl.StreamStopMessageV2:
+		p.inStream = false
+		p._clientConfig.Logger.Trace().Msgf("Stream stop message")
+	case *pglogrepl.StreamCommitMessageV2:
+		p._clientConfig.Logger.Trace().Msgf("Stream commit message: xid %d", typedLogicalMsg.Xid)
+
+		// Process all operations then remove queue
+		p.origin = p.streamOrigins[typedLogicalMsg.Xid]
+		if err := p.replayQueue(typedLogicalMsg.Xid, handle); err != nil {
+			return false, err
+		}
+		delete(p.streamOrigins, typedLogicalMsg.Xid)
+		p.origin = ""
+		p.lastCommitLSN = typedLogicalMsg.TransactionEndLSN
+		return true, nil // FLUSH position
+
+	case *pglogrepl.StreamAbortMessageV2:
+		p._clientConfig.Logger.Trace().Msgf("Stream abort message: xid %d, subxact %d", typedLogicalMsg.Xid, typedLogicalMsg.SubXid)
+		// A rolled back subtransaction only discards its own changes, the transaction goes on
+		if typedLogicalMsg.SubXid != typedLogicalMsg.Xid {
+			p.discardSubxact(typedLogicalMsg.Xid, typedLogicalMsg.SubXid)
+			break
+		}
+		if err := p.dropQueue(typedLogicalMsg.Xid); err != nil {
+			return false, err
+		}
+		delete(p.streamOrigins, typedLogicalMsg.Xid)
+	default:
+		p._clientConfig.Logger.Trace().Msgf("Unknown message type in pgoutput stream: %T", typedLogicalMsg)
+	}
+
+	return false, nil
+}
+
+func (p *PgOutputDecoder) processTwoPhaseMessage(msg *twoPhaseMessage, handle ChangeHandler) (bool, error) {
+	switch msg.Type() {
+	case messageTypeBeginPrepare:
+		if p.lastCommitLSN > msg.LSN {
+			p._clientConfig.Logger.Trace().Msgf("Received stale message, ignoring. Last written LSN: %s Message LSN: %s", p.lastCommitLSN, msg.LSN)
+			p.processMessages = false
+			break
+		}
+		p.processMessages = true
+		p.preparing = msg.Gid
+		p.origin = ""
+
+	case messageTypePrepare:
+		p.processMessages = false
+		p.preparing = ""
+		p.origin = ""
+		p.lastCommitLSN = msg.EndLSN
+		return true, nil
+
+	case messageTypeStreamPrepare:
+		p._clientConfig.Logger.Trace().Msgf("Stream prepare message: xid %d, gid %s", msg.Xid, msg.Gid)
+
+		// Same as stream commit, changes are delivered with the gid
+		p.preparing = msg.Gid
+		p.origin = p.streamOrigins[msg.Xid]
+		if err := p.replayQueue(msg.Xid, handle); err != nil {
+			return false, err
+		}
+		p.preparing = ""
+		p.origin = ""
+		delete(p.streamOrigins, msg.Xid)
+		p.lastCommitLSN = msg.EndLSN
+		return true, nil
+
+	case messageTypeCommitPrepared, messageTypeRollbackPrepared:
+		outcome := &TransactionOutcome{Gid: msg.Gid, Committed: msg.Type() == messageTypeCommitPrepared}
+		if err := handle(&Change{Outcome: outcome}); err != nil {
+			return false, err
+		}
+		p.lastCommitLSN = msg.EndLSN
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (p *PgOutputDecoder) parseTuple(relationID uint32, tuple *pglogrepl.TupleData) (*flash.EventData, error) {
+	rel, ok := p.relations[relationID]
+	if !ok {
+		return nil, fmt.Errorf("unknown relation ID %d", relationID)
+	}
+	if tuple == nil || len(tuple.Columns) == 0 {
+		return nil, nil
+	}
+	values := flash.EventData{}
+	for idx, col := range tuple.Columns {
+		colName := rel.Columns[idx].Name
+		switch col.DataType {
+		case 'n': // null
+			values[colName] = nil
+		case 'u': // unchanged toast
+			// This TOAST value was not changed. TOAST values are not stored in the tuple, and logical replication doesn't want to spend a disk read to fetch its value for you.
+			// Resolved by the driver according to DriverConfig.ToastStrategy
+			values[colName] = flash.Unchanged
+		case 't': //text
+			val, err := decodeTextColumnData(p._clientConfig.Types, col.Data, rel.Columns[idx].DataType)
+			if err != nil {
+				return nil, err
+			}
+			values[colName] = val
+		case 'b': // binary, only sent when requested
+			val, err := decodeBinaryColumnData(p.typeMap, p._clientConfig.Types, col.Data, rel.Columns[idx].DataType)
+			if err != nil {
+				return nil, err
+			}
+			values[colName] = val
+		}
+	}
+	return &values, nil
+}
+
+func (p *PgOutputDecoder) getRelationTableName(relationID uint32) (string, error) {
+	rel, ok := p.relations[relationID]
+	if !ok {
+		return "", fmt.Errorf("unknown relation ID %d", relationID)
+	}
+	return rel.Namespace + "." + rel.RelationName, nil
+}
@@ -0,0 +1,230 @@
+package wal_logical
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/jackc/pglogrepl"
+	"io"
+	"os"
+)
+
+// streamQueue buffers the raw messages of a streamed transaction until its commit.
+// Once the memory limit is exceeded, messages are moved to an append-only file, replayed in order on commit.
+// Each message keeps the xid of its subtransaction, to discard it when the subtransaction is rolled back.
+type streamQueue struct {
+	messages []queuedMessage
+	size     int64 // Size of messages kept in memory
+	count    int
+
+	subxactCounts  map[uint32]int      // key: subxact xid -> number of buffered messages
+	abortedSubxact map[uint32]struct{} // Subtransactions rolled back after being spilled, skipped on replay
+
+	file   *os.File // Nil until spilled
+	writer *bufio.Writer
+}
+
+type queuedMessage struct {
+	subXid uint32
+	data   []byte
+}
+
+// StreamQueueSizes returns the number of buffered messages of each in-progress streamed transaction, in memory or spilled
+func (p *PgOutputDecoder) StreamQueueSizes() map[uint32]int {
+	p.queuesMutex.Lock()
+	defer p.queuesMutex.Unlock()
+
+	sizes := make(map[uint32]int, len(p.streamQueues))
+	for xid, queue := range p.streamQueues {
+		sizes[xid] = queue.count
+	}
+	return sizes
+}
+
+// enqueue copies the message of the subtransaction at the end of the queue of the transaction,
+// spilling the queue to disk if the memory limit is exceeded
+func (p *PgOutputDecoder) enqueue(xid uint32, subXid uint32, data []byte) error {
+	p.queuesMutex.Lock()
+	defer p.queuesMutex.Unlock()
+
+	queue, exists := p.streamQueues[xid]
+	if !exists {
+		queue = &streamQueue{subxactCounts: make(map[uint32]int), abortedSubxact: make(map[uint32]struct{})}
+		p.streamQueues[xid] = queue
+	}
+	queue.count++
+	queue.subxactCounts[subXid]++
+
+	if queue.file != nil {
+		return writeSpilledMessage(queue.writer, subXid, data)
+	}
+
+	// The buffer of received data is reused by the connection
+	queue.messages = append(queue.messages, queuedMessage{subXid: subXid, data: append([]byte(nil), data...)})
+	queue.size += int64(len(data))
+	p.queuedBytes += int64(len(data))
+
+	if p.memoryLimit > 0 && p.queuedBytes > p.memoryLimit {
+		return p.spill(xid, queue)
+	}
+	return nil
+}
+
+// spill moves messages of the queue to a new file, following messages are appended to it
+func (p *PgOutputDecoder) spill(xid uint32, queue *streamQueue) error {
+	file, err := os.CreateTemp(p.spillDir, fmt.Sprintf("flash-stream-%d-*.spill", xid))
+	if err != nil {
+		return err
+	}
+	queue.file, queue.writer = file, bufio.NewWriter(file)
+	p._clientConfig.Logger.Debug().Uint32("xid", xid).Str("file", file.Name()).Int64("bytes", queue.size).Msg("stream queue spilled to disk")
+
+	for _, message := range queue.messages {
+		if err := writeSpilledMessage(queue.writer, message.subXid, message.data); err != nil {
+			return err
+		}
+	}
+	p.queuedBytes -= queue.size
+	queue.messages, queue.size = nil, 0
+	return nil
+}
+
+// replayQueue processes all messages of the transaction in order, then removes its queue
+func (p *PgOutputDecoder) replayQueue(xid uint32, handle ChangeHandler) error {
+	p.queuesMutex.Lock()
+	queue, exists := p.streamQueues[xid]
+	p.queuesMutex.Unlock()
+	if !exists {
+		return nil
+	}
+	p._clientConfig.Logger.Trace().Msgf("Processing %d entries from stream queue: xid %d", queue.count, xid)
+
+	replay := func(data []byte) error {
+		logicalMsg, err := pglogrepl.ParseV2(data, true)
+		if err != nil {
+			return err
+		}
+		// ⚠️ Do not use goroutine to handle in parallel, order is very important
+		// Cannot flush position here because return statement can cause loss
+		_, err = p.processMessage(data, logicalMsg, true, handle)
+		return err
+	}
+
+	if queue.file != nil {
+		if err := replaySpilledMessages(queue, replay); err != nil {
+			return err
+		}
+	}
+	for _, message := range queue.messages {
+		if err := replay(message.data); err != nil {
+			return err
+		}
+	}
+	return p.dropQueue(xid)
+}
+
+// discardSubxact removes messages of the rolled back subtransaction from the queue of the transaction.
+// Spilled messages cannot be removed from the append-only file, they are skipped on replay.
+func (p *PgOutputDecoder) discardSubxact(xid uint32, subXid uint32) {
+	p.queuesMutex.Lock()
+	defer p.queuesMutex.Unlock()
+
+	queue, exists := p.streamQueues[xid]
+	if !exists {
+		return
+	}
+	p._clientConfig.Logger.Trace().Msgf("Delete %d entries from stream queue: xid %d, subxact %d", queue.subxactCounts[subXid], xid, subXid)
+	queue.count -= queue.subxactCounts[subXid]
+	delete(queue.subxactCounts, subXid)
+	if queue.file != nil {
+		queue.abortedSubxact[subXid] = struct{}{}
+	}
+
+	kept := queue.messages[:0]
+	for _, message := range queue.messages {
+		if message.subXid == subXid {
+			queue.size -= int64(len(message.data))
+			p.queuedBytes -= int64(len(message.data))
+			continue
+		}
+		kept = append(kept, message)
+	}
+	queue.messages = kept
+}
+
+// dropQueue removes the queue of the transaction and its file
+func (p *PgOutputDecoder) dropQueue(xid uint32) error {
+	p.queuesMutex.Lock()
+	defer p.queuesMutex.Unlock()
+
+	queue, exists := p.streamQueues[xid]
+	if !exists {
+		return nil
+	}
+	p._clientConfig.Logger.Trace().Msgf("Delete %d entries from stream queue: xid %d", queue.count, xid)
+	delete(p.streamQueues, xid)
+	p.queuedBytes -= queue.size
+	return removeSpillFile(queue)
+}
+
+// Close removes all queues and their files, called by the driver on Close
+func (p *PgOutputDecoder) Close() error {
+	p.queuesMutex.Lock()
+	defer p.queuesMutex.Unlock()
+
+	var errs []error
+	for _, queue := range p.streamQueues {
+		errs = append(errs, removeSpillFile(queue))
+	}
+	p.streamQueues = make(map[uint32]*streamQueue)
+	p.queuedBytes = 0
+	return errors.Join(errs...)
+}
+
+// writeSpilledMessage appends the message prefixed by the xid of its subtransaction and its length
+func writeSpilledMessage(writer *bufio.Writer, subXid uint32, data []byte) error {
+	if err := binary.Write(writer, binary.BigEndian, [2]uint32{subXid, uint32(len(data))}); err != nil {
+		return err
+	}
+	_, err := writer.Write(data)
+	return err
+}
+
+func replaySpilledMessages(queue *streamQueue, replay func(data []byte) error) error {
+	if err := queue.writer.Flush(); err != nil {
+		return err
+	}
+	if _, err := queue.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(queue.file)
+	for {
+		var header [2]uint32 // subxact xid, length
+		if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		data := make([]byte, header[1])
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return err
+		}
+		if _, aborted := queue.abortedSubxact[header[0]]; aborted {
+			continue
+		}
+		if err := replay(data); err != nil {
+			return err
+		}
+	}
+}
+
+func removeSpillFile(queue *streamQueue) error {
+	if queue.file == nil {
+		return nil
+	}
+	_ = queue.file.Close()
+	return os.Remove(queue.file.Name())
+}
@@ -0,0 +1,139 @@
+package wal_logical
+
+import (
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/quix-labs/flash"
+	"github.com/rs/zerolog"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestPgOutputDecoderSpilledStream(t *testing.T) {
+	for _, committed := range []bool{true, false} {
+		name := "Abort"
+		if committed {
+			name = "Commit"
+		}
+		t.Run(name, func(t *testing.T) {
+			logger := zerolog.Nop()
+			decoder := NewPgOutputDecoder()
+			if err := decoder.Init(&flash.ClientConfig{Logger: &logger}); err != nil {
+				t.Fatal(err)
+			}
+			spillDir := t.TempDir()
+			decoder.PluginArgs(&PluginOptions{Streaming: true, StreamMemoryLimit: 20, StreamSpillDir: spillDir})
+
+			relation := testMessage{'R'}.uint32(7).uint32(1).string("public").string("posts").uint8('f').uint16(1).
+				uint8(1).string("id").uint32(pgtype.Int4OID).uint32(0xFFFFFFFF)
+			messages := []testMessage{testMessage{'S'}.uint32(7).uint8(1), relation}
+			for _, id := range []byte{'1', '2', '3'} {
+				messages = append(messages, testMessage{'I'}.uint32(7).uint32(1).uint8('N').uint16(1).uint8('t').uint32(1).uint8(id))
+			}
+			messages = append(messages, testMessage{'E'})
+
+			var changes []*Change
+			handle := func(change *Change) error {
+				changes = append(changes, change)
+				return nil
+			}
+			for _, message := range messages {
+				if _, err := decoder.Decode(&pglogrepl.XLogData{WALData: message}, handle); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if files, _ := os.ReadDir(spillDir); len(files) != 1 {
+				t.Fatalf("expected 1 spilled file, got %d", len(files))
+			}
+			if sizes := decoder.StreamQueueSizes(); sizes[7] != 3 {
+				t.Errorf("StreamQueueSizes() = %v, expected 3 messages for xid 7", sizes)
+			}
+
+			end := testMessage{'A'}.uint32(7).uint32(7)
+			if committed {
+				end = testMessage{'c'}.uint32(7).uint8(0).uint64(100).uint64(101).uint64(0)
+			}
+			if _, err := decoder.Decode(&pglogrepl.XLogData{WALData: end}, handle); err != nil {
+				t.Fatal(err)
+			}
+
+			if files, _ := os.ReadDir(spillDir); len(files) != 0 {
+				t.Errorf("expected spilled file to be removed, got %d files", len(files))
+			}
+			var ids []any
+			for _, change := range changes {
+				ids = append(ids, (*change.New)["id"])
+			}
+			var expected []any
+			if committed {
+				expected = []any{int64(1), int64(2), int64(3)}
+			}
+			if !reflect.DeepEqual(ids, expected) {
+				t.Errorf("decoded ids = %v, expected %v", ids, expected)
+			}
+		})
+	}
+}
+
+func TestPgOutputDecoderStreamSubxactAbort(t *testing.T) {
+	for _, memoryLimit := range []int64{0, 20} {
+		name := "InMemory"
+		if memoryLimit > 0 {
+			name = "Spilled"
+		}
+		t.Run(name, func(t *testing.T) {
+			logger := zerolog.Nop()
+			decoder := NewPgOutputDecoder()
+			if err := decoder.Init(&flash.ClientConfig{Logger: &logger}); err != nil {
+				t.Fatal(err)
+			}
+			decoder.PluginArgs(&PluginOptions{Streaming: true, StreamMemoryLimit: memoryLimit, StreamSpillDir: t.TempDir()})
+
+			relation := testMessage{'R'}.uint32(7).uint32(1).string("public").string("posts").uint8('f').uint16(1).
+				uint8(1).string("id").uint32(pgtype.Int4OID).uint32(0xFFFFFFFF)
+			insert := func(xid uint32, id byte) testMessage {
+				return testMessage{'I'}.uint32(xid).uint32(1).uint8('N').uint16(1).uint8('t').uint32(1).uint8(id)
+			}
+			// Subtransaction 8 of transaction 7 is rolled back, changes of subtransaction 9 are kept
+			messages := []testMessage{
+				testMessage{'S'}.uint32(7).uint8(1), relation,
+				insert(7, '1'), insert(8, '2'), insert(9, '3'), insert(8, '4'),
+				testMessage{'E'},
+				testMessage{'A'}.uint32(7).uint32(8),
+				testMessage{'S'}.uint32(7).uint8(0), insert(7, '5'), testMessage{'E'},
+			}
+
+			var changes []*Change
+			handle := func(change *Change) error {
+				changes = append(changes, change)
+				return nil
+			}
+			for _, message := range messages {
+				if _, err := decoder.Decode(&pglogrepl.XLogData{WALData: message}, handle); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if sizes := decoder.StreamQueueSizes(); sizes[7] != 3 {
+				t.Errorf("StreamQueueSizes() = %v, expected 3 messages for xid 7", sizes)
+			}
+
+			commit := testMessage{'c'}.uint32(7).uint8(0).uint64(100).uint64(101).uint64(0)
+			if _, err := decoder.Decode(&pglogrepl.XLogData{WALData: commit}, handle); err != nil {
+				t.Fatal(err)
+			}
+
+			var ids []any
+			for _, change := range changes {
+				ids = append(ids, (*change.New)["id"])
+			}
+			if expected := []any{int64(1), int64(3), int64(5)}; !reflect.DeepEqual(ids, expected) {
+				t.Errorf("decoded ids = %v, expected %v", ids, expected)
+			}
+			if decoder.queuedBytes != 0 {
+				t.Errorf("queuedBytes = %d after commit, expected 0", decoder.queuedBytes)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package wal_logical
+
+import (
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/quix-labs/flash"
+	"github.com/rs/zerolog"
+	"testing"
+)
+
+func TestPgOutputDecoderOrigin(t *testing.T) {
+	logger := zerolog.Nop()
+	decoder := NewPgOutputDecoder()
+	if err := decoder.Init(&flash.ClientConfig{Logger: &logger}); err != nil {
+		t.Fatal(err)
+	}
+
+	relation := testMessage{'R'}.uint32(1).string("public").string("posts").uint8('f').uint16(1).
+		uint8(1).string("id").uint32(pgtype.Int4OID).uint32(0xFFFFFFFF)
+	begin := testMessage{'B'}.uint64(100).uint64(0).uint32(1)
+	origin := testMessage{'O'}.uint64(100).string("sync_writer")
+	insert := testMessage{'I'}.uint32(1).uint8('N').uint16(1).uint8('t').uint32(1).uint8('1')
+	commit := testMessage{'C'}.uint8(0).uint64(100).uint64(101).uint64(0)
+	secondBegin := testMessage{'B'}.uint64(200).uint64(0).uint32(2)
+	secondCommit := testMessage{'C'}.uint8(0).uint64(200).uint64(201).uint64(0)
+
+	var changes []*Change
+	handle := func(change *Change) error {
+		changes = append(changes, change)
+		return nil
+	}
+	for _, data := range []testMessage{relation, begin, origin, insert, commit, secondBegin, insert, secondCommit} {
+		if _, err := decoder.Decode(&pglogrepl.XLogData{WALData: data}, handle); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(changes) != 2 {
+		t.Fatalf("expected 2 changes, got %d", len(changes))
+	}
+	if changes[0].Origin != "sync_writer" {
+		t.Errorf("expected first change from origin sync_writer, got %q", changes[0].Origin)
+	}
+	if changes[1].Origin != "" {
+		t.Errorf("expected second change without origin, got %q", changes[1].Origin)
+	}
+}
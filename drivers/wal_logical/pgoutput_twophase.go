@@ -0,0 +1,76 @@
+package wal_logical
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/jackc/pglogrepl"
+)
+
+// Two-phase commit messages of protocol version 3+, not supported by pglogrepl.ParseV2
+const (
+	messageTypeBeginPrepare     = pglogrepl.MessageType('b')
+	messageTypePrepare          = pglogrepl.MessageType('P')
+	messageTypeCommitPrepared   = pglogrepl.MessageType('K')
+	messageTypeRollbackPrepared = pglogrepl.MessageType('r')
+	messageTypeStreamPrepare    = pglogrepl.MessageType('p')
+)
+
+// twoPhaseMessage contains the fields shared by all two-phase messages, timestamps are ignored
+type twoPhaseMessage struct {
+	messageType pglogrepl.MessageType
+
+	LSN    pglogrepl.LSN // Prepare LSN, commit LSN or prepared transaction end LSN for rollback
+	EndLSN pglogrepl.LSN // End of the message transaction, used to flush position
+	Xid    uint32
+	Gid    string
+}
+
+func (m *twoPhaseMessage) Type() pglogrepl.MessageType {
+	return m.messageType
+}
+
+func isTwoPhaseMessage(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	switch pglogrepl.MessageType(data[0]) {
+	case messageTypeBeginPrepare, messageTypePrepare, messageTypeCommitPrepared, messageTypeRollbackPrepared, messageTypeStreamPrepare:
+		return true
+	}
+	return false
+}
+
+// parseTwoPhaseMessage decodes:
+//
+//	BeginPrepare:     LSN, EndLSN, timestamp, xid, gid
+//	Prepare:          flags, LSN, EndLSN, timestamp, xid, gid (same for CommitPrepared and StreamPrepare)
+//	RollbackPrepared: flags, LSN, EndLSN, timestamp, timestamp, xid, gid
+func parseTwoPhaseMessage(data []byte) (*twoPhaseMessage, error) {
+	msg := &twoPhaseMessage{messageType: pglogrepl.MessageType(data[0])}
+
+	offset, expectedLen := 0, 28
+	switch msg.messageType {
+	case messageTypePrepare, messageTypeCommitPrepared, messageTypeStreamPrepare:
+		offset = 1 // flags
+	case messageTypeRollbackPrepared:
+		offset, expectedLen = 1, 36 // flags, second timestamp
+	}
+	if len(data) < 1+offset+expectedLen+1 {
+		return nil, fmt.Errorf("two-phase message %q must have at least %d bytes, got %d", msg.messageType, 1+offset+expectedLen+1, len(data))
+	}
+	src := data[1+offset:]
+
+	msg.LSN = pglogrepl.LSN(binary.BigEndian.Uint64(src[0:]))
+	msg.EndLSN = pglogrepl.LSN(binary.BigEndian.Uint64(src[8:]))
+	msg.Xid = binary.BigEndian.Uint32(src[expectedLen-4:])
+
+	gid := src[expectedLen:]
+	end := bytes.IndexByte(gid, 0)
+	if end == -1 {
+		return nil, fmt.Errorf("two-phase message %q has an unterminated gid", msg.messageType)
+	}
+	msg.Gid = string(gid[:end])
+
+	return msg, nil
+}
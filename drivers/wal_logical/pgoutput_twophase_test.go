@@ -0,0 +1,106 @@
+package wal_logical
+
+import (
+	"encoding/binary"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/quix-labs/flash"
+	"github.com/rs/zerolog"
+	"reflect"
+	"testing"
+)
+
+type testMessage []byte
+
+func (m testMessage) uint8(v uint8) testMessage   { return append(m, v) }
+func (m testMessage) uint16(v uint16) testMessage { return binary.BigEndian.AppendUint16(m, v) }
+func (m testMessage) uint32(v uint32) testMessage { return binary.BigEndian.AppendUint32(m, v) }
+func (m testMessage) uint64(v uint64) testMessage { return binary.BigEndian.AppendUint64(m, v) }
+func (m testMessage) string(v string) testMessage { return append(append(m, v...), 0) }
+
+func twoPhaseTestMessage(messageType pglogrepl.MessageType, lsn uint64, gid string) testMessage {
+	msg := testMessage{byte(messageType)}
+	if messageType != messageTypeBeginPrepare {
+		msg = msg.uint8(0) // flags
+	}
+	msg = msg.uint64(lsn).uint64(lsn + 1).uint64(0) // LSN, EndLSN, timestamp
+	if messageType == messageTypeRollbackPrepared {
+		msg = msg.uint64(0)
+	}
+	return msg.uint32(42).string(gid)
+}
+
+func TestPgOutputDecoderTwoPhase(t *testing.T) {
+	logger := zerolog.Nop()
+	decoder := NewPgOutputDecoder()
+	if err := decoder.Init(&flash.ClientConfig{Logger: &logger}); err != nil {
+		t.Fatal(err)
+	}
+
+	relation := testMessage{'R'}.uint32(1).string("public").string("posts").uint8('f').uint16(1).
+		uint8(1).string("id").uint32(pgtype.Int4OID).uint32(0xFFFFFFFF)
+	insert := testMessage{'I'}.uint32(1).uint8('N').uint16(1).uint8('t').uint32(1).uint8('1')
+
+	messages := []struct {
+		name     string
+		data     testMessage
+		flush    bool
+		expected *Change
+	}{
+		{"Relation", relation, false, nil},
+		{"BeginPrepare", twoPhaseTestMessage(messageTypeBeginPrepare, 100, "tx1"), false, nil},
+		{"Insert", insert, false, &Change{Operation: flash.OperationInsert, Table: "public.posts", New: &flash.EventData{"id": int64(1)}, Prepared: "tx1"}},
+		{"Prepare", twoPhaseTestMessage(messageTypePrepare, 100, "tx1"), true, nil},
+		{"CommitPrepared", twoPhaseTestMessage(messageTypeCommitPrepared, 200, "tx1"), true, &Change{Outcome: &TransactionOutcome{Gid: "tx1", Committed: true}}},
+		{"RollbackPrepared", twoPhaseTestMessage(messageTypeRollbackPrepared, 300, "tx2"), true, &Change{Outcome: &TransactionOutcome{Gid: "tx2", Committed: false}}},
+	}
+
+	for _, test := range messages {
+		t.Run(test.name, func(t *testing.T) {
+			var changes []*Change
+			flush, err := decoder.Decode(&pglogrepl.XLogData{WALData: test.data}, func(change *Change) error {
+				changes = append(changes, change)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Decode() returned an error: %v", err)
+			}
+			if flush != test.flush {
+				t.Errorf("Decode() flush = %v, expected %v", flush, test.flush)
+			}
+
+			if test.expected == nil {
+				if len(changes) != 0 {
+					t.Errorf("Decode() expected no changes, got %d", len(changes))
+				}
+				return
+			}
+			if len(changes) != 1 {
+				t.Fatalf("Decode() expected 1 change, got %d", len(changes))
+			}
+			if !reflect.DeepEqual(changes[0], test.expected) {
+				t.Errorf("Decode() = %+v, expected %+v", changes[0], test.expected)
+			}
+		})
+	}
+}
+
+func TestPgOutputDecoderPluginArgs(t *testing.T) {
+	decoder := NewPgOutputDecoder()
+	tests := []struct {
+		name     string
+		options  *PluginOptions
+		expected []string
+	}{
+		{"PostgreSQL 14", &PluginOptions{Publications: []string{"pub"}, TwoPhase: true, ServerVersion: 14}, []string{"proto_version '2'", "publication_names 'pub'", "messages 'true'"}},
+		{"PostgreSQL 15", &PluginOptions{Publications: []string{"pub"}, TwoPhase: true, ServerVersion: 15}, []string{"proto_version '3'", "publication_names 'pub'", "messages 'true'", "two_phase 'on'"}},
+		{"PostgreSQL 16", &PluginOptions{Publications: []string{"pub"}, Streaming: true, ServerVersion: 16}, []string{"proto_version '4'", "publication_names 'pub'", "messages 'true'", "streaming 'parallel'"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if args := decoder.PluginArgs(test.options); !reflect.DeepEqual(args, test.expected) {
+				t.Errorf("PluginArgs() = %v, expected %v", args, test.expected)
+			}
+		})
+	}
+}
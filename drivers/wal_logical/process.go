@@ -1,110 +1,93 @@
 package wal_logical
 
 import (
-	"fmt"
 	"github.com/jackc/pglogrepl"
-	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/quix-labs/flash"
 	"reflect"
+	"time"
 )
 
 func (d *Driver) processXld(xld *pglogrepl.XLogData) (bool, error) {
-	logicalMsg, err := pglogrepl.ParseV2(xld.WALData, d.replicationState.inStream)
-	if err != nil {
-		return false, err
-	}
-
+	d.replicationState.Lock()
 	d.replicationState.lastReceivedLSN = xld.ServerWALEnd
-	return d.processMessage(logicalMsg, false)
-}
+	d.replicationState.serverWALEnd = max(d.replicationState.serverWALEnd, xld.ServerWALEnd)
+	d.replicationState.lastMessageAt = time.Now()
+	d.replicationState.Unlock()
 
-func (d *Driver) processMessage(logicalMsg pglogrepl.Message, fromQueue bool) (bool, error) {
-	switch typedLogicalMsg := logicalMsg.(type) {
-	case *pglogrepl.RelationMessageV2:
-		d.replicationState.relations[typedLogicalMsg.RelationID] = typedLogicalMsg
+	return d.Config.OutputDecoder.Decode(xld, d.processChange)
+}
 
-	case *pglogrepl.BeginMessage:
-		if d.replicationState.lastWrittenLSN > typedLogicalMsg.FinalLSN {
-			d._clientConfig.Logger.Trace().Msgf("Received stale message, ignoring. Last written LSN: %s Message LSN: %s", d.replicationState.lastWrittenLSN, typedLogicalMsg.FinalLSN)
-			d.replicationState.processMessages = false
-			break
+func (d *Driver) processChange(change *Change) error {
+	if change.Outcome != nil {
+		eventType := flash.LifecycleTransactionRolledBack
+		if change.Outcome.Committed {
+			eventType = flash.LifecycleTransactionCommitted
 		}
+		d._clientConfig.EmitLifecycleEvent(&flash.LifecycleEvent{Type: eventType, TransactionId: change.Outcome.Gid})
+		return nil
+	}
 
-		d.replicationState.processMessages = true
-		d.replicationState.currentTransactionLSN = typedLogicalMsg.FinalLSN
+	// Already filtered by the server on PostgreSQL 16+
+	if d.Config.OnlyLocalChanges && change.Origin != "" {
+		return nil
+	}
 
-	case *pglogrepl.CommitMessage:
-		d.replicationState.processMessages = false
-		return true, nil
+	if change.Operation == flash.OperationMessage {
+		return d.processMessage(change)
+	}
 
-	case *pglogrepl.InsertMessageV2:
-		// If we are in replicationState, append XLogData to memory to run/delete after stream commit/abort
-		if d.replicationState.inStream && !fromQueue {
-			d.replicationState.streamQueues[typedLogicalMsg.Xid] = append(d.replicationState.streamQueues[typedLogicalMsg.Xid], &logicalMsg)
-			break
-		}
+	change.Table = d.resolvePartition(change.Table)
 
-		if !d.replicationState.processMessages && !fromQueue {
-			// Stale message
-			break
+	// All operations of published tables are received, keep listeners of this operation only
+	// Copy to avoid holding the lock while sending events
+	d.activeListenersMutex.RLock()
+	listeners := make(map[string]*flash.ListenerConfig)
+	for listenerUid, listener := range d.activeListeners[change.Table] {
+		if listener.operations.IncludeOne(change.Operation) && listener.config.AcceptsOrigin(change.Origin) {
+			listeners[listenerUid] = listener.config
 		}
+	}
+	d.activeListenersMutex.RUnlock()
 
-		tableName, _ := d.getRelationTableName(typedLogicalMsg.RelationID)
-		listeners, exists := d.activeListeners[tableName]
-		if !exists {
-			break
-		}
+	if len(listeners) == 0 {
+		return nil
+	}
 
-		newData, err := d.parseTuple(typedLogicalMsg.RelationID, typedLogicalMsg.Tuple)
-		if err != nil {
-			return false, err
-		}
+	if err := d.resolveUnchanged(change); err != nil {
+		return err
+	}
+
+	switch change.Operation {
+	case flash.OperationInsert:
 		for listenerUid, listenerConfig := range listeners {
 
-			if !d.checkConditions(newData, listenerConfig.Conditions) {
+			if !listenerConfig.IncludesRow(change.New) || !d.checkConditions(change.New, listenerConfig.Conditions) {
 				continue
 			}
 
-			reducedNewData := d.ExtractFields(newData, listenerConfig.Fields)
+			reducedNewData := d.ExtractFields(change.New, listenerConfig.Fields)
 			*d.eventsChan <- &flash.DatabaseEvent{
 				ListenerUid: listenerUid,
-				Event:       &flash.InsertEvent{New: reducedNewData},
+				Event:       &flash.InsertEvent{New: reducedNewData, Prepared: change.Prepared},
 			}
 		}
 
-	case *pglogrepl.UpdateMessageV2:
-		// If we are in replicationState, append XLogData to memory to run/delete after stream commit/abort
-		if d.replicationState.inStream && !fromQueue {
-			d.replicationState.streamQueues[typedLogicalMsg.Xid] = append(d.replicationState.streamQueues[typedLogicalMsg.Xid], &logicalMsg)
-			break
-		}
-
-		if !d.replicationState.processMessages && !fromQueue {
-			// Stale message
-			break
-		}
-
-		tableName, _ := d.getRelationTableName(typedLogicalMsg.RelationID)
-		listeners, exists := d.activeListeners[tableName]
-		if !exists {
-			break
-		}
-
-		newData, err := d.parseTuple(typedLogicalMsg.RelationID, typedLogicalMsg.NewTuple)
-		if err != nil {
-			return false, err
-		}
-
-		oldData, err := d.parseTuple(typedLogicalMsg.RelationID, typedLogicalMsg.OldTuple)
-		if err != nil {
-			return false, err
-		}
+	case flash.OperationUpdate:
 		for listenerUid, listenerConfig := range listeners {
 
-			if len(listenerConfig.Conditions) > 0 {
+			if !listenerConfig.IncludesRow(change.New) {
+				continue
+			}
+
+			if len(listenerConfig.Conditions) > 0 && !d.hasConditionColumns(change.Old, listenerConfig.Conditions) {
+				// Old row only contains identity columns (see ReplicaIdentityKeep), its previous state is unknown
+				if !d.checkConditions(change.New, listenerConfig.Conditions) {
+					continue
+				}
+			} else if len(listenerConfig.Conditions) > 0 {
 				// HANDLING CONDITIONS - e.g: SOFT DELETE
-				oldRespectConditions := d.checkConditions(oldData, listenerConfig.Conditions)
-				newRespectConditions := d.checkConditions(newData, listenerConfig.Conditions)
+				oldRespectConditions := d.checkConditions(change.Old, listenerConfig.Conditions)
+				newRespectConditions := d.checkConditions(change.New, listenerConfig.Conditions)
 				if !oldRespectConditions && !newRespectConditions {
 					continue
 				}
@@ -113,7 +96,7 @@ func (d *Driver) processMessage(logicalMsg pglogrepl.Message, fromQueue bool) (b
 					// IN THIS CASE, THIS IS AN INSERT
 					*d.eventsChan <- &flash.DatabaseEvent{
 						ListenerUid: listenerUid,
-						Event:       &flash.InsertEvent{New: d.ExtractFields(newData, listenerConfig.Fields)},
+						Event:       &flash.InsertEvent{New: d.ExtractFields(change.New, listenerConfig.Fields), Prepared: change.Prepared},
 					}
 					continue
 				}
@@ -122,166 +105,88 @@ func (d *Driver) processMessage(logicalMsg pglogrepl.Message, fromQueue bool) (b
 					// IN THIS CASE, THIS IS A DELETE
 					*d.eventsChan <- &flash.DatabaseEvent{
 						ListenerUid: listenerUid,
-						Event:       &flash.DeleteEvent{Old: d.ExtractFields(oldData, listenerConfig.Fields)},
+						Event:       &flash.DeleteEvent{Old: d.ExtractFields(change.Old, listenerConfig.Fields), Prepared: change.Prepared},
 					}
 					continue
 				}
 			}
 
-			reducedOldData := d.ExtractFields(oldData, listenerConfig.Fields)
-			reducedNewData := d.ExtractFields(newData, listenerConfig.Fields)
-			if d.CheckEquals(reducedNewData, reducedOldData) {
+			reducedOldData := d.ExtractFields(change.Old, listenerConfig.Fields)
+			reducedNewData := d.ExtractFields(change.New, listenerConfig.Fields)
+			// Unchanged values are equal to their old value, if known.
+			// Fields absent from the old row are unknown, the update is sent.
+			if d.CheckEquals(carryOverUnchanged(reducedOldData, reducedNewData), reducedOldData) {
 				continue //Ignore operation if update is not in listener fields
 			}
 			*d.eventsChan <- &flash.DatabaseEvent{
 				ListenerUid: listenerUid,
-				Event:       &flash.UpdateEvent{Old: reducedOldData, New: reducedNewData},
+				Event:       &flash.UpdateEvent{Old: reducedOldData, New: reducedNewData, Prepared: change.Prepared},
 			}
 		}
 
-	case *pglogrepl.DeleteMessageV2:
-		// If we are in replicationState, append XLogData to memory to run/delete after stream commit/abort
-		if d.replicationState.inStream && !fromQueue {
-			d.replicationState.streamQueues[typedLogicalMsg.Xid] = append(d.replicationState.streamQueues[typedLogicalMsg.Xid], &logicalMsg)
-			break
-		}
-
-		if !d.replicationState.processMessages && !fromQueue {
-			// Stale message
-			break
-		}
-
-		tableName, _ := d.getRelationTableName(typedLogicalMsg.RelationID)
-		listeners, exists := d.activeListeners[tableName]
-		if !exists {
-			break
-		}
-		oldData, err := d.parseTuple(typedLogicalMsg.RelationID, typedLogicalMsg.OldTuple)
-		if err != nil {
-			return false, err
-		}
+	case flash.OperationDelete:
 		for listenerUid, listenerConfig := range listeners {
 
-			if !d.checkConditions(oldData, listenerConfig.Conditions) {
+			if !listenerConfig.IncludesRow(change.Old) {
+				continue
+			}
+			// Conditions cannot be checked when the old row only contains identity columns, see ReplicaIdentityKeep
+			if d.hasConditionColumns(change.Old, listenerConfig.Conditions) && !d.checkConditions(change.Old, listenerConfig.Conditions) {
 				continue
 			}
 
-			reducedOldData := d.ExtractFields(oldData, listenerConfig.Fields)
+			reducedOldData := d.ExtractFields(change.Old, listenerConfig.Fields)
 			*d.eventsChan <- &flash.DatabaseEvent{
 				ListenerUid: listenerUid,
-				Event:       &flash.DeleteEvent{Old: reducedOldData},
+				Event:       &flash.DeleteEvent{Old: reducedOldData, Prepared: change.Prepared},
 			}
 		}
 
-	case *pglogrepl.TruncateMessageV2:
-		// If we are in replicationState, append XLogData to memory to run/delete after stream commit/abort
-		if d.replicationState.inStream && !fromQueue {
-			d.replicationState.streamQueues[typedLogicalMsg.Xid] = append(d.replicationState.streamQueues[typedLogicalMsg.Xid], &logicalMsg)
-			break
-		}
-
-		if !d.replicationState.processMessages && !fromQueue {
-			// Stale message
-			break
-		}
-
-		for _, relId := range typedLogicalMsg.RelationIDs {
-			tableName, _ := d.getRelationTableName(relId)
-			listeners, exists := d.activeListeners[tableName]
-			if !exists {
-				break
-			}
-			for listenerUid, _ := range listeners {
-				*d.eventsChan <- &flash.DatabaseEvent{
-					ListenerUid: listenerUid,
-					Event:       &flash.TruncateEvent{},
-				}
+	case flash.OperationTruncate:
+		for listenerUid, _ := range listeners {
+			*d.eventsChan <- &flash.DatabaseEvent{
+				ListenerUid: listenerUid,
+				Event:       &flash.TruncateEvent{Prepared: change.Prepared},
 			}
 		}
-	case *pglogrepl.TypeMessageV2:
-		d._clientConfig.Logger.Trace().Msgf("typeMessage for xid %d\n", typedLogicalMsg.Xid)
-	case *pglogrepl.OriginMessage:
-		d._clientConfig.Logger.Trace().Msgf("originMessage for xid %s\n", typedLogicalMsg.Name)
-	case *pglogrepl.LogicalDecodingMessageV2:
-		d._clientConfig.Logger.Trace().Msgf("Logical decoding message: %q, %q, %d", typedLogicalMsg.Prefix, typedLogicalMsg.Content, typedLogicalMsg.Xid)
+	}
 
-	case *pglogrepl.StreamStartMessageV2:
-		d.replicationState.inStream = true
-		// Create dynamic queue if not exists
-		if _, exists := d.replicationState.streamQueues[typedLogicalMsg.Xid]; !exists {
-			d.replicationState.streamQueues[typedLogicalMsg.Xid] = []*pglogrepl.Message{} // Dynamic size
-		}
-		d._clientConfig.Logger.Trace().Msgf("Stream start message: xid %d, first segment? %d", typedLogicalMsg.Xid, typedLogicalMsg.FirstSegment)
+	return nil
+}
 
-	case *pglogrepl.StreamStopMessageV2:
-		d.replicationState.inStream = false
-		d._clientConfig.Logger.Trace().Msgf("Stream stop message")
-	case *pglogrepl.StreamCommitMessageV2:
-		d._clientConfig.Logger.Trace().Msgf("Stream commit message: xid %d", typedLogicalMsg.Xid)
+func (d *Driver) processMessage(change *Change) error {
+	message := change.Message
 
-		// Process all operations then remove queue
-		queueLen := len(d.replicationState.streamQueues[typedLogicalMsg.Xid])
-		if queueLen > 0 {
-			d._clientConfig.Logger.Trace().Msgf("Processing %d entries from stream queue: xid %d", queueLen, typedLogicalMsg.Xid)
-			// ⚠️ Do not use goroutine to handle in parallel, order is very important
-			for _, message := range d.replicationState.streamQueues[typedLogicalMsg.Xid] {
-				// Cannot flush position here because return statement can cause loss
-				_, err := d.processMessage(*message, true)
-				if err != nil {
-					return false, err
-				}
-			}
+	d.activeListenersMutex.RLock()
+	var listenerUids []string
+	for listenerUid, listenerConfig := range d.messageListeners {
+		if listenerConfig.MessagePrefix == message.Prefix && listenerConfig.AcceptsOrigin(change.Origin) {
+			listenerUids = append(listenerUids, listenerUid)
 		}
-		d._clientConfig.Logger.Trace().Msgf("Delete %d entries from stream queue: xid %d", queueLen, typedLogicalMsg.Xid)
-		delete(d.replicationState.streamQueues, typedLogicalMsg.Xid)
-		return true, nil // FLUSH position
-
-	case *pglogrepl.StreamAbortMessageV2:
-		d._clientConfig.Logger.Trace().Msgf("Stream abort message: xid %d", typedLogicalMsg.Xid)
-		d._clientConfig.Logger.Trace().Msgf("Delete %d entries from stream queue: xid %d", len(d.replicationState.streamQueues[typedLogicalMsg.Xid]), typedLogicalMsg.Xid)
-		delete(d.replicationState.streamQueues, typedLogicalMsg.Xid)
-	default:
-		d._clientConfig.Logger.Trace().Msgf("Unknown message type in pgoutput stream: %T", typedLogicalMsg)
 	}
+	d.activeListenersMutex.RUnlock()
 
-	return false, nil
-}
-
-func (d *Driver) parseTuple(relationID uint32, tuple *pglogrepl.TupleData) (*flash.EventData, error) {
-	rel, ok := d.replicationState.relations[relationID]
-	if !ok {
-		return nil, fmt.Errorf("unknown relation ID %d", relationID)
-	}
-	if len(tuple.Columns) == 0 {
-		return nil, nil
-	}
-	values := flash.EventData{} //Initialize as nil and create only on first col
-	for idx, col := range tuple.Columns {
-		colName := rel.Columns[idx].Name
-		switch col.DataType {
-		case 'n': // null
-			values[colName] = nil
-		case 'u': // unchanged toast
-			// This TOAST value was not changed. TOAST values are not stored in the tuple, and logical replication doesn't want to spend a disk read to fetch its value for you.
-		case 't': //text
-			val, err := d.decodeTextColumnData(col.Data, rel.Columns[idx].DataType)
-			if err != nil {
-				return nil, err
-			}
-			values[colName] = val
+	for _, listenerUid := range listenerUids {
+		*d.eventsChan <- &flash.DatabaseEvent{
+			ListenerUid: listenerUid,
+			Event:       message,
 		}
 	}
-	return &values, nil
+	return nil
 }
 
+// ExtractFields keeps listened fields of the row. Columns absent from the row are left out instead of being nil,
+// e.g: old rows only containing identity columns, see ReplicaIdentityKeep.
 func (d *Driver) ExtractFields(data *flash.EventData, fields []string) *flash.EventData {
-	if len(fields) == 0 { // Empty same as SELECT *
+	if len(fields) == 0 || data == nil { // Empty same as SELECT *
 		return data
 	}
 
 	reducedData := flash.EventData{}
 	for _, field := range fields {
-		reducedData[field] = (*data)[field]
+		if value, exists := (*data)[field]; exists {
+			reducedData[field] = value
+		}
 	}
 	return &reducedData
 }
@@ -289,25 +194,24 @@ func (d *Driver) CheckEquals(source any, target any) bool {
 	return reflect.DeepEqual(source, target)
 }
 
-func (d *Driver) getRelationTableName(relationID uint32) (string, error) {
-	rel, ok := d.replicationState.relations[relationID]
-	if !ok {
-		return "", fmt.Errorf("unknown relation ID %d", relationID)
+func (d *Driver) hasConditionColumns(data *flash.EventData, conditions []*flash.ListenerCondition) bool {
+	if data == nil {
+		return false
 	}
-	return rel.Namespace + "." + rel.RelationName, nil
-}
-
-func (d *Driver) decodeTextColumnData(data []byte, dataType uint32) (interface{}, error) {
-	if dt, ok := d.replicationState.typeMap.TypeForOID(dataType); ok {
-		return dt.Codec.DecodeValue(d.replicationState.typeMap, dataType, pgtype.TextFormatCode, data)
+	for _, condition := range conditions {
+		if _, exists := (*data)[condition.Column]; !exists {
+			return false
+		}
 	}
-	return string(data), nil
+	return true
 }
 
 func (d *Driver) checkConditions(data *flash.EventData, conditions []*flash.ListenerCondition) bool {
 	for _, condition := range conditions {
-		value := (*data)[condition.Column]
-		if value != condition.Value {
+		if data == nil {
+			return false
+		}
+		if !flash.ValuesEqual((*data)[condition.Column], condition.Value) {
 			return false
 		}
 	}
@@ -0,0 +1,103 @@
+package wal_logical
+
+import (
+	"github.com/quix-labs/flash"
+	"testing"
+)
+
+func TestProcessChangeIdentityOnlyOldRow(t *testing.T) {
+	driver := NewDriver(&DriverConfig{ReplicaIdentityPolicy: ReplicaIdentityKeep})
+	eventsChan := make(flash.DatabaseEventsChan, 10)
+	driver.eventsChan = &eventsChan
+	driver.activeListeners["public.posts"] = map[string]*activeListener{
+		"listener1": {
+			config:     &flash.ListenerConfig{Table: "posts", Conditions: []*flash.ListenerCondition{{Column: "active", Value: true}}},
+			operations: flash.OperationAll,
+		},
+	}
+
+	tests := []struct {
+		name      string
+		change    *Change
+		operation flash.Operation // Zero when no event is expected
+	}{
+		{
+			"Update matching conditions",
+			&Change{Operation: flash.OperationUpdate, Table: "public.posts", Old: &flash.EventData{"id": 1}, New: &flash.EventData{"id": 1, "active": true}},
+			flash.OperationUpdate,
+		},
+		{
+			"Update without old row",
+			&Change{Operation: flash.OperationUpdate, Table: "public.posts", New: &flash.EventData{"id": 1, "active": true}},
+			flash.OperationUpdate,
+		},
+		{
+			"Update not matching conditions",
+			&Change{Operation: flash.OperationUpdate, Table: "public.posts", Old: &flash.EventData{"id": 1}, New: &flash.EventData{"id": 1, "active": false}},
+			0,
+		},
+		{
+			"Delete",
+			&Change{Operation: flash.OperationDelete, Table: "public.posts", Old: &flash.EventData{"id": 1}},
+			flash.OperationDelete,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := driver.processChange(test.change); err != nil {
+				t.Fatal(err)
+			}
+			if test.operation == 0 {
+				if len(eventsChan) != 0 {
+					t.Errorf("expected no event, got %+v", (<-eventsChan).Event)
+				}
+				return
+			}
+			if len(eventsChan) != 1 {
+				t.Fatalf("expected 1 event, got %d", len(eventsChan))
+			}
+			if event := (<-eventsChan).Event; event.GetOperation() != test.operation {
+				t.Errorf("expected %s event, got %s", test.operation, event.GetOperation())
+			}
+		})
+	}
+}
+
+func TestProcessChangeIdentityOnlyOldRowFields(t *testing.T) {
+	driver := NewDriver(&DriverConfig{ReplicaIdentityPolicy: ReplicaIdentityKeep})
+	eventsChan := make(flash.DatabaseEventsChan, 10)
+	driver.eventsChan = &eventsChan
+	driver.activeListeners["public.posts"] = map[string]*activeListener{
+		"listener1": {
+			config:     &flash.ListenerConfig{Table: "posts", Fields: []string{"id", "title"}},
+			operations: flash.OperationAll,
+		},
+	}
+
+	// The key changed, the new title is NULL: the previous title is unknown, not NULL
+	change := &Change{Operation: flash.OperationUpdate, Table: "public.posts", Old: &flash.EventData{"id": 1}, New: &flash.EventData{"id": 2, "title": nil}}
+	if err := driver.processChange(change); err != nil {
+		t.Fatal(err)
+	}
+	if len(eventsChan) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(eventsChan))
+	}
+	event, ok := (<-eventsChan).Event.(*flash.UpdateEvent)
+	if !ok {
+		t.Fatalf("expected update event")
+	}
+	if _, exists := (*event.Old)["title"]; exists {
+		t.Errorf("expected unknown title to be absent from old row, got %v", *event.Old)
+	}
+
+	// Only the identity is known, the update is sent even if listened fields may be unchanged
+	change = &Change{Operation: flash.OperationUpdate, Table: "public.posts", Old: &flash.EventData{"id": 2}, New: &flash.EventData{"id": 2, "title": nil}}
+	if err := driver.processChange(change); err != nil {
+		t.Fatal(err)
+	}
+	if len(eventsChan) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(eventsChan))
+	}
+	<-eventsChan
+}
@@ -2,10 +2,8 @@ package wal_logical
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"github.com/jackc/pgx/v5/pgconn"
-	"github.com/quix-labs/flash"
 	"strings"
 )
 
@@ -13,46 +11,271 @@ func (d *Driver) getFullSlotName(slotName string) string {
 	return d.Config.PublicationSlotPrefix + "-" + slotName
 }
 
-func (d *Driver) getCreatePublicationSlotSql(fullSlotName string, config *flash.ListenerConfig, operation *flash.Operation) (string, error) {
-	if config == nil {
-		return fmt.Sprintf(`CREATE PUBLICATION "%s";`, fullSlotName), nil
-	}
+func (d *Driver) getPublicationName() string {
+	return d.getFullSlotName("main")
+}
 
-	rawSql := d.getDropPublicationSlotSql(fullSlotName)
-	// SET REPLICA IDENTITY TO FULL ON CREATION
-	quotedTableName := d.sanitizeTableName(config.Table, true)
-	rawSql += fmt.Sprintf(`ALTER TABLE %s REPLICA IDENTITY FULL;CREATE PUBLICATION "%s" FOR TABLE %s`, quotedTableName, fullSlotName, quotedTableName)
-
-	if operation != nil {
-		//TODO THROW ERROR IF NOT ATOMIC OR JOIN EACH ATOMIC (see .getAlterPublicationEventsSql() )
-		operationName, err := operation.StrictName()
-		if err != nil {
-			return "", err
-		}
-		rawSql += fmt.Sprintf(` WITH (publish = '%s')`, strings.ToLower(operationName))
+// getCreatePublicationSql returns the statement creating the publication if missing, and registering this instance as its owner.
+// The publication is kept while the replication stream reads it, it is only dropped on Close or by the garbage collector.
+// On PostgreSQL 13+, changes of partitions are published under the name of their published partitioned table.
+func (d *Driver) getCreatePublicationSql(publicationName string, serverVersion int) string {
+	options := ""
+	if serverVersion >= 13 {
+		options = " WITH (publish_via_partition_root = true)"
 	}
-	return rawSql + ";", nil
+	return d.getRegisterPublicationSql(publicationName) + fmt.Sprintf(`
+		DO $create$
+		BEGIN
+			IF NOT EXISTS (SELECT FROM pg_publication WHERE pubname = %s) THEN
+				CREATE PUBLICATION "%s"%s;
+			END IF;
+		END;
+		$create$;`, quoteLiteral(publicationName), publicationName, options)
 }
 
-func (d *Driver) getAlterPublicationEventsSql(publication *activePublication) (string, error) {
-	if publication == nil {
-		return "", errors.New("publication is nil")
+// getResetPublicationTablesSql returns the statement removing all tables from the publication, e.g: left by a previous run
+func (d *Driver) getResetPublicationTablesSql(publicationName string) string {
+	return fmt.Sprintf(`
+		DO $reset$
+		DECLARE
+			published_table REGCLASS;
+		BEGIN
+			FOR published_table IN SELECT pr.prrelid::REGCLASS FROM pg_publication_rel pr JOIN pg_publication p ON p.oid = pr.prpubid WHERE p.pubname = %s LOOP
+				EXECUTE format('ALTER PUBLICATION %%I DROP TABLE %%s', %s, published_table);
+			END LOOP;
+		END;
+		$reset$;`, quoteLiteral(publicationName), quoteLiteral(publicationName))
+}
+
+// getAddPublicationTableSql returns the statement publishing changes of the table, if not already published.
+// With ReplicaIdentityTemporaryFull, SET REPLICA IDENTITY TO FULL, the original one is restored when no instance needs it anymore
+func (d *Driver) getAddPublicationTableSql(tableName string) string {
+	quotedTableName := d.sanitizeTableName(tableName, true)
+	addTableSql := fmt.Sprintf(`
+		DO $add$
+		BEGIN
+			IF NOT EXISTS (
+				SELECT FROM pg_publication_rel pr JOIN pg_publication p ON p.oid = pr.prpubid
+				WHERE p.pubname = %s AND pr.prrelid = %s::regclass
+			) THEN
+				ALTER PUBLICATION "%s" ADD TABLE %s;
+			END IF;
+		END;
+		$add$;`, quoteLiteral(d.getPublicationName()), quoteLiteral(quotedTableName), d.getPublicationName(), quotedTableName)
+	if d.Config.ReplicaIdentityPolicy != ReplicaIdentityTemporaryFull {
+		return addTableSql
 	}
+	return d.getSaveReplicaIdentitySql(quotedTableName) +
+		fmt.Sprintf(`ALTER TABLE %s REPLICA IDENTITY FULL;`, quotedTableName) + addTableSql
+}
 
-	var rawOperations []string
-	for _, targetOperation := range publication.operations.GetAtomics() {
-		operation, err := targetOperation.StrictName()
-		if err != nil {
-			return "", err
-		}
-		rawOperations = append(rawOperations, strings.ToLower(operation))
+func (d *Driver) getDropPublicationTableSql(tableName string) string {
+	quotedTableName := d.sanitizeTableName(tableName, true)
+	dropTableSql := fmt.Sprintf(`ALTER PUBLICATION "%s" DROP TABLE %s;`, d.getPublicationName(), quotedTableName)
+	if d.Config.ReplicaIdentityPolicy != ReplicaIdentityTemporaryFull {
+		return dropTableSql
 	}
+	return dropTableSql + d.getRestoreReplicaIdentitySql(quotedTableName)
+}
+
+// getReplicaIdentitySql returns the query selecting the replica identity of the table: d, n, f or i, and its relkind
+func (d *Driver) getReplicaIdentitySql(tableName string) string {
+	return fmt.Sprintf(`SELECT relreplident, relkind FROM pg_class WHERE oid = %s::regclass;`, quoteLiteral(d.sanitizeTableName(tableName, true)))
+}
 
-	return fmt.Sprintf(`ALTER PUBLICATION "%s" SET (publish = '%s');`, publication.slotName, strings.Join(rawOperations, ", ")), nil
+// getPartitionsSql returns the query selecting all partitions of the table as schema.table, recursively, with their relkind
+func (d *Driver) getPartitionsSql(tableName string) string {
+	return fmt.Sprintf(`
+		WITH RECURSIVE partitions AS (
+			SELECT inhrelid FROM pg_inherits WHERE inhparent = %s::regclass
+			UNION ALL
+			SELECT i.inhrelid FROM pg_inherits i JOIN partitions p ON i.inhparent = p.inhrelid
+		)
+		SELECT n.nspname || '.' || c.relname, c.relkind FROM partitions p
+		JOIN pg_class c ON c.oid = p.inhrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace;`, quoteLiteral(d.sanitizeTableName(tableName, true)))
+}
+
+// getColumnTypesSql returns the query selecting the type of each column of the tables with its table, element types are selected for arrays
+func (d *Driver) getColumnTypesSql(tableNames []string) string {
+	regclasses := make([]string, len(tableNames))
+	for i, tableName := range tableNames {
+		regclasses[i] = fmt.Sprintf(`to_regclass(%s)`, quoteLiteral(d.sanitizeTableName(tableName, true)))
+	}
+	return fmt.Sprintf(`
+		SELECT DISTINCT a.attrelid::regclass::text, CASE WHEN t.typcategory = 'A' THEN t.typelem ELSE t.oid END
+		FROM pg_attribute a JOIN pg_type t ON t.oid = a.atttypid
+		WHERE a.attrelid IN (%s) AND a.attnum > 0 AND NOT a.attisdropped;`, strings.Join(regclasses, ","))
 }
 
 func (d *Driver) getDropPublicationSlotSql(fullSlotName string) string {
-	return fmt.Sprintf(`DROP PUBLICATION IF EXISTS "%s";`, fullSlotName)
+	return fmt.Sprintf(`DROP PUBLICATION IF EXISTS "%s";DELETE FROM "%s"."publications" WHERE name = %s;`,
+		fullSlotName, d.Config.MetadataSchema, quoteLiteral(fullSlotName))
+}
+
+// getBootstrapSql returns the statement creating the metadata schema and registering this instance
+func (d *Driver) getBootstrapSql() string {
+	return fmt.Sprintf(`
+		CREATE SCHEMA IF NOT EXISTS "%s";
+		CREATE TABLE IF NOT EXISTS "%s"."instances" (
+			id TEXT PRIMARY KEY,
+			heartbeat_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE TABLE IF NOT EXISTS "%s"."publications" (
+			name TEXT PRIMARY KEY,
+			instance_id TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS "%s"."replication_slots" (
+			name TEXT PRIMARY KEY,
+			instance_id TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS "%s"."replica_identities" (
+			table_name TEXT NOT NULL,
+			instance_id TEXT NOT NULL,
+			original_identity TEXT NOT NULL,
+			PRIMARY KEY (table_name, instance_id)
+		);
+		INSERT INTO "%s"."instances" (id) VALUES (%s) ON CONFLICT (id) DO UPDATE SET heartbeat_at = now();`,
+		d.Config.MetadataSchema, d.Config.MetadataSchema, d.Config.MetadataSchema, d.Config.MetadataSchema,
+		d.Config.MetadataSchema, d.Config.MetadataSchema, quoteLiteral(d.instanceId))
+}
+
+func (d *Driver) getRefreshHeartbeatSql() string {
+	return fmt.Sprintf(`UPDATE "%s"."instances" SET heartbeat_at = now() WHERE id = %s;`, d.Config.MetadataSchema, quoteLiteral(d.instanceId))
+}
+
+// getSlotStatsSql returns the query selecting restart_lsn, confirmed_flush_lsn and retained WAL bytes of the replication slot
+func (d *Driver) getSlotStatsSql() string {
+	return fmt.Sprintf(`SELECT restart_lsn, confirmed_flush_lsn, COALESCE(pg_wal_lsn_diff(pg_current_wal_lsn(), restart_lsn), 0)::bigint
+		FROM pg_replication_slots WHERE slot_name = %s;`, quoteLiteral(d.Config.ReplicationSlot))
+}
+
+// getSlotExistsSql returns the query selecting the replication slot if it exists
+func (d *Driver) getSlotExistsSql() string {
+	return fmt.Sprintf(`SELECT 1 FROM pg_replication_slots WHERE slot_name = %s;`, quoteLiteral(d.Config.ReplicationSlot))
+}
+
+// getRegisterReplicationSlotSql returns the statement recording this instance as owner of the replication slot
+func (d *Driver) getRegisterReplicationSlotSql() string {
+	return fmt.Sprintf(`INSERT INTO "%s"."replication_slots" (name, instance_id) VALUES (%s, %s) ON CONFLICT (name) DO UPDATE SET instance_id = EXCLUDED.instance_id;`,
+		d.Config.MetadataSchema, quoteLiteral(d.Config.ReplicationSlot), quoteLiteral(d.instanceId))
+}
+
+// getDropReplicationSlotSql returns the statement dropping the replication slot, and its owner when the metadata schema still exists
+func (d *Driver) getDropReplicationSlotSql() string {
+	return fmt.Sprintf(`
+		SELECT pg_drop_replication_slot(slot_name) FROM pg_replication_slots WHERE slot_name = %s;
+		DO $unregister$
+		BEGIN
+			DELETE FROM "%s"."replication_slots" WHERE name = %s;
+		EXCEPTION WHEN undefined_table OR invalid_schema_name THEN
+			-- Metadata schema dropped with the last instance
+		END;
+		$unregister$;`,
+		quoteLiteral(d.Config.ReplicationSlot), d.Config.MetadataSchema, quoteLiteral(d.Config.ReplicationSlot))
+}
+
+func (d *Driver) getRegisterPublicationSql(fullSlotName string) string {
+	return fmt.Sprintf(`INSERT INTO "%s"."publications" (name, instance_id) VALUES (%s, %s) ON CONFLICT (name) DO UPDATE SET instance_id = EXCLUDED.instance_id;`,
+		d.Config.MetadataSchema, quoteLiteral(fullSlotName), quoteLiteral(d.instanceId))
+}
+
+// getSaveReplicaIdentitySql returns the statement saving the replica identity of the table before its alteration.
+// When another instance already altered the table, its saved identity is kept as the original one.
+func (d *Driver) getSaveReplicaIdentitySql(quotedTableName string) string {
+	return fmt.Sprintf(`
+		INSERT INTO "%s"."replica_identities" (table_name, instance_id, original_identity)
+		SELECT %s, %s, COALESCE(
+			(SELECT original_identity FROM "%s"."replica_identities" WHERE table_name = %s LIMIT 1),
+			(SELECT CASE c.relreplident
+				WHEN 'd' THEN 'DEFAULT'
+				WHEN 'n' THEN 'NOTHING'
+				WHEN 'f' THEN 'FULL'
+				ELSE (SELECT 'USING INDEX ' || quote_ident(i.relname) FROM pg_index x JOIN pg_class i ON i.oid = x.indexrelid WHERE x.indrelid = c.oid AND x.indisreplident)
+			END FROM pg_class c WHERE c.oid = %s::regclass)
+		)
+		ON CONFLICT (table_name, instance_id) DO NOTHING;`,
+		d.Config.MetadataSchema, quoteLiteral(quotedTableName), quoteLiteral(d.instanceId),
+		d.Config.MetadataSchema, quoteLiteral(quotedTableName), quoteLiteral(quotedTableName))
+}
+
+// getRestoreReplicaIdentitySql returns the statement releasing the table for this instance,
+// its original replica identity is restored when no other instance listens to it
+func (d *Driver) getRestoreReplicaIdentitySql(quotedTableName string) string {
+	return fmt.Sprintf(`
+		DO $restore$
+		DECLARE
+			saved_identity RECORD;
+		BEGIN
+			FOR saved_identity IN DELETE FROM "%s"."replica_identities" r WHERE r.table_name = %s AND r.instance_id = %s RETURNING r.table_name, r.original_identity LOOP
+				IF NOT EXISTS (SELECT FROM "%s"."replica_identities" r WHERE r.table_name = saved_identity.table_name) THEN
+					EXECUTE format('ALTER TABLE %%s REPLICA IDENTITY %%s', saved_identity.table_name, saved_identity.original_identity);
+				END IF;
+			END LOOP;
+		END;
+		$restore$;`,
+		d.Config.MetadataSchema, quoteLiteral(quotedTableName), quoteLiteral(d.instanceId), d.Config.MetadataSchema)
+}
+
+// getDropInstancesSql returns the statement removing instances matching the condition, with all their objects.
+// Replication slots are dropped when inactive, a slot still streaming is dropped by its owner on Close.
+// Replica identities are restored once no remaining instance listens to the table.
+// Rows are locked to avoid concurrent collectors dropping the same objects.
+func (d *Driver) getDropInstancesSql(rawConditionSql string) string {
+	return fmt.Sprintf(`
+		DO $collect$
+		DECLARE
+			target_instance_id TEXT;
+			object_name TEXT;
+			saved_identity RECORD;
+		BEGIN
+			FOR target_instance_id IN SELECT id FROM "%s"."instances" WHERE %s FOR UPDATE SKIP LOCKED LOOP
+				FOR object_name IN DELETE FROM "%s"."publications" p WHERE p.instance_id = target_instance_id RETURNING p.name LOOP
+					EXECUTE format('DROP PUBLICATION IF EXISTS %%I', object_name);
+				END LOOP;
+				FOR object_name IN DELETE FROM "%s"."replication_slots" s WHERE s.instance_id = target_instance_id RETURNING s.name LOOP
+					PERFORM pg_drop_replication_slot(slot_name) FROM pg_replication_slots WHERE slot_name = object_name AND NOT active;
+				END LOOP;
+				FOR saved_identity IN DELETE FROM "%s"."replica_identities" r WHERE r.instance_id = target_instance_id RETURNING r.table_name, r.original_identity LOOP
+					IF NOT EXISTS (SELECT FROM "%s"."replica_identities" r WHERE r.table_name = saved_identity.table_name) THEN
+						BEGIN
+							EXECUTE format('ALTER TABLE %%s REPLICA IDENTITY %%s', saved_identity.table_name, saved_identity.original_identity);
+						EXCEPTION WHEN undefined_table THEN
+							-- Table dropped in the meantime
+						END;
+					END IF;
+				END LOOP;
+				DELETE FROM "%s"."instances" WHERE id = target_instance_id;
+			END LOOP;
+		END;
+		$collect$;`,
+		d.Config.MetadataSchema, rawConditionSql,
+		d.Config.MetadataSchema, d.Config.MetadataSchema, d.Config.MetadataSchema, d.Config.MetadataSchema,
+		d.Config.MetadataSchema)
+}
+
+// getCollectGarbageSql returns the statement removing objects of instances without recent heartbeat
+func (d *Driver) getCollectGarbageSql() string {
+	return d.getDropInstancesSql(fmt.Sprintf(`heartbeat_at < now() - INTERVAL '%d milliseconds' AND id <> %s`,
+		d.Config.InstanceTimeout.Milliseconds(), quoteLiteral(d.instanceId)))
+}
+
+// getUnregisterInstanceSql returns the statement removing objects of this instance,
+// the metadata schema is dropped when no other instance uses it.
+func (d *Driver) getUnregisterInstanceSql() string {
+	return d.getDropInstancesSql(fmt.Sprintf(`id = %s`, quoteLiteral(d.instanceId))) + fmt.Sprintf(`
+		DO $drop$
+		BEGIN
+			LOCK TABLE "%s"."instances" IN ACCESS EXCLUSIVE MODE;
+			IF NOT EXISTS (SELECT FROM "%s"."instances") THEN
+				DROP SCHEMA "%s" CASCADE;
+			END IF;
+		END;
+		$drop$;`, d.Config.MetadataSchema, d.Config.MetadataSchema, d.Config.MetadataSchema)
+}
+
+func quoteLiteral(literal string) string {
+	return `'` + strings.ReplaceAll(literal, `'`, `''`) + `'`
 }
 
 // Returns tablename as format public.posts.
@@ -2,8 +2,11 @@ package wal_logical
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/quix-labs/flash"
+	"time"
 )
 
 type subscriptionClaim struct {
@@ -12,123 +15,151 @@ type subscriptionClaim struct {
 	operation      *flash.Operation
 }
 
-type activePublication struct {
-	listenerConfig *flash.ListenerConfig
-	slotName       string
-	operations     *flash.Operation // Use with bitwise to handle combined operations
+type activeListener struct {
+	config     *flash.ListenerConfig
+	operations flash.Operation // Use bitwise comparison to check for listened events
 }
 
-// Key -> listenerUid
 type subscriptionState struct {
-	subChan              chan *subscriptionClaim
-	unsubChan            chan *subscriptionClaim
-	currentSubscriptions map[string]*activePublication
+	subChan         chan *subscriptionClaim
+	unsubChan       chan *subscriptionClaim
+	publishedTables map[string]bool            // key: tableName -> added to the publication
+	partitions      map[string]map[string]bool // key 1: published tableName -> key 2: partition -> is leaf, see refreshPartitions
 }
 
 func (d *Driver) initQuerying() error {
 	d.subscriptionState = &subscriptionState{
-		subChan:              make(chan *subscriptionClaim),
-		unsubChan:            make(chan *subscriptionClaim),
-		currentSubscriptions: make(map[string]*activePublication),
+		subChan:         make(chan *subscriptionClaim),
+		unsubChan:       make(chan *subscriptionClaim),
+		publishedTables: make(map[string]bool),
+		partitions:      make(map[string]map[string]bool),
 	}
 
-	// Bootstrap/Start listening TODO USELESS
 	d.activePublications = make(map[string]bool)
 
 	return nil
 }
 
 func (d *Driver) startQuerying(readyChan *chan struct{}) error {
-	// Create connection
-	config, err := pgconn.ParseConfig(d._clientConfig.DatabaseCnx)
-	if err != nil {
-		return err
-	}
-	config.RuntimeParams["application_name"] = "Flash: replication (querying)"
-	if d.queryConn, err = pgconn.ConnectConfig(context.Background(), config); err != nil {
+	if err := d.startQueryConn(true); err != nil {
 		return err
 	}
 
+	heartbeatTicker := time.NewTicker(d.Config.HeartbeatInterval)
+	defer heartbeatTicker.Stop()
+
 	*readyChan <- struct{}{}
 	for {
+		var err error
 		select {
 
-		case claimSub := <-d.subscriptionState.unsubChan:
-			currentSub, exists := d.subscriptionState.currentSubscriptions[claimSub.listenerUid]
-			if !exists {
-				continue
-			}
-
-			// TODO Operation.Remove()
-			prevEvents := *currentSub.operations
-			*currentSub.operations &= ^(*claimSub.operation) // Remove operation from listened
+		case <-d.shutdown:
+			return nil
 
-			// Bypass if no changes
-			if *currentSub.operations == prevEvents {
-				return nil
+		case <-heartbeatTicker.C:
+			if err = d.refreshHeartbeat(); err != nil {
+				break
 			}
+			d.collectGarbage()
+			d.refreshSlotStats()
 
-			if len(currentSub.operations.GetAtomics()) > 0 {
-				alterSql, err := d.getAlterPublicationEventsSql(currentSub)
-				if err != nil {
-					return err
-				}
-				if _, err := d.sqlExec(d.queryConn, alterSql); err != nil {
-					return err
+			// Cover partitions attached or detached since the last heartbeat
+			for tableName := range d.subscriptionState.publishedTables {
+				if err = d.refreshPartitions(tableName, false); err != nil {
+					break
 				}
-			} else {
-				if _, err := d.sqlExec(d.queryConn, d.getDropPublicationSlotSql(currentSub.slotName)); err != nil {
-					return err
-				}
-				delete(d.activePublications, currentSub.slotName)
-				delete(d.subscriptionState.currentSubscriptions, claimSub.listenerUid)
 			}
 
-		case claimSub := <-d.subscriptionState.subChan:
-			currentSub, exists := d.subscriptionState.currentSubscriptions[claimSub.listenerUid]
-			if !exists {
-				currentSub = &activePublication{
-					listenerConfig: claimSub.listenerConfig,
-					slotName:       d.getFullSlotName(claimSub.listenerUid),
-					operations:     claimSub.operation,
-				}
-
-				slotName := d.getFullSlotName(claimSub.listenerUid)
-				rawSql, err := d.getCreatePublicationSlotSql(slotName, claimSub.listenerConfig, claimSub.operation)
-				if err != nil {
-					return err
-				}
-				if _, err := d.sqlExec(d.queryConn, rawSql); err != nil {
-					return err
-				}
+		case claimSub := <-d.subscriptionState.unsubChan:
+			tableName := d.sanitizeTableName(claimSub.listenerConfig.Table, false)
 
-				d.subscriptionState.currentSubscriptions[claimSub.listenerUid] = currentSub
-				d.activePublications[slotName] = true
-				d.replicationState.restartChan <- struct{}{} // Send restart signal
+			d.activeListenersMutex.RLock()
+			stillListened := len(d.activeListeners[tableName]) > 0
+			d.activeListenersMutex.RUnlock()
 
-			} else {
-				prevEvents := *currentSub.operations
+			// Keep table published while other listeners use it
+			if stillListened || !d.subscriptionState.publishedTables[tableName] {
+				continue
+			}
+			// Removed first, the table is not published again on reconnection
+			delete(d.subscriptionState.publishedTables, tableName)
+			_, err = d.sqlExec(d.queryConn, d.getDropPublicationTableSql(tableName)+d.getReleasePartitionsSql(tableName))
 
-				// TODO Operation.Append() or Operation.Merge()
-				*currentSub.operations |= *claimSub.operation //Append operation to listened
+		case claimSub := <-d.subscriptionState.subChan:
+			tableName := d.sanitizeTableName(claimSub.listenerConfig.Table, false)
+			if d.subscriptionState.publishedTables[tableName] {
+				continue
+			}
 
-				// Bypass if no changes
-				if prevEvents == *currentSub.operations {
-					return nil
+			if d.Config.ReplicaIdentityPolicy == ReplicaIdentityRequireFull {
+				if err = d.checkReplicaIdentity(tableName); err != nil {
+					if isConnectionLost(d.queryConn, err) {
+						// Checked again after reconnection
+						go func() { d.subscriptionState.subChan <- claimSub }()
+					}
+					break
 				}
+			}
 
-				alterSql, err := d.getAlterPublicationEventsSql(currentSub)
-				if err != nil {
-					return err
-				}
-				if _, err := d.sqlExec(d.queryConn, alterSql); err != nil {
-					return err
-				}
+			if err = d.requireTextTuples(tableName); err != nil {
+				break
+			}
+
+			// The replication stream receives changes of the table from now on, without restart when tuples are decodable.
+			// Added first, the table is published on reconnection.
+			d.subscriptionState.publishedTables[tableName] = true
+			if _, err = d.sqlExec(d.queryConn, d.getAddPublicationTableSql(tableName)); err != nil {
+				break
+			}
+			err = d.refreshPartitions(tableName, d.Config.ReplicaIdentityPolicy == ReplicaIdentityRequireFull)
+		}
+
+		if err == nil {
+			continue
+		}
+		if !isConnectionLost(d.queryConn, err) {
+			return err
+		}
+		if err := d.reconnect("querying", err, d.restartQuerying); err != nil {
+			if errors.Is(err, errClosed) {
+				return nil
 			}
+			return err
 		}
 	}
 }
 
+// startQueryConn connects, registers this instance then creates the publication used for the whole replication, if missing.
+// The publication is never dropped while the replication stream reads it, tables of a previous run are removed on first start.
+func (d *Driver) startQueryConn(firstStart bool) error {
+	config, err := pgconn.ParseConfig(d._clientConfig.DatabaseCnx)
+	if err != nil {
+		return err
+	}
+	config.RuntimeParams["application_name"] = "Flash: replication (querying)"
+	if d.queryConn, err = pgconn.ConnectConfig(context.Background(), config); err != nil {
+		return err
+	}
+
+	// Create metadata tables if not exists, register this instance
+	if _, err := d.sqlExec(d.queryConn, d.getBootstrapSql()); err != nil {
+		return err
+	}
+	d.collectGarbage()
+
+	// Tables are added and removed as listeners change
+	publicationName := d.getPublicationName()
+	publicationSql := d.getCreatePublicationSql(publicationName, parseServerVersion(d.queryConn.ParameterStatus("server_version")))
+	if firstStart {
+		publicationSql += d.getResetPublicationTablesSql(publicationName)
+	}
+	if _, err := d.sqlExec(d.queryConn, publicationSql); err != nil {
+		return err
+	}
+	d.activePublications[publicationName] = true
+	return nil
+}
+
 func (d *Driver) closeQuerying() error {
 	if d.queryConn != nil {
 		for publication, _ := range d.activePublications {
@@ -136,6 +167,12 @@ func (d *Driver) closeQuerying() error {
 				return err
 			}
 		}
+
+		// Drop objects of this instance and restore replica identities, other instances keep their own
+		if _, err := d.sqlExec(d.queryConn, d.getUnregisterInstanceSql()); err != nil {
+			return err
+		}
+
 		err := d.queryConn.Close(context.Background())
 		if err != nil {
 			return err
@@ -144,3 +181,24 @@ func (d *Driver) closeQuerying() error {
 	}
 	return nil
 }
+
+// checkReplicaIdentity returns an error if the table does not use REPLICA IDENTITY FULL
+func (d *Driver) checkReplicaIdentity(tableName string) error {
+	results, err := d.sqlExec(d.queryConn, d.getReplicaIdentitySql(tableName))
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 || len(results[0].Rows) == 0 {
+		return fmt.Errorf("table %s not found", tableName)
+	}
+	// Changes of partitions use the replica identity of each partition
+	if relkind := string(results[0].Rows[0][1]); relkind == "p" {
+		return nil
+	}
+	if identity := string(results[0].Rows[0][0]); identity != "f" {
+		names := map[string]string{"d": "DEFAULT", "n": "NOTHING", "i": "USING INDEX"}
+		return fmt.Errorf("table %s must use REPLICA IDENTITY FULL with ReplicaIdentityRequireFull, got %s: run ALTER TABLE %s REPLICA IDENTITY FULL",
+			tableName, names[identity], d.sanitizeTableName(tableName, true))
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package wal_logical
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/quix-labs/flash"
+	"math/rand"
+	"time"
+)
+
+var errClosed = errors.New("driver closed")
+
+// reconnect emits LifecycleDisconnected then calls restart until it succeeds, waiting with exponential backoff between attempts.
+// Returns an error after MaxReconnectAttempts consecutive failures, or errClosed if the driver is closed meanwhile.
+func (d *Driver) reconnect(connName string, cause error, restart func() error) error {
+	d._clientConfig.EmitLifecycleEvent(&flash.LifecycleEvent{Type: flash.LifecycleDisconnected, Err: fmt.Errorf("%s connection lost: %w", connName, cause)})
+
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-d.shutdown:
+			return errClosed
+		case <-time.After(backoffDelay(attempt, d.Config.MinReconnectInterval, d.Config.MaxReconnectInterval)):
+		}
+
+		err := restart()
+		if err == nil {
+			d._clientConfig.EmitLifecycleEvent(&flash.LifecycleEvent{Type: flash.LifecycleReconnected})
+			return nil
+		}
+		d._clientConfig.Logger.Warn().Err(err).Str("connection", connName).Int("attempt", attempt).Msg("reconnection attempt failed")
+		if d.Config.MaxReconnectAttempts > 0 && attempt >= d.Config.MaxReconnectAttempts {
+			return fmt.Errorf("could not reconnect %s connection after %d attempts: %w", connName, attempt, err)
+		}
+	}
+}
+
+// backoffDelay doubles the delay on each attempt up to maxDelay, a random jitter of up to half the delay is subtracted
+// to avoid multiple instances reconnecting at the same time
+func backoffDelay(attempt int, minDelay time.Duration, maxDelay time.Duration) time.Duration {
+	delay := maxDelay
+	if attempt < 32 && minDelay<<(attempt-1) < maxDelay {
+		delay = minDelay << (attempt - 1)
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// isConnectionLost checks if the error was caused by a closed connection, other errors are returned to the caller
+func isConnectionLost(conn *pgconn.PgConn, err error) bool {
+	if err == nil || conn == nil {
+		return false
+	}
+	return conn.IsClosed()
+}
+
+// restartReplication opens a new replication connection, then reuses the persistent slot.
+// Replication resumes from the last flushed position, the server keeps the WAL retained by the slot meanwhile.
+func (d *Driver) restartReplication() error {
+	if d.replicationConn != nil {
+		_ = d.replicationConn.Close(context.Background())
+		d.replicationConn = nil
+	}
+	if err := d.startConn(); err != nil {
+		return err
+	}
+	if err := d.Config.OutputDecoder.Init(d._clientConfig); err != nil {
+		return err
+	}
+	return d.startReplication()
+}
+
+// restartQuerying opens a new querying connection, then adds the tables published before to the kept publication, if missing
+func (d *Driver) restartQuerying() error {
+	if d.queryConn != nil {
+		_ = d.queryConn.Close(context.Background())
+		d.queryConn = nil
+	}
+	if err := d.startQueryConn(false); err != nil {
+		return err
+	}
+	for tableName := range d.subscriptionState.publishedTables {
+		if _, err := d.sqlExec(d.queryConn, d.getAddPublicationTableSql(tableName)); err != nil {
+			return err
+		}
+		if err := d.refreshPartitions(tableName, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package wal_logical
+
+import (
+	"github.com/jackc/pglogrepl"
+	"github.com/quix-labs/flash"
+	"github.com/rs/zerolog"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{7, time.Minute},
+		{100, time.Minute},
+	}
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			delay := backoffDelay(test.attempt, time.Second, time.Minute)
+			if delay < test.expected/2 || delay > test.expected {
+				t.Fatalf("backoffDelay(%d) = %s, expected between %s and %s", test.attempt, delay, test.expected/2, test.expected)
+			}
+		}
+	}
+}
+
+func TestPgOutputDecoderInitDiscardsStreams(t *testing.T) {
+	logger := zerolog.Nop()
+	clientConfig := &flash.ClientConfig{Logger: &logger}
+	decoder := NewPgOutputDecoder()
+	if err := decoder.Init(clientConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stream interrupted by a connection loss
+	if _, err := decoder.Decode(&pglogrepl.XLogData{WALData: testMessage{'S'}.uint32(7).uint8(1)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := decoder.enqueue(7, 7, testMessage{'I'}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := decoder.Init(clientConfig); err != nil {
+		t.Fatal(err)
+	}
+	if decoder.inStream || len(decoder.StreamQueueSizes()) != 0 {
+		t.Errorf("Init() must discard in-progress streams, got inStream %v and queues %v", decoder.inStream, decoder.StreamQueueSizes())
+	}
+}
@@ -7,35 +7,33 @@ import (
 	"github.com/jackc/pglogrepl"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgproto3"
-	"github.com/jackc/pgx/v5/pgtype"
-	"strings"
+	"github.com/quix-labs/flash"
+	"strconv"
+	"sync"
 	"time"
 )
 
+// replicationState is written by the replicator goroutine, locked for readers of Driver.Stats
 type replicationState struct {
-	lastReceivedLSN       pglogrepl.LSN
-	currentTransactionLSN pglogrepl.LSN
-	lastWrittenLSN        pglogrepl.LSN
+	sync.Mutex
 
-	typeMap   *pgtype.Map
-	relations map[uint32]*pglogrepl.RelationMessageV2
+	lastReceivedLSN pglogrepl.LSN
+	lastWrittenLSN  pglogrepl.LSN
+	serverWALEnd    pglogrepl.LSN
+	lastMessageAt   time.Time
 
-	processMessages bool
-	inStream        bool
-	streamQueues    map[uint32][]*pglogrepl.Message
+	slot slotStats // Written by the querying goroutine
 
-	restartChan chan struct{}
+	binaryTuples    bool               // Requested by the running replication, see useBinaryTuples
+	restartRequests chan chan struct{} // Sent by the querying goroutine, closed once replication restarted
 }
 
 func (d *Driver) initReplicator() error {
 	d.replicationState = &replicationState{
-		lastWrittenLSN: pglogrepl.LSN(0), //TODO KEEP IN FILE OR IGNORE
-		relations:      make(map[uint32]*pglogrepl.RelationMessageV2),
-		typeMap:        pgtype.NewMap(),
-		streamQueues:   make(map[uint32][]*pglogrepl.Message),
-		restartChan:    make(chan struct{}),
+		lastWrittenLSN:  pglogrepl.LSN(0), //TODO KEEP IN FILE OR IGNORE
+		restartRequests: make(chan chan struct{}),
 	}
-	return nil
+	return d.Config.OutputDecoder.Init(d._clientConfig)
 }
 
 func (d *Driver) startReplicator() error {
@@ -54,26 +52,16 @@ func (d *Driver) startReplicator() error {
 
 	for {
 		select {
-		case <-d.replicationState.restartChan:
-
-			if d.replicationConn == nil {
-				continue
-			}
-			if err := d.replicationConn.Close(context.Background()); err != nil {
-				d._clientConfig.Logger.Error().Err(err).Msgf("received err: %s", err)
-				return err
-			}
-			if err := d.startConn(); err != nil {
-				d._clientConfig.Logger.Error().Err(err).Msgf("received err: %s", err)
-				return err
-			}
-			if err := d.startReplication(); err != nil {
-				d._clientConfig.Logger.Error().Err(err).Msgf("received err: %s", err)
-				return err
+		case <-d.shutdown:
+			return nil
+		case restarted := <-d.replicationState.restartRequests:
+			err := d.restartReplication()
+			close(restarted)
+			if err != nil {
+				if err := d.handleReplicationError(err); err != nil {
+					return err
+				}
 			}
-
-			continue
-
 		default:
 			if d.replicationConn == nil {
 				time.Sleep(time.Millisecond * 100)
@@ -87,8 +75,11 @@ func (d *Driver) startReplicator() error {
 					WALApplyPosition: d.replicationState.lastReceivedLSN + 1,
 				})
 				if err != nil {
-					d._clientConfig.Logger.Error().Err(err).Msgf("received err: %s", err)
-					return err
+					if err := d.handleReplicationError(err); err != nil {
+						return err
+					}
+					nextStandbyMessageDeadline = time.Now().Add(standbyMessageTimeout)
+					continue
 				}
 				d._clientConfig.Logger.Trace().Msg("Sent Standby status message at " + (d.replicationState.lastWrittenLSN + 1).String())
 				nextStandbyMessageDeadline = time.Now().Add(standbyMessageTimeout)
@@ -102,9 +93,11 @@ func (d *Driver) startReplicator() error {
 				if pgconn.Timeout(err) {
 					continue
 				}
-				d._clientConfig.Logger.Warn().Err(err).Msgf("received err: %s", err)
-				time.Sleep(time.Millisecond * 100)
-				continue // CLOSED CONNECTION TODO handle and return err when needed
+				if err := d.handleReplicationError(err); err != nil {
+					return err
+				}
+				nextStandbyMessageDeadline = time.Now().Add(standbyMessageTimeout)
+				continue
 			}
 
 			if errMsg, ok := rawMsg.(*pgproto3.ErrorResponse); ok {
@@ -125,7 +118,11 @@ func (d *Driver) startReplicator() error {
 				}
 				d._clientConfig.Logger.Trace().Msg(fmt.Sprintf("Primary Keepalive Message => ServerWALEnd: %s ServerTime: %s ReplyRequested: %t", pkm.ServerWALEnd, pkm.ServerTime, pkm.ReplyRequested))
 
+				d.replicationState.Lock()
 				d.replicationState.lastReceivedLSN = pkm.ServerWALEnd
+				d.replicationState.serverWALEnd = pkm.ServerWALEnd
+				d.replicationState.lastMessageAt = time.Now()
+				d.replicationState.Unlock()
 
 				if pkm.ReplyRequested {
 					nextStandbyMessageDeadline = time.Time{}
@@ -143,7 +140,9 @@ func (d *Driver) startReplicator() error {
 					return err
 				}
 				if updateLsn {
+					d.replicationState.Lock()
 					d.replicationState.lastWrittenLSN = xld.ServerWALEnd
+					d.replicationState.Unlock()
 					// TODO write wal position in file if needed
 					nextStandbyMessageDeadline = time.Time{} // Force resend standby message
 				}
@@ -153,6 +152,23 @@ func (d *Driver) startReplicator() error {
 	}
 }
 
+// handleReplicationError reconnects when the connection is lost, returns nil once replication is restarted or the driver is closed
+func (d *Driver) handleReplicationError(err error) error {
+	select {
+	case <-d.shutdown:
+		return nil
+	default:
+	}
+	if !isConnectionLost(d.replicationConn, err) {
+		d._clientConfig.Logger.Error().Err(err).Msgf("received err: %s", err)
+		return err
+	}
+	if err := d.reconnect("replication", err, d.restartReplication); err != nil && !errors.Is(err, errClosed) {
+		return err
+	}
+	return nil
+}
+
 func (d *Driver) closeReplicator() error {
 	if d.replicationConn != nil {
 		// CLOSE ACTUAL
@@ -165,8 +181,7 @@ func (d *Driver) closeReplicator() error {
 			d._clientConfig.Logger.Error().Err(err).Msgf("received err: %s", err)
 			return err
 		}
-		dropReplicationSql := fmt.Sprintf(`select pg_drop_replication_slot(slot_name) from pg_replication_slots where slot_name = '%s';`, d.Config.ReplicationSlot)
-		_, err := d.sqlExec(d.replicationConn, dropReplicationSql)
+		_, err := d.sqlExec(d.replicationConn, d.getDropReplicationSlotSql())
 		if err != nil {
 			d._clientConfig.Logger.Error().Err(err).Msgf("received err: %s", err)
 			return err
@@ -195,51 +210,171 @@ func (d *Driver) startConn() error {
 		return err
 	}
 
-	// Create false publication to avoid START_REPLICATION error
-	initSlotName := d.getFullSlotName("init")
+	return nil
+}
 
-	// DROP OLD
-	dropPublicationSql := d.getDropPublicationSlotSql(initSlotName)
-	dropReplicationSql := fmt.Sprintf(`select pg_drop_replication_slot(slot_name) from pg_replication_slots where slot_name = '%s';`, d.Config.ReplicationSlot)
-	createPublicationSlotSql, err := d.getCreatePublicationSlotSql(initSlotName, nil, nil)
+func (d *Driver) startReplication() error {
+	serverVersion := d.getServerVersion()
+	twoPhase := d.Config.UseTwoPhase && serverVersion >= 15
+
+	slotOptions := ""
+	if twoPhase {
+		slotOptions = " (TWO_PHASE)"
+	}
+	if err := d.ensureReplicationSlot(slotOptions); err != nil {
+		return err
+	}
+	binaryTuples, err := d.useBinaryTuples(serverVersion)
 	if err != nil {
 		return err
 	}
+	d.replicationState.Lock()
+	d.replicationState.binaryTuples = binaryTuples
+	d.replicationState.Unlock()
 
-	d.activePublications[initSlotName] = true
+	replicationOptions := pglogrepl.StartReplicationOptions{
+		Mode: pglogrepl.LogicalReplication,
+		PluginArgs: d.Config.OutputDecoder.PluginArgs(&PluginOptions{
+			Publications:      []string{d.getPublicationName()},
+			Streaming:         d.Config.UseStreaming,
+			StreamMemoryLimit: d.Config.StreamMemoryLimit,
+			StreamSpillDir:    d.Config.StreamSpillDir,
+			Binary:            binaryTuples,
+			TwoPhase:          twoPhase,
+			OnlyLocalOrigin:   d.Config.OnlyLocalChanges,
+			ServerVersion:     serverVersion,
+		}),
+	}
 
-	if _, err := d.sqlExec(d.replicationConn, dropPublicationSql+dropReplicationSql+createPublicationSlotSql); err != nil {
+	if err := pglogrepl.StartReplication(context.Background(), d.replicationConn, d.Config.ReplicationSlot, d.replicationState.lastWrittenLSN+1, replicationOptions); err != nil {
 		return err
 	}
-
+	d._clientConfig.Logger.Debug().Msg("Started replication slot: " + d.Config.ReplicationSlot)
 	return nil
 }
 
-func (d *Driver) startReplication() error {
-	if _, err := d.sqlExec(d.replicationConn, fmt.Sprintf(`CREATE_REPLICATION_SLOT "%s" TEMPORARY LOGICAL "pgoutput";`, d.Config.ReplicationSlot)); err != nil {
+// useBinaryTuples checks if binary tuples can be requested, the binary representation of each column type of listened tables
+// must be decodable, see TypeRegistry.TextFormatRequiredBy. Tables listened later restart replication if needed, see requireTextTuples.
+func (d *Driver) useBinaryTuples(serverVersion int) (bool, error) {
+	if !d.Config.UseBinaryTuples || serverVersion < 14 {
+		return false, nil
+	}
+
+	d.activeListenersMutex.RLock()
+	tableNames := make([]string, 0, len(d.activeListeners))
+	for tableName := range d.activeListeners {
+		tableNames = append(tableNames, tableName)
+	}
+	d.activeListenersMutex.RUnlock()
+
+	info, tableName, err := d.textFormatRequiredBy(d.replicationConn, tableNames)
+	if err != nil {
+		return false, err
+	}
+	if info != nil {
+		d._clientConfig.Logger.Warn().Str("type", info.Name).Str("table", tableName).Msg("binary tuples disabled, a column type must be received as text")
+		return false, nil
+	}
+	return true, nil
+}
+
+// textFormatRequiredBy returns the first column type of the tables which must be received as text, with its table
+func (d *Driver) textFormatRequiredBy(conn *pgconn.PgConn, tableNames []string) (*flash.TypeInfo, string, error) {
+	if len(tableNames) == 0 {
+		return nil, "", nil
+	}
+	results, err := d.sqlExec(conn, d.getColumnTypesSql(tableNames))
+	if err != nil {
+		return nil, "", err
+	}
+	for _, result := range results {
+		for _, row := range result.Rows {
+			oid, err := strconv.ParseUint(string(row[1]), 10, 32)
+			if err != nil {
+				return nil, "", err
+			}
+			if info, required := d._clientConfig.Types.TextFormatRequiredBy([]uint32{uint32(oid)}); required {
+				return info, string(row[0]), nil
+			}
+		}
+	}
+	return nil, "", nil
+}
+
+// requireTextTuples restarts replication with text tuples before the table is published, when its column types cannot be received as binary.
+// Called by the querying goroutine, blocks until replication restarted.
+func (d *Driver) requireTextTuples(tableName string) error {
+	d.replicationState.Lock()
+	binaryTuples := d.replicationState.binaryTuples
+	d.replicationState.Unlock()
+	if !binaryTuples {
+		return nil
+	}
+
+	info, _, err := d.textFormatRequiredBy(d.queryConn, []string{tableName})
+	if err != nil || info == nil {
 		return err
 	}
+	d._clientConfig.Logger.Warn().Str("type", info.Name).Str("table", tableName).Msg("binary tuples disabled, restarting replication: a column type must be received as text")
 
-	initSlotName := d.getFullSlotName("init")
-	activePublications := []string{initSlotName}
-	for publicationName, _ := range d.activePublications {
-		activePublications = append(activePublications, publicationName)
+	restarted := make(chan struct{})
+	select {
+	case d.replicationState.restartRequests <- restarted:
+	case <-d.shutdown:
+		return nil
 	}
-	replicationOptions := pglogrepl.StartReplicationOptions{
-		Mode: pglogrepl.LogicalReplication,
-		PluginArgs: []string{
-			"proto_version '2'", // Keep as version 2 to compatibility
-			"publication_names '" + strings.Join(activePublications, ", ") + "'",
-			"messages 'true'",
-		},
+	select {
+	case <-restarted:
+	case <-d.shutdown:
 	}
-	if d.Config.UseStreaming {
-		replicationOptions.PluginArgs = append(replicationOptions.PluginArgs, "streaming 'true'")
+	return nil
+}
+
+// ensureReplicationSlot reuses the persistent slot, so replication resumes after a reconnection or a restart,
+// or creates it when missing: first start, or slot dropped by the garbage collector of another instance.
+func (d *Driver) ensureReplicationSlot(slotOptions string) error {
+	results, err := d.sqlExec(d.replicationConn, d.getSlotExistsSql())
+	if err != nil {
+		return err
+	}
+	if len(results) > 0 && len(results[0].Rows) > 0 {
+		_, err = d.sqlExec(d.replicationConn, d.getRegisterReplicationSlotSql())
+		return err
 	}
 
-	if err := pglogrepl.StartReplication(context.Background(), d.replicationConn, d.Config.ReplicationSlot, d.replicationState.lastWrittenLSN+1, replicationOptions); err != nil {
+	results, err = d.sqlExec(d.replicationConn, fmt.Sprintf(`CREATE_REPLICATION_SLOT "%s" LOGICAL "%s"%s;`, d.Config.ReplicationSlot, d.Config.OutputDecoder.PluginName(), slotOptions))
+	if err != nil {
 		return err
 	}
-	d._clientConfig.Logger.Debug().Msg("Started replication slot: " + d.Config.ReplicationSlot)
+	if _, err = d.sqlExec(d.replicationConn, d.getRegisterReplicationSlotSql()); err != nil {
+		return err
+	}
+
+	// A new slot starts at its consistent point, changes between the last flushed position and this point cannot be streamed anymore.
+	if resumeLSN := d.replicationState.lastWrittenLSN; resumeLSN > 0 && len(results) > 0 && len(results[0].Rows) > 0 {
+		if consistentPoint, err := pglogrepl.ParseLSN(string(results[0].Rows[0][1])); err == nil && consistentPoint > resumeLSN+1 {
+			d._clientConfig.EmitLifecycleEvent(&flash.LifecycleEvent{
+				Type: flash.LifecycleGapDetected,
+				Err:  fmt.Errorf("replication slot recreated at %s, changes since %s may be lost", consistentPoint, resumeLSN),
+			})
+		}
+	}
 	return nil
 }
+
+// getServerVersion returns the major version of the server, 0 if unknown
+func (d *Driver) getServerVersion() int {
+	return parseServerVersion(d.replicationConn.ParameterStatus("server_version"))
+}
+
+// parseServerVersion extracts the major version, e.g: "16.2 (Debian 16.2-1.pgdg120+2)" -> 16, "17beta1" -> 17
+func parseServerVersion(version string) int {
+	major := 0
+	for _, char := range version {
+		if char < '0' || char > '9' {
+			break
+		}
+		major = major*10 + int(char-'0')
+	}
+	return major
+}
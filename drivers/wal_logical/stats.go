@@ -0,0 +1,132 @@
+package wal_logical
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jackc/pglogrepl"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrNotReplicating       = errors.New("replication not started")
+	ErrLagExceeded          = errors.New("replication lag exceeded")
+	ErrMessageDelayExceeded = errors.New("no message received from the server")
+)
+
+// Stats is a snapshot of the replication progress, see Driver.Stats
+type Stats struct {
+	ReceivedLSN  pglogrepl.LSN // Last position received, from data or keepalives
+	FlushedLSN   pglogrepl.LSN // Last position acknowledged to the server, once the transaction is handled
+	ServerWALEnd pglogrepl.LSN // End of the WAL on the server, from keepalives
+
+	SlotRestartLSN        pglogrepl.LSN // Oldest WAL position retained for the slot, from pg_replication_slots
+	SlotConfirmedFlushLSN pglogrepl.LSN // Position confirmed by the driver, as seen by the server
+	RetainedWALBytes      uint64        // WAL retained on the server because of the slot
+	SlotCheckedAt         time.Time     // Zero until the slot is queried, refreshed every HeartbeatInterval
+
+	LastMessageAt    time.Time     // Zero until the first message
+	SinceLastMessage time.Duration // Zero until the first message
+
+	StreamQueues map[uint32]int // key: xid -> buffered messages of in-progress streamed transactions, see DriverConfig.UseStreaming
+}
+
+// LagBytes returns the distance between the server WAL end and the flushed position
+func (s *Stats) LagBytes() uint64 {
+	if s.ServerWALEnd <= s.FlushedLSN {
+		return 0
+	}
+	return uint64(s.ServerWALEnd - s.FlushedLSN)
+}
+
+// StreamQueueReporter can be implemented by an OutputDecoder buffering streamed transactions
+type StreamQueueReporter interface {
+	StreamQueueSizes() map[uint32]int
+}
+
+type slotStats struct {
+	restartLSN        pglogrepl.LSN
+	confirmedFlushLSN pglogrepl.LSN
+	retainedWALBytes  uint64
+	checkedAt         time.Time
+}
+
+// Stats returns the current replication progress, safe to call from any goroutine
+func (d *Driver) Stats() *Stats {
+	stats := &Stats{}
+	if d.replicationState == nil {
+		return stats
+	}
+
+	d.replicationState.Lock()
+	stats.ReceivedLSN = d.replicationState.lastReceivedLSN
+	stats.FlushedLSN = d.replicationState.lastWrittenLSN
+	stats.ServerWALEnd = d.replicationState.serverWALEnd
+	stats.LastMessageAt = d.replicationState.lastMessageAt
+	stats.SlotRestartLSN = d.replicationState.slot.restartLSN
+	stats.SlotConfirmedFlushLSN = d.replicationState.slot.confirmedFlushLSN
+	stats.RetainedWALBytes = d.replicationState.slot.retainedWALBytes
+	stats.SlotCheckedAt = d.replicationState.slot.checkedAt
+	d.replicationState.Unlock()
+
+	if !stats.LastMessageAt.IsZero() {
+		stats.SinceLastMessage = time.Since(stats.LastMessageAt)
+	}
+	if reporter, ok := d.Config.OutputDecoder.(StreamQueueReporter); ok {
+		stats.StreamQueues = reporter.StreamQueueSizes()
+	}
+	return stats
+}
+
+// Health returns nil if the replication is running within the limits of DriverConfig.MaxLagBytes and DriverConfig.MaxMessageDelay
+func (d *Driver) Health() error {
+	return d.checkHealth(d.Stats())
+}
+
+func (d *Driver) checkHealth(stats *Stats) error {
+	if stats.LastMessageAt.IsZero() {
+		return ErrNotReplicating
+	}
+	if d.Config.MaxLagBytes > 0 {
+		if stats.RetainedWALBytes > d.Config.MaxLagBytes {
+			return fmt.Errorf("%w: slot retains %d bytes of WAL, limit is %d", ErrLagExceeded, stats.RetainedWALBytes, d.Config.MaxLagBytes)
+		}
+		if lag := stats.LagBytes(); lag > d.Config.MaxLagBytes {
+			return fmt.Errorf("%w: flushed position is %d bytes behind server, limit is %d", ErrLagExceeded, lag, d.Config.MaxLagBytes)
+		}
+	}
+	if d.Config.MaxMessageDelay > 0 && stats.SinceLastMessage > d.Config.MaxMessageDelay {
+		return fmt.Errorf("%w: last message received %s ago, limit is %s", ErrMessageDelayExceeded, stats.SinceLastMessage, d.Config.MaxMessageDelay)
+	}
+	return nil
+}
+
+// refreshSlotStats queries pg_replication_slots then calls DriverConfig.OnLagExceeded if a limit is exceeded
+func (d *Driver) refreshSlotStats() {
+	results, err := d.sqlExec(d.queryConn, d.getSlotStatsSql())
+	if err != nil {
+		d._clientConfig.Logger.Warn().Err(err).Msg("could not query replication slot stats")
+		return
+	}
+
+	// The slot is created by the replicator, may not exist yet
+	if len(results) > 0 && len(results[0].Rows) > 0 {
+		row := results[0].Rows[0]
+		slot := slotStats{checkedAt: time.Now()}
+		slot.restartLSN, _ = pglogrepl.ParseLSN(string(row[0]))
+		slot.confirmedFlushLSN, _ = pglogrepl.ParseLSN(string(row[1]))
+		slot.retainedWALBytes, _ = strconv.ParseUint(string(row[2]), 10, 64)
+
+		d.replicationState.Lock()
+		d.replicationState.slot = slot
+		d.replicationState.Unlock()
+	}
+
+	stats := d.Stats()
+	if err := d.checkHealth(stats); err != nil && !errors.Is(err, ErrNotReplicating) {
+		d._clientConfig.Logger.Warn().Err(err).Msg("replication health check failed")
+		if d.Config.OnLagExceeded != nil {
+			d.Config.OnLagExceeded(stats, err)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package wal_logical
+
+import (
+	"errors"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/quix-labs/flash"
+	"github.com/rs/zerolog"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheckHealth(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		stats    *Stats
+		expected error
+	}{
+		{"Not started", &Stats{}, ErrNotReplicating},
+		{"Healthy", &Stats{ServerWALEnd: 200, FlushedLSN: 150, RetainedWALBytes: 50, LastMessageAt: now, SinceLastMessage: time.Second}, nil},
+		{"Retained WAL", &Stats{ServerWALEnd: 200, FlushedLSN: 200, RetainedWALBytes: 101, LastMessageAt: now}, ErrLagExceeded},
+		{"Flush lag", &Stats{ServerWALEnd: 300, FlushedLSN: 150, LastMessageAt: now}, ErrLagExceeded},
+		{"Message delay", &Stats{LastMessageAt: now, SinceLastMessage: time.Minute}, ErrMessageDelayExceeded},
+	}
+
+	driver := NewDriver(&DriverConfig{MaxLagBytes: 100, MaxMessageDelay: 30 * time.Second})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := driver.checkHealth(test.stats); !errors.Is(err, test.expected) {
+				t.Errorf("checkHealth() = %v, expected %v", err, test.expected)
+			}
+		})
+	}
+}
+
+func TestPgOutputDecoderStreamQueueSizes(t *testing.T) {
+	logger := zerolog.Nop()
+	decoder := NewPgOutputDecoder()
+	if err := decoder.Init(&flash.ClientConfig{Logger: &logger}); err != nil {
+		t.Fatal(err)
+	}
+
+	relation := testMessage{'R'}.uint32(7).uint32(1).string("public").string("posts").uint8('f').uint16(1).
+		uint8(1).string("id").uint32(pgtype.Int4OID).uint32(0xFFFFFFFF)
+	insert := testMessage{'I'}.uint32(7).uint32(1).uint8('N').uint16(1).uint8('t').uint32(1).uint8('1')
+
+	messages := []struct {
+		data     testMessage
+		expected map[uint32]int
+	}{
+		{testMessage{'S'}.uint32(7).uint8(1), map[uint32]int{}},
+		{relation, map[uint32]int{}},
+		{insert, map[uint32]int{7: 1}},
+		{insert, map[uint32]int{7: 2}},
+		{testMessage{'E'}, map[uint32]int{7: 2}},
+		{testMessage{'A'}.uint32(7).uint32(7), map[uint32]int{}},
+	}
+
+	for i, message := range messages {
+		if _, err := decoder.Decode(&pglogrepl.XLogData{WALData: message.data}, func(change *Change) error {
+			t.Errorf("message %d: unexpected change %+v", i, change)
+			return nil
+		}); err != nil {
+			t.Fatalf("message %d: Decode() returned an error: %v", i, err)
+		}
+		if sizes := decoder.StreamQueueSizes(); !reflect.DeepEqual(sizes, message.expected) {
+			t.Errorf("message %d: StreamQueueSizes() = %v, expected %v", i, sizes, message.expected)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package wal_logical
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/quix-labs/flash"
+	"strings"
+)
+
+// ToastStrategy defines how unchanged TOAST columns of updated rows are resolved.
+// PostgreSQL does not send them in the replication stream, unless they are part of the replica identity.
+type ToastStrategy uint8
+
+const (
+	ToastCarryOver ToastStrategy = iota // Copy the value from the old row, which is complete with REPLICA IDENTITY FULL
+	ToastFetch                          // Same as ToastCarryOver, missing values are queried using the primary key
+	ToastSentinel                       // Keep flash.Unchanged as value
+)
+
+type keyColumn struct {
+	name    string
+	typeOid uint32
+}
+
+// resolveUnchanged replaces flash.Unchanged values of the new row according to Config.ToastStrategy
+func (d *Driver) resolveUnchanged(change *Change) error {
+	if change.Operation != flash.OperationUpdate || !hasUnchanged(change.New) {
+		return nil
+	}
+
+	switch d.Config.ToastStrategy {
+	case ToastCarryOver:
+		change.New = carryOverUnchanged(change.Old, change.New)
+	case ToastFetch:
+		change.New = carryOverUnchanged(change.Old, change.New)
+		if hasUnchanged(change.New) {
+			return d.fetchUnchanged(change.Table, change.New)
+		}
+	}
+	return nil
+}
+
+// fetchUnchanged queries the current value of unchanged columns, values are kept as flash.Unchanged
+// if the table has no primary key or if the row no longer exists
+func (d *Driver) fetchUnchanged(tableName string, data *flash.EventData) error {
+	keys, err := d.getPrimaryKey(tableName)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		d._clientConfig.Logger.Debug().Str("table", tableName).Msg("cannot fetch unchanged values without primary key")
+		return nil
+	}
+
+	var columns []string
+	for column, value := range *data {
+		if value == flash.Unchanged {
+			columns = append(columns, column)
+		}
+	}
+
+	conditions := make([]string, len(keys))
+	params := make([][]byte, len(keys))
+	paramOids := make([]uint32, len(keys))
+	for i, key := range keys {
+		value, exists := (*data)[key.name]
+		if !exists || value == flash.Unchanged {
+			return nil
+		}
+		if text, isText := value.(string); isText {
+			params[i] = []byte(text) // Already the text representation, e.g: numeric, uuid
+		} else if params[i], err = d.typeMap.Encode(key.typeOid, pgtype.TextFormatCode, value, nil); err != nil {
+			return err
+		}
+		paramOids[i] = key.typeOid
+		conditions[i] = fmt.Sprintf(`%s = $%d`, quoteIdentifier(key.name), i+1)
+	}
+
+	quotedColumns := make([]string, len(columns))
+	for i, column := range columns {
+		quotedColumns[i] = quoteIdentifier(column)
+	}
+	query := fmt.Sprintf(`SELECT %s FROM %s WHERE %s;`,
+		strings.Join(quotedColumns, ", "),
+		d.sanitizeTableName(tableName, true),
+		strings.Join(conditions, " AND "),
+	)
+
+	conn, err := d.getFetchConn()
+	if err != nil {
+		return err
+	}
+	d._clientConfig.Logger.Trace().Str("query", query).Msg("fetching unchanged values")
+	result := conn.ExecParams(context.Background(), query, params, paramOids, nil, nil).Read()
+	if result.Err != nil {
+		return result.Err
+	}
+	if len(result.Rows) == 0 {
+		return nil // Deleted since, keep sentinel
+	}
+
+	for i, field := range result.FieldDescriptions {
+		if result.Rows[0][i] == nil {
+			(*data)[columns[i]] = nil
+			continue
+		}
+		value, err := decodeTextColumnData(d._clientConfig.Types, result.Rows[0][i], field.DataTypeOID)
+		if err != nil {
+			return err
+		}
+		(*data)[columns[i]] = value
+	}
+	return nil
+}
+
+func (d *Driver) getPrimaryKey(tableName string) ([]*keyColumn, error) {
+	if keys, exists := d.primaryKeys[tableName]; exists {
+		return keys, nil
+	}
+
+	conn, err := d.getFetchConn()
+	if err != nil {
+		return nil, err
+	}
+	results, err := d.sqlExec(conn, fmt.Sprintf(`SELECT a.attname, a.atttypid FROM pg_index i
+		JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+		WHERE i.indrelid = %s::regclass AND i.indisprimary;`, quoteLiteral(d.sanitizeTableName(tableName, true))))
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, errors.New("no result for primary key query")
+	}
+
+	var keys []*keyColumn
+	for _, row := range results[0].Rows {
+		var typeOid uint32
+		if _, err := fmt.Sscan(string(row[1]), &typeOid); err != nil {
+			return nil, err
+		}
+		keys = append(keys, &keyColumn{name: string(row[0]), typeOid: typeOid})
+	}
+	d.primaryKeys[tableName] = keys
+	return keys, nil
+}
+
+// getFetchConn lazily creates a dedicated connection, only used by the replication goroutine
+func (d *Driver) getFetchConn() (*pgconn.PgConn, error) {
+	if d.fetchConn != nil {
+		return d.fetchConn, nil
+	}
+	config, err := pgconn.ParseConfig(d._clientConfig.DatabaseCnx)
+	if err != nil {
+		return nil, err
+	}
+	config.RuntimeParams["application_name"] = "Flash: replication (fetching)"
+	if d.fetchConn, err = pgconn.ConnectConfig(context.Background(), config); err != nil {
+		return nil, err
+	}
+	return d.fetchConn, nil
+}
+
+func (d *Driver) closeFetching() error {
+	if d.fetchConn == nil {
+		return nil
+	}
+	err := d.fetchConn.Close(context.Background())
+	d.fetchConn = nil
+	return err
+}
+
+func hasUnchanged(data *flash.EventData) bool {
+	if data == nil {
+		return false
+	}
+	for _, value := range *data {
+		if value == flash.Unchanged {
+			return true
+		}
+	}
+	return false
+}
+
+// carryOverUnchanged returns a copy of newData where unchanged values are taken from oldData when known
+func carryOverUnchanged(oldData *flash.EventData, newData *flash.EventData) *flash.EventData {
+	if newData == nil || oldData == nil {
+		return newData
+	}
+	resolved := make(flash.EventData, len(*newData))
+	for column, value := range *newData {
+		if oldValue, exists := (*oldData)[column]; exists && value == flash.Unchanged {
+			value = oldValue
+		}
+		resolved[column] = value
+	}
+	return &resolved
+}
+
+func quoteIdentifier(identifier string) string {
+	return `"` + strings.ReplaceAll(identifier, `"`, `""`) + `"`
+}
@@ -0,0 +1,39 @@
+package wal_logical
+
+import (
+	"github.com/quix-labs/flash"
+	"reflect"
+	"testing"
+)
+
+func TestResolveUnchanged(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy ToastStrategy
+		old      *flash.EventData
+		expected *flash.EventData
+	}{
+		{"CarryOver", ToastCarryOver, &flash.EventData{"id": 1, "content": "long"}, &flash.EventData{"id": 2, "content": "long"}},
+		{"CarryOver without old value", ToastCarryOver, &flash.EventData{"id": 1}, &flash.EventData{"id": 2, "content": flash.Unchanged}},
+		{"CarryOver without old row", ToastCarryOver, nil, &flash.EventData{"id": 2, "content": flash.Unchanged}},
+		{"Sentinel", ToastSentinel, &flash.EventData{"id": 1, "content": "long"}, &flash.EventData{"id": 2, "content": flash.Unchanged}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			driver := NewDriver(&DriverConfig{ToastStrategy: test.strategy})
+			change := &Change{
+				Operation: flash.OperationUpdate,
+				Table:     "public.posts",
+				Old:       test.old,
+				New:       &flash.EventData{"id": 2, "content": flash.Unchanged},
+			}
+			if err := driver.resolveUnchanged(change); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(change.New, test.expected) {
+				t.Errorf("resolveUnchanged() = %+v, expected %+v", change.New, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package wal_logical
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pglogrepl"
+	"github.com/quix-labs/flash"
+)
+
+var (
+	_ OutputDecoder = (*Wal2JsonDecoder)(nil) // Interface implementation
+)
+
+// Wal2JsonDecoder decodes the JSON output of the wal2json plugin (format-version 2)
+type Wal2JsonDecoder struct {
+	_clientConfig *flash.ClientConfig
+}
+
+type wal2JsonColumn struct {
+	Name    string          `json:"name"`
+	Type    string          `json:"type"`
+	TypeOid uint32          `json:"typeoid"`
+	Value   json.RawMessage `json:"value"`
+}
+
+type wal2JsonMessage struct {
+	Action   string            `json:"action"`
+	Schema   string            `json:"schema"`
+	Table    string            `json:"table"`
+	Columns  []*wal2JsonColumn `json:"columns"`
+	Identity []*wal2JsonColumn `json:"identity"`
+
+	// Logical decoding messages
+	Transactional bool   `json:"transactional"`
+	Prefix        string `json:"prefix"`
+	Content       string `json:"content"`
+}
+
+func NewWal2JsonDecoder() *Wal2JsonDecoder {
+	return &Wal2JsonDecoder{}
+}
+
+func (w *Wal2JsonDecoder) Init(clientConfig *flash.ClientConfig) error {
+	w._clientConfig = clientConfig
+	return nil
+}
+
+func (w *Wal2JsonDecoder) PluginName() string {
+	return "wal2json"
+}
+
+func (w *Wal2JsonDecoder) PluginArgs(_ *PluginOptions) []string {
+	// All tables are decoded, so tables can be listened at runtime without restart.
+	// Changes of other tables are ignored by the driver.
+	return []string{
+		"\"format-version\" '2'",
+		"\"include-types\" 'true'",
+		"\"include-type-oids\" 'true'",
+		"\"include-transaction\" 'true'",
+	}
+}
+
+func (w *Wal2JsonDecoder) Decode(xld *pglogrepl.XLogData, handle ChangeHandler) (bool, error) {
+	var msg wal2JsonMessage
+	if err := json.Unmarshal(xld.WALData, &msg); err != nil {
+		return false, err
+	}
+
+	tableName := msg.Schema + "." + msg.Table
+	switch msg.Action {
+	case "B": // Begin
+	case "C": // Commit
+		return true, nil
+
+	case "I":
+		newData, err := w.parseColumns(msg.Columns)
+		if err != nil {
+			return false, err
+		}
+		return false, handle(&Change{Operation: flash.OperationInsert, Table: tableName, New: newData})
+
+	case "U":
+		newData, err := w.parseColumns(msg.Columns)
+		if err != nil {
+			return false, err
+		}
+		oldData, err := w.parseColumns(msg.Identity)
+		if err != nil {
+			return false, err
+		}
+		// Unchanged TOAST columns are omitted, mark columns only known from the identity
+		if newData != nil && oldData != nil {
+			for column := range *oldData {
+				if _, exists := (*newData)[column]; !exists {
+					(*newData)[column] = flash.Unchanged
+				}
+			}
+		}
+		return false, handle(&Change{Operation: flash.OperationUpdate, Table: tableName, Old: oldData, New: newData})
+
+	case "D":
+		oldData, err := w.parseColumns(msg.Identity)
+		if err != nil {
+			return false, err
+		}
+		return false, handle(&Change{Operation: flash.OperationDelete, Table: tableName, Old: oldData})
+
+	case "T":
+		return false, handle(&Change{Operation: flash.OperationTruncate, Table: tableName})
+
+	case "M":
+		w._clientConfig.Logger.Trace().Msgf("Logical decoding message: %s", xld.WALData)
+		return false, handle(&Change{Operation: flash.OperationMessage, Message: &flash.MessageEvent{
+			Prefix:        msg.Prefix,
+			Content:       []byte(msg.Content),
+			Transactional: msg.Transactional,
+			LSN:           uint64(xld.WALStart),
+		}})
+
+	default:
+		w._clientConfig.Logger.Trace().Msgf("Unknown action in wal2json stream: %q", msg.Action)
+	}
+
+	return false, nil
+}
+
+func (w *Wal2JsonDecoder) parseColumns(columns []*wal2JsonColumn) (*flash.EventData, error) {
+	if len(columns) == 0 {
+		return nil, nil
+	}
+	values := flash.EventData{}
+	for _, column := range columns {
+		val, err := w.decodeColumnValue(column)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode column %s: %w", column.Name, err)
+		}
+		values[column.Name] = val
+	}
+	return &values, nil
+}
+
+// decodeColumnValue converts the JSON representation back to the text format, then decodes it like pgoutput does
+func (w *Wal2JsonDecoder) decodeColumnValue(column *wal2JsonColumn) (any, error) {
+	if len(column.Value) == 0 || string(column.Value) == "null" {
+		return nil, nil
+	}
+
+	// Numbers and booleans are sent unquoted, other types are quoted using their text representation
+	textValue := []byte(column.Value)
+	if column.Value[0] == '"' {
+		var str string
+		if err := json.Unmarshal(column.Value, &str); err != nil {
+			return nil, err
+		}
+		textValue = []byte(str)
+	}
+
+	return decodeTextColumnData(w._clientConfig.Types, textValue, column.TypeOid)
+}
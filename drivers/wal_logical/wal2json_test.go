@@ -0,0 +1,92 @@
+package wal_logical
+
+import (
+	"github.com/jackc/pglogrepl"
+	"github.com/quix-labs/flash"
+	"github.com/rs/zerolog"
+	"reflect"
+	"testing"
+)
+
+func TestWal2JsonDecoder(t *testing.T) {
+	logger := zerolog.Nop()
+	decoder := NewWal2JsonDecoder()
+	if err := decoder.Init(&flash.ClientConfig{Logger: &logger}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		data     string
+		flush    bool
+		expected *Change
+	}{
+		{"Begin", `{"action":"B"}`, false, nil},
+		{"Commit", `{"action":"C"}`, true, nil},
+		{
+			"Insert",
+			`{"action":"I","schema":"public","table":"posts","columns":[{"name":"id","type":"integer","typeoid":23,"value":1},{"name":"slug","type":"character varying(255)","typeoid":1043,"value":"slug1"},{"name":"active","type":"boolean","typeoid":16,"value":true}]}`,
+			false,
+			&Change{Operation: flash.OperationInsert, Table: "public.posts", New: &flash.EventData{"id": int64(1), "slug": "slug1", "active": true}},
+		},
+		{
+			"Update",
+			`{"action":"U","schema":"public","table":"posts","columns":[{"name":"id","type":"integer","typeoid":23,"value":1},{"name":"slug","type":"character varying(255)","typeoid":1043,"value":null}],"identity":[{"name":"id","type":"integer","typeoid":23,"value":1},{"name":"slug","type":"character varying(255)","typeoid":1043,"value":"slug1"}]}`,
+			false,
+			&Change{Operation: flash.OperationUpdate, Table: "public.posts", Old: &flash.EventData{"id": int64(1), "slug": "slug1"}, New: &flash.EventData{"id": int64(1), "slug": nil}},
+		},
+		{
+			"Update unchanged TOAST",
+			`{"action":"U","schema":"public","table":"posts","columns":[{"name":"id","type":"integer","typeoid":23,"value":1}],"identity":[{"name":"id","type":"integer","typeoid":23,"value":1},{"name":"content","type":"text","typeoid":25,"value":"long"}]}`,
+			false,
+			&Change{Operation: flash.OperationUpdate, Table: "public.posts", Old: &flash.EventData{"id": int64(1), "content": "long"}, New: &flash.EventData{"id": int64(1), "content": flash.Unchanged}},
+		},
+		{
+			"Delete",
+			`{"action":"D","schema":"public","table":"posts","identity":[{"name":"id","type":"integer","typeoid":23,"value":1}]}`,
+			false,
+			&Change{Operation: flash.OperationDelete, Table: "public.posts", Old: &flash.EventData{"id": int64(1)}},
+		},
+		{
+			"Truncate",
+			`{"action":"T","schema":"public","table":"posts"}`,
+			false,
+			&Change{Operation: flash.OperationTruncate, Table: "public.posts"},
+		},
+		{
+			"Message",
+			`{"action":"M","transactional":true,"prefix":"invoices","content":"{\"id\":1}"}`,
+			false,
+			&Change{Operation: flash.OperationMessage, Message: &flash.MessageEvent{Prefix: "invoices", Content: []byte(`{"id":1}`), Transactional: true}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var changes []*Change
+			flush, err := decoder.Decode(&pglogrepl.XLogData{WALData: []byte(test.data)}, func(change *Change) error {
+				changes = append(changes, change)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Decode() returned an error: %v", err)
+			}
+			if flush != test.flush {
+				t.Errorf("Decode() flush = %v, expected %v", flush, test.flush)
+			}
+
+			if test.expected == nil {
+				if len(changes) != 0 {
+					t.Errorf("Decode() expected no changes, got %d", len(changes))
+				}
+				return
+			}
+			if len(changes) != 1 {
+				t.Fatalf("Decode() expected 1 change, got %d", len(changes))
+			}
+			if !reflect.DeepEqual(changes[0], test.expected) {
+				t.Errorf("Decode() = %+v, expected %+v", changes[0], test.expected)
+			}
+		})
+	}
+}
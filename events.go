@@ -1,21 +1,50 @@
 package flash
 
+import "encoding/json"
+
 type EventData map[string]any
 type Event interface {
 	GetOperation() Operation
 }
 
+// Row events - Prepared is the global identifier of the prepared transaction when the event is delivered
+// at prepare time, empty otherwise. Its outcome is notified using LifecycleTransactionCommitted or LifecycleTransactionRolledBack.
 type InsertEvent struct {
-	New *EventData
+	New      *EventData
+	Prepared string
 }
 type UpdateEvent struct {
-	Old *EventData
-	New *EventData
+	Old      *EventData
+	New      *EventData
+	Prepared string
 }
 type DeleteEvent struct {
-	Old *EventData
+	Old      *EventData
+	Prepared string
+}
+type TruncateEvent struct {
+	Prepared string
+}
+
+// MessageEvent is a logical decoding message sent using pg_logical_emit_message, see NewMessageListener
+type MessageEvent struct {
+	Prefix        string
+	Content       []byte
+	Transactional bool   // Transactional messages are delivered on commit, in order with row changes
+	LSN           uint64 // Position of the message in the WAL
+	Prepared      string
+}
+
+// NotificationEvent is a notification sent using NOTIFY or pg_notify on a custom channel, see NewChannelListener
+type NotificationEvent struct {
+	Channel string
+	Payload string // Raw payload, see DecodePayload
+}
+
+// DecodePayload decodes the JSON payload into v
+func (e *NotificationEvent) DecodePayload(v any) error {
+	return json.Unmarshal([]byte(e.Payload), v)
 }
-type TruncateEvent struct{}
 
 func (e *InsertEvent) GetOperation() Operation {
 	return OperationInsert
@@ -29,3 +58,20 @@ func (e *DeleteEvent) GetOperation() Operation {
 func (e *TruncateEvent) GetOperation() Operation {
 	return OperationTruncate
 }
+func (e *MessageEvent) GetOperation() Operation {
+	return OperationMessage
+}
+func (e *NotificationEvent) GetOperation() Operation {
+	return OperationNotification
+}
+
+// Unchanged is set as column value when the database did not send it because it was not modified.
+// e.g: unchanged TOAST columns in wal_logical, see its ToastStrategy option.
+// Use value == flash.Unchanged to distinguish it from NULL.
+var Unchanged = unchangedValue{}
+
+type unchangedValue struct{}
+
+func (unchangedValue) String() string {
+	return "<unchanged>"
+}
@@ -0,0 +1,330 @@
+package flashtest
+
+import (
+	"errors"
+	"github.com/quix-labs/flash"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+type CallType uint8
+
+const (
+	CallListenStart CallType = iota + 1
+	CallListenStop
+)
+
+// Call is a recorded HandleOperationListenStart/HandleOperationListenStop invocation
+type Call struct {
+	Type           CallType
+	ListenerUid    string
+	ListenerConfig *flash.ListenerConfig
+	Operation      flash.Operation
+}
+
+type activeListener struct {
+	config     *flash.ListenerConfig
+	operations flash.Operation // Use bitwise comparison to check for listened events
+}
+
+var (
+	_ flash.Driver = (*Driver)(nil) // Interface implementation
+)
+
+// Driver is an in-memory flash.Driver, events are injected manually using Insert, Update, Delete and Truncate
+type Driver struct {
+	sync.Mutex
+
+	calls           []*Call
+	callsSignal     chan struct{}
+	activeListeners map[string]*activeListener // key: listenerUid
+
+	eventsChan *flash.DatabaseEventsChan
+	listening  chan struct{}
+	shutdown   chan struct{}
+}
+
+func NewDriver() *Driver {
+	return &Driver{
+		callsSignal:     make(chan struct{}),
+		activeListeners: make(map[string]*activeListener),
+		listening:       make(chan struct{}),
+		shutdown:        make(chan struct{}),
+	}
+}
+
+func (d *Driver) Init(_ *flash.ClientConfig) error {
+	return nil
+}
+
+func (d *Driver) HandleOperationListenStart(listenerUid string, listenerConfig *flash.ListenerConfig, operation flash.Operation) error {
+	d.Lock()
+	defer d.Unlock()
+
+	if _, exists := d.activeListeners[listenerUid]; !exists {
+		d.activeListeners[listenerUid] = &activeListener{config: listenerConfig}
+	}
+	d.activeListeners[listenerUid].operations |= operation
+
+	d.recordCall(&Call{Type: CallListenStart, ListenerUid: listenerUid, ListenerConfig: listenerConfig, Operation: operation})
+	return nil
+}
+
+func (d *Driver) HandleOperationListenStop(listenerUid string, listenerConfig *flash.ListenerConfig, operation flash.Operation) error {
+	d.Lock()
+	defer d.Unlock()
+
+	if listener, exists := d.activeListeners[listenerUid]; exists {
+		listener.operations &= ^operation
+		if listener.operations == 0 {
+			delete(d.activeListeners, listenerUid)
+		}
+	}
+
+	d.recordCall(&Call{Type: CallListenStop, ListenerUid: listenerUid, ListenerConfig: listenerConfig, Operation: operation})
+	return nil
+}
+
+func (d *Driver) Listen(eventsChan *flash.DatabaseEventsChan) error {
+	d.Lock()
+	d.eventsChan = eventsChan
+	select {
+	case <-d.listening:
+	default:
+		close(d.listening)
+	}
+	d.Unlock()
+
+	<-d.shutdown
+	return nil
+}
+
+func (d *Driver) Close() error {
+	d.Lock()
+	defer d.Unlock()
+
+	select {
+	case <-d.shutdown:
+	default:
+		close(d.shutdown)
+	}
+	return nil
+}
+
+// Calls returns a copy of all recorded calls, in order
+func (d *Driver) Calls() []*Call {
+	d.Lock()
+	defer d.Unlock()
+
+	calls := make([]*Call, len(d.calls))
+	copy(calls, d.calls)
+	return calls
+}
+
+// IsListening checks if at least one listener listens for the operation on the table
+func (d *Driver) IsListening(table string, operation flash.Operation) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	for _, listener := range d.activeListeners {
+		if sanitizeTableName(listener.config.Table) == sanitizeTableName(table) && listener.operations.IncludeAll(operation) {
+			return true
+		}
+	}
+	return false
+}
+
+// Insert injects an insert event for the table, blocks until the driver is listening
+func (d *Driver) Insert(table string, newData flash.EventData) error {
+	return d.inject(table, flash.OperationInsert, nil, &newData)
+}
+
+// Update injects an update event for the table, blocks until the driver is listening
+func (d *Driver) Update(table string, oldData flash.EventData, newData flash.EventData) error {
+	return d.inject(table, flash.OperationUpdate, &oldData, &newData)
+}
+
+// Delete injects a delete event for the table, blocks until the driver is listening
+func (d *Driver) Delete(table string, oldData flash.EventData) error {
+	return d.inject(table, flash.OperationDelete, &oldData, nil)
+}
+
+// Truncate injects a truncate event for the table, blocks until the driver is listening
+func (d *Driver) Truncate(table string) error {
+	return d.inject(table, flash.OperationTruncate, nil, nil)
+}
+
+// Message injects a transactional logical decoding message for listeners created using flash.NewMessageListener,
+// blocks until the driver is listening
+func (d *Driver) Message(prefix string, content []byte) error {
+	message := &flash.MessageEvent{Prefix: prefix, Content: content, Transactional: true}
+
+	d.Lock()
+	var events []*flash.DatabaseEvent
+	for listenerUid, listener := range d.activeListeners {
+		if listener.config.MessagePrefix == prefix && listener.operations.IncludeOne(flash.OperationMessage) {
+			events = append(events, &flash.DatabaseEvent{ListenerUid: listenerUid, Event: message})
+		}
+	}
+	d.Unlock()
+
+	return d.send(events)
+}
+
+// Notify injects a notification for listeners created using flash.NewChannelListener, blocks until the driver is listening
+func (d *Driver) Notify(channel string, payload string) error {
+	notification := &flash.NotificationEvent{Channel: channel, Payload: payload}
+
+	d.Lock()
+	var events []*flash.DatabaseEvent
+	for listenerUid, listener := range d.activeListeners {
+		if listener.config.Channel == channel && listener.operations.IncludeOne(flash.OperationNotification) {
+			events = append(events, &flash.DatabaseEvent{ListenerUid: listenerUid, Event: notification})
+		}
+	}
+	d.Unlock()
+
+	return d.send(events)
+}
+
+func (d *Driver) inject(table string, operation flash.Operation, oldData *flash.EventData, newData *flash.EventData) error {
+	return d.send(d.buildEvents(sanitizeTableName(table), operation, oldData, newData))
+}
+
+func (d *Driver) send(events []*flash.DatabaseEvent) error {
+	select {
+	case <-d.listening:
+	case <-d.shutdown:
+		return errors.New("driver closed")
+	}
+
+	for _, event := range events {
+		select {
+		case *d.eventsChan <- event:
+		case <-d.shutdown:
+			return errors.New("driver closed")
+		}
+	}
+	return nil
+}
+
+// buildEvents applies Fields/Conditions with the same semantics as the database drivers
+func (d *Driver) buildEvents(table string, operation flash.Operation, oldData *flash.EventData, newData *flash.EventData) []*flash.DatabaseEvent {
+	d.Lock()
+	defer d.Unlock()
+
+	var events []*flash.DatabaseEvent
+	for listenerUid, listener := range d.activeListeners {
+		if sanitizeTableName(listener.config.Table) != table || !listener.operations.IncludeAll(operation) {
+			continue
+		}
+		config := listener.config
+
+		switch operation {
+		case flash.OperationInsert:
+			if !config.IncludesRow(newData) || !checkConditions(newData, config.Conditions) {
+				continue
+			}
+			events = append(events, &flash.DatabaseEvent{
+				ListenerUid: listenerUid,
+				Event:       &flash.InsertEvent{New: extractFields(newData, config.Fields)},
+			})
+
+		case flash.OperationUpdate:
+			if !config.IncludesRow(newData) {
+				continue
+			}
+			if len(config.Conditions) > 0 {
+				oldRespectConditions := checkConditions(oldData, config.Conditions)
+				newRespectConditions := checkConditions(newData, config.Conditions)
+				if !oldRespectConditions && !newRespectConditions {
+					continue
+				}
+				if !oldRespectConditions && newRespectConditions {
+					events = append(events, &flash.DatabaseEvent{
+						ListenerUid: listenerUid,
+						Event:       &flash.InsertEvent{New: extractFields(newData, config.Fields)},
+					})
+					continue
+				}
+				if oldRespectConditions && !newRespectConditions {
+					events = append(events, &flash.DatabaseEvent{
+						ListenerUid: listenerUid,
+						Event:       &flash.DeleteEvent{Old: extractFields(oldData, config.Fields)},
+					})
+					continue
+				}
+			}
+
+			reducedOldData := extractFields(oldData, config.Fields)
+			reducedNewData := extractFields(newData, config.Fields)
+			if reflect.DeepEqual(reducedOldData, reducedNewData) {
+				continue // Ignore operation if update is not in listener fields
+			}
+			events = append(events, &flash.DatabaseEvent{
+				ListenerUid: listenerUid,
+				Event:       &flash.UpdateEvent{Old: reducedOldData, New: reducedNewData},
+			})
+
+		case flash.OperationDelete:
+			if !config.IncludesRow(oldData) || !checkConditions(oldData, config.Conditions) {
+				continue
+			}
+			events = append(events, &flash.DatabaseEvent{
+				ListenerUid: listenerUid,
+				Event:       &flash.DeleteEvent{Old: extractFields(oldData, config.Fields)},
+			})
+
+		case flash.OperationTruncate:
+			events = append(events, &flash.DatabaseEvent{
+				ListenerUid: listenerUid,
+				Event:       &flash.TruncateEvent{},
+			})
+		}
+	}
+	return events
+}
+
+func (d *Driver) recordCall(call *Call) {
+	d.calls = append(d.calls, call)
+
+	// Wake up all waiters
+	close(d.callsSignal)
+	d.callsSignal = make(chan struct{})
+}
+
+func extractFields(data *flash.EventData, fields []string) *flash.EventData {
+	if len(fields) == 0 || data == nil { // Empty same as SELECT *
+		return data
+	}
+
+	reducedData := flash.EventData{}
+	for _, field := range fields {
+		reducedData[field] = (*data)[field]
+	}
+	return &reducedData
+}
+
+func checkConditions(data *flash.EventData, conditions []*flash.ListenerCondition) bool {
+	for _, condition := range conditions {
+		if data == nil {
+			return false
+		}
+		if !flash.ValuesEqual((*data)[condition.Column], condition.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns tablename as format public.posts.
+// posts -> public.posts
+// "stats"."name" -> stats.name
+func sanitizeTableName(tableName string) string {
+	splits := strings.Split(strings.ReplaceAll(tableName, `"`, ""), ".")
+	if len(splits) == 1 {
+		splits = []string{"public", splits[0]}
+	}
+	return strings.Join(splits, ".")
+}
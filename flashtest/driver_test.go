@@ -0,0 +1,172 @@
+package flashtest
+
+import (
+	"github.com/quix-labs/flash"
+	"github.com/rs/zerolog"
+	"testing"
+	"time"
+)
+
+func startClient(t *testing.T, listeners ...*flash.Listener) *Driver {
+	driver := NewDriver()
+	logger := zerolog.Nop()
+	client, err := flash.NewClient(&flash.ClientConfig{
+		DatabaseCnx: "in-memory",
+		Driver:      driver,
+		Logger:      &logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Attach(listeners...)
+	go func() {
+		_ = client.Start()
+	}()
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	return driver
+}
+
+func TestDriverRecordsCalls(t *testing.T) {
+	listener, _ := flash.NewListener(&flash.ListenerConfig{Table: "posts"})
+	stop, err := listener.On(flash.OperationInsert|flash.OperationDelete, func(event flash.Event) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	driver := startClient(t, listener)
+	WaitForListening(t, driver, "posts", flash.OperationInsert|flash.OperationDelete, time.Second)
+
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := driver.Calls()
+	expected := []struct {
+		callType  CallType
+		operation flash.Operation
+	}{
+		{CallListenStart, flash.OperationInsert},
+		{CallListenStart, flash.OperationDelete},
+		{CallListenStop, flash.OperationInsert},
+		{CallListenStop, flash.OperationDelete},
+	}
+	if len(calls) != len(expected) {
+		t.Fatalf("expected %d calls, got %d", len(expected), len(calls))
+	}
+	for i, call := range calls {
+		if call.Type != expected[i].callType || call.Operation != expected[i].operation {
+			t.Errorf("call %d: expected %d %s, got %d %s", i, expected[i].callType, expected[i].operation, call.Type, call.Operation)
+		}
+	}
+	if driver.IsListening("posts", flash.OperationInsert) {
+		t.Errorf("expected driver to stop listening")
+	}
+}
+
+func TestDriverInjectEvents(t *testing.T) {
+	listener, _ := flash.NewListener(&flash.ListenerConfig{Table: "public.posts"})
+	recorder := NewRecorder()
+	if _, err := listener.On(flash.OperationAll, recorder.Callback()); err != nil {
+		t.Fatal(err)
+	}
+
+	driver := startClient(t, listener)
+	WaitForListening(t, driver, "posts", flash.OperationAll, time.Second)
+
+	if err := driver.Insert("posts", flash.EventData{"id": 1}); err != nil {
+		t.Fatal(err)
+	}
+	event := WaitForEventOperation(t, recorder, flash.OperationInsert, time.Second)
+	if (*event.(*flash.InsertEvent).New)["id"] != 1 {
+		t.Errorf("unexpected insert data: %+v", event)
+	}
+
+	_ = driver.Update("posts", flash.EventData{"id": 1}, flash.EventData{"id": 2})
+	WaitForEventOperation(t, recorder, flash.OperationUpdate, time.Second)
+
+	_ = driver.Delete("posts", flash.EventData{"id": 2})
+	WaitForEventOperation(t, recorder, flash.OperationDelete, time.Second)
+
+	_ = driver.Truncate("posts")
+	WaitForEventOperation(t, recorder, flash.OperationTruncate, time.Second)
+
+	_ = driver.Insert("comments", flash.EventData{"id": 1})
+	AssertNoEvent(t, recorder, 100*time.Millisecond)
+}
+
+func TestDriverFieldsAndConditions(t *testing.T) {
+	listener, _ := flash.NewListener(&flash.ListenerConfig{
+		Table:      "posts",
+		Fields:     []string{"slug"},
+		Conditions: []*flash.ListenerCondition{{Column: "active", Value: true}},
+	})
+	recorder := NewRecorder()
+	if _, err := listener.On(flash.OperationAll, recorder.Callback()); err != nil {
+		t.Fatal(err)
+	}
+
+	driver := startClient(t, listener)
+	WaitForListening(t, driver, "posts", flash.OperationAll, time.Second)
+
+	// Not matching conditions
+	_ = driver.Insert("posts", flash.EventData{"slug": "a", "active": false})
+	AssertNoEvent(t, recorder, 100*time.Millisecond)
+
+	// Matching conditions, only listened fields are sent
+	_ = driver.Insert("posts", flash.EventData{"slug": "a", "active": true})
+	event := WaitForEventOperation(t, recorder, flash.OperationInsert, time.Second)
+	if len(*event.(*flash.InsertEvent).New) != 1 {
+		t.Errorf("expected only listened fields, got %+v", event.(*flash.InsertEvent).New)
+	}
+
+	// Update outside listened fields is ignored
+	_ = driver.Update("posts", flash.EventData{"slug": "a", "active": true, "id": 1}, flash.EventData{"slug": "a", "active": true, "id": 2})
+	AssertNoEvent(t, recorder, 100*time.Millisecond)
+
+	// Soft delete
+	_ = driver.Update("posts", flash.EventData{"slug": "a", "active": true}, flash.EventData{"slug": "a", "active": false})
+	WaitForEventOperation(t, recorder, flash.OperationDelete, time.Second)
+
+	// Soft restore
+	_ = driver.Update("posts", flash.EventData{"slug": "a", "active": false}, flash.EventData{"slug": "a", "active": true})
+	WaitForEventOperation(t, recorder, flash.OperationInsert, time.Second)
+}
+
+func TestDriverMessages(t *testing.T) {
+	listener, _ := flash.NewMessageListener("invoices")
+	recorder := NewRecorder()
+	if _, err := listener.On(flash.OperationMessage, recorder.Callback()); err != nil {
+		t.Fatal(err)
+	}
+
+	driver := startClient(t, listener)
+	WaitForListening(t, driver, "", flash.OperationMessage, time.Second)
+
+	_ = driver.Message("orders", []byte("ignored"))
+	AssertNoEvent(t, recorder, 100*time.Millisecond)
+
+	_ = driver.Message("invoices", []byte(`{"id":1}`))
+	event := WaitForEventOperation(t, recorder, flash.OperationMessage, time.Second)
+	if string(event.(*flash.MessageEvent).Content) != `{"id":1}` {
+		t.Errorf("unexpected message content: %+v", event)
+	}
+}
+
+func TestDriverNotifications(t *testing.T) {
+	listener, _ := flash.NewChannelListener("invoice_ready")
+	recorder := NewRecorder()
+	if _, err := listener.On(flash.OperationNotification, recorder.Callback()); err != nil {
+		t.Fatal(err)
+	}
+
+	driver := startClient(t, listener)
+	WaitForListening(t, driver, "", flash.OperationNotification, time.Second)
+
+	_ = driver.Notify("invoice_ready", `{"id":1}`)
+	event := WaitForEventOperation(t, recorder, flash.OperationNotification, time.Second)
+	if event.(*flash.NotificationEvent).Payload != `{"id":1}` {
+		t.Errorf("unexpected notification payload: %+v", event)
+	}
+}
@@ -0,0 +1,84 @@
+package flashtest
+
+import (
+	"github.com/quix-labs/flash"
+	"testing"
+	"time"
+)
+
+// Recorder collects events received by listener callbacks
+type Recorder struct {
+	events chan flash.Event
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{
+		events: make(chan flash.Event, 1024),
+	}
+}
+
+// Callback returns a callback usable with flash.Listener.On
+func (r *Recorder) Callback() flash.EventCallback {
+	return func(event flash.Event) {
+		r.events <- event
+	}
+}
+
+// WaitForEvent returns the next received event, fails the test if none is received before timeout
+func WaitForEvent(t testing.TB, r *Recorder, timeout time.Duration) flash.Event {
+	t.Helper()
+
+	select {
+	case event := <-r.events:
+		return event
+	case <-time.After(timeout):
+		t.Fatalf("no event received after %s", timeout)
+		return nil
+	}
+}
+
+// WaitForEventOperation returns the next received event, fails the test if none is received before timeout
+// or if the received event does not match the operation
+func WaitForEventOperation(t testing.TB, r *Recorder, operation flash.Operation, timeout time.Duration) flash.Event {
+	t.Helper()
+
+	event := WaitForEvent(t, r, timeout)
+	if event.GetOperation() != operation {
+		t.Fatalf("expected %s event, got %s", operation, event.GetOperation())
+	}
+	return event
+}
+
+// AssertNoEvent fails the test if an event is received during the given duration
+func AssertNoEvent(t testing.TB, r *Recorder, duration time.Duration) {
+	t.Helper()
+
+	select {
+	case event := <-r.events:
+		t.Fatalf("unexpected %s event received: %+v", event.GetOperation(), event)
+	case <-time.After(duration):
+	}
+}
+
+// WaitForListening blocks until a listener listens for the operation on the table, fails the test after timeout
+func WaitForListening(t testing.TB, d *Driver, table string, operation flash.Operation, timeout time.Duration) {
+	t.Helper()
+
+	deadline := time.After(timeout)
+	for {
+		d.Lock()
+		signal := d.callsSignal
+		d.Unlock()
+
+		if d.IsListening(table, operation) {
+			return
+		}
+
+		select {
+		case <-signal:
+		case <-deadline:
+			t.Fatalf("no listener for %s on %s after %s", operation, table, timeout)
+			return
+		}
+	}
+}
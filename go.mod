@@ -3,6 +3,7 @@ module github.com/quix-labs/flash
 go 1.21.6
 
 require (
+	github.com/lib/pq v1.10.9
 	github.com/rs/zerolog v1.33.0
 	github.com/testcontainers/testcontainers-go v0.32.0
 	github.com/testcontainers/testcontainers-go/modules/postgres v0.32.0
@@ -0,0 +1,121 @@
+package flash
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"time"
+)
+
+var ErrLeadershipLost = errors.New("leadership lost")
+
+type LeaderElectionConfig struct {
+	LockId        int64         // Advisory lock key, must be shared by all replicas consuming the same events
+	RetryInterval time.Duration // Default to 5 seconds -> delay between two attempts to acquire leadership, or to check it
+}
+
+// leaderElection holds a session-level advisory lock on a dedicated connection.
+// The lock is released by PostgreSQL as soon as the session dies, allowing a standby to take over.
+type leaderElection struct {
+	config       *LeaderElectionConfig
+	clientConfig *ClientConfig
+
+	db   *sql.DB
+	conn *sql.Conn
+}
+
+func newLeaderElection(clientConfig *ClientConfig) *leaderElection {
+	config := clientConfig.LeaderElection
+	if config.RetryInterval == time.Duration(0) {
+		config.RetryInterval = 5 * time.Second
+	}
+	return &leaderElection{
+		config:       config,
+		clientConfig: clientConfig,
+	}
+}
+
+// acquire blocks until this client becomes the leader, or the context is canceled
+func (e *leaderElection) acquire(ctx context.Context) error {
+	connector, err := pq.NewConnector(e.clientConfig.DatabaseCnx)
+	if err != nil {
+		return err
+	}
+	e.db = sql.OpenDB(connector)
+
+	for {
+		acquired, err := e.tryLock(ctx)
+		if err != nil {
+			e.clientConfig.Logger.Warn().Err(err).Msg("could not acquire leadership")
+		}
+		if acquired {
+			e.clientConfig.EmitLifecycleEvent(&LifecycleEvent{Type: LifecycleLeadershipAcquired})
+			return nil
+		}
+
+		e.clientConfig.Logger.Debug().Int64("lock", e.config.LockId).Msg("standing by, leadership held by another client")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(e.config.RetryInterval):
+		}
+	}
+}
+
+func (e *leaderElection) tryLock(ctx context.Context) (bool, error) {
+	if e.conn == nil {
+		conn, err := e.db.Conn(ctx)
+		if err != nil {
+			return false, err
+		}
+		e.conn = conn
+	}
+
+	var acquired bool
+	if err := e.conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, e.config.LockId).Scan(&acquired); err != nil {
+		// Session is unusable, use a new one on next attempt
+		_ = e.conn.Close()
+		e.conn = nil
+		return false, err
+	}
+	return acquired, nil
+}
+
+// watch checks periodically the session holding the lock, and sends ErrLeadershipLost when it dies
+func (e *leaderElection) watch(ctx context.Context, lostChan chan<- error) {
+	ticker := time.NewTicker(e.config.RetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.conn.PingContext(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				e.clientConfig.EmitLifecycleEvent(&LifecycleEvent{Type: LifecycleLeadershipLost, Err: err})
+				select {
+				case lostChan <- fmt.Errorf("%w: %w", ErrLeadershipLost, err):
+				case <-ctx.Done():
+				}
+				return
+			}
+		}
+	}
+}
+
+// release closes the session, PostgreSQL releases the lock
+func (e *leaderElection) release() error {
+	if e.conn != nil {
+		_ = e.conn.Close()
+		e.conn = nil
+	}
+	if e.db != nil {
+		return e.db.Close()
+	}
+	return nil
+}
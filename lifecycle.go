@@ -0,0 +1,63 @@
+package flash
+
+type LifecycleEventType uint8
+
+const (
+	LifecycleDisconnected          LifecycleEventType = iota + 1 // Connection to the database lost
+	LifecycleReconnected                                         // Connection to the database re-established
+	LifecycleGapDetected                                         // Some events may have been lost, a resync is advised
+	LifecycleLeadershipAcquired                                  // This client became the leader, see ClientConfig.LeaderElection
+	LifecycleLeadershipLost                                      // This client is no longer the leader, Start returns ErrLeadershipLost
+	LifecycleRebalanced                                          // Consumer group membership changed, listeners were reassigned
+	LifecycleTransactionCommitted                                // A prepared transaction, delivered at prepare time, was committed
+	LifecycleTransactionRolledBack                               // A prepared transaction, delivered at prepare time, was rolled back
+)
+
+func (t LifecycleEventType) String() string {
+	switch t {
+	case LifecycleDisconnected:
+		return "DISCONNECTED"
+	case LifecycleReconnected:
+		return "RECONNECTED"
+	case LifecycleGapDetected:
+		return "GAP_DETECTED"
+	case LifecycleLeadershipAcquired:
+		return "LEADERSHIP_ACQUIRED"
+	case LifecycleLeadershipLost:
+		return "LEADERSHIP_LOST"
+	case LifecycleRebalanced:
+		return "REBALANCED"
+	case LifecycleTransactionCommitted:
+		return "TRANSACTION_COMMITTED"
+	case LifecycleTransactionRolledBack:
+		return "TRANSACTION_ROLLED_BACK"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// LifecycleEvent is emitted on state changes which are not related to database rows
+type LifecycleEvent struct {
+	Type LifecycleEventType
+
+	ListenerUid string    // Empty when not related to a specific listener
+	Operation   Operation // Zero when not related to a specific operation
+	Err         error     // Cause of the event, if any
+
+	TransactionId string // Global identifier of the prepared transaction, see Prepared field of events
+}
+
+type LifecycleCallback func(event *LifecycleEvent)
+
+// EmitLifecycleEvent logs the event and forwards it to OnLifecycleEvent if defined
+func (c *ClientConfig) EmitLifecycleEvent(event *LifecycleEvent) {
+	logEvent := c.Logger.Debug()
+	if event.Err != nil {
+		logEvent = c.Logger.Warn().Err(event.Err)
+	}
+	logEvent.Str("type", event.Type.String()).Str("listener", event.ListenerUid).Str("transaction", event.TransactionId).Msg("lifecycle event")
+
+	if c.OnLifecycleEvent != nil {
+		c.OnLifecycleEvent(event)
+	}
+}
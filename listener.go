@@ -2,7 +2,14 @@ package flash
 
 import (
 	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // TODO SORTIR VERIFICATION AU NIVEAU LISTENER, PBM oblige à envoyer les columns dans l'event
@@ -18,6 +25,71 @@ type ListenerConfig struct {
 	MaxParallelProcess int      // Default to 1 (not parallel) -> use -1 for Infinity
 
 	Conditions []*ListenerCondition
+
+	MessagePrefix string // Set by NewMessageListener -> receives MessageEvent with this prefix instead of table events
+	Channel       string // Set by NewChannelListener -> receives NotificationEvent of this channel instead of table events
+
+	IgnoredOrigins  []string // Changes written by sessions using these replication origins are skipped (wal_logical only)
+	AcceptedOrigins []string // Default to all -> only changes of these replication origins are accepted, "" means no origin (wal_logical only)
+
+	PartitionKey string // Column used to split rows between consumer group members, see ClientConfig.ConsumerGroup
+	Partitions   int    // Default to 16 when PartitionKey is set -> number of row partitions
+
+	ownedPartitions atomic.Pointer[[]int] // Set by the client on rebalance while drivers read it, nil means all rows
+}
+
+// OwnedPartitions returns the row partitions handled by this client, nil when all rows are handled
+func (c *ListenerConfig) OwnedPartitions() []int {
+	if partitions := c.ownedPartitions.Load(); partitions != nil {
+		return *partitions
+	}
+	return nil
+}
+
+func (c *ListenerConfig) setOwnedPartitions(partitions []int) {
+	if partitions == nil {
+		c.ownedPartitions.Store(nil)
+		return
+	}
+	c.ownedPartitions.Store(&partitions)
+}
+
+// IncludesRow checks if the row belongs to a partition handled by this client, using PartitionOf
+func (c *ListenerConfig) IncludesRow(data *EventData) bool {
+	ownedPartitions := c.OwnedPartitions()
+	if c.PartitionKey == "" || ownedPartitions == nil {
+		return true
+	}
+	var value any
+	if data != nil {
+		value = (*data)[c.PartitionKey]
+	}
+	partition := PartitionOf(value, c.Partitions)
+	for _, owned := range ownedPartitions {
+		if owned == partition {
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptsOrigin checks the replication origin of a change against IgnoredOrigins and AcceptedOrigins,
+// origin is empty for changes written without pg_replication_origin_session_setup
+func (c *ListenerConfig) AcceptsOrigin(origin string) bool {
+	for _, ignored := range c.IgnoredOrigins {
+		if ignored == origin {
+			return false
+		}
+	}
+	if len(c.AcceptedOrigins) == 0 {
+		return true
+	}
+	for _, accepted := range c.AcceptedOrigins {
+		if accepted == origin {
+			return true
+		}
+	}
+	return false
 }
 
 type CreateEventCallback func(event Operation) error
@@ -46,6 +118,12 @@ func NewListener(config *ListenerConfig) (*Listener, error) {
 	if config.MaxParallelProcess == 0 {
 		config.MaxParallelProcess = 1
 	}
+	if config.PartitionKey != "" && config.Partitions == 0 {
+		config.Partitions = 16
+	}
+	if config.PartitionKey != "" && len(config.Fields) > 0 && !slices.Contains(config.Fields, config.PartitionKey) {
+		return nil, fmt.Errorf("partition key %s must be one of the fields", config.PartitionKey)
+	}
 
 	var semaphore chan struct{} = nil
 	if config.MaxParallelProcess != -1 {
@@ -59,12 +137,44 @@ func NewListener(config *ListenerConfig) (*Listener, error) {
 	}, nil
 }
 
+// NewMessageListener creates a listener for logical decoding messages sent using pg_logical_emit_message with this prefix.
+// Only OperationMessage can be listened, and only drivers based on logical replication support it.
+func NewMessageListener(prefix string) (*Listener, error) {
+	if prefix == "" {
+		return nil, errors.New("prefix cannot be empty")
+	}
+	return NewListener(&ListenerConfig{MessagePrefix: prefix})
+}
+
+// NewChannelListener creates a listener for notifications sent using NOTIFY or pg_notify on this channel.
+// Only OperationNotification can be listened, and only drivers based on LISTEN support it.
+func NewChannelListener(channel string) (*Listener, error) {
+	if channel == "" {
+		return nil, errors.New("channel cannot be empty")
+	}
+	return NewListener(&ListenerConfig{Channel: channel})
+}
+
+// listenableOperations returns operations accepted by On, depending on the listener type
+func (c *ListenerConfig) listenableOperations() Operation {
+	if c.MessagePrefix != "" {
+		return OperationMessage
+	}
+	if c.Channel != "" {
+		return OperationNotification
+	}
+	return OperationAll
+}
+
 /* Callback management */
 
 func (l *Listener) On(operation Operation, callback EventCallback) (func() error, error) {
 	if callback == nil {
 		return nil, errors.New("callback cannot be nil")
 	}
+	if listenable := l.Config.listenableOperations(); operation&^listenable != 0 {
+		return nil, fmt.Errorf("this listener can only listen to %s", listenable)
+	}
 
 	// TODO NOTIFY CLIENT FROM UPDATE BUT DO NOT SEND INSERT/DELETE
 	if err := l.addListenedEventIfNeeded(operation); err != nil {
@@ -119,7 +229,7 @@ func (l *Listener) Init(_createCallback CreateEventCallback, _deleteCallback Del
 	l._clientDeleteEventCallback = _deleteCallback
 
 	// Emit all events for initialization
-	for targetEvent := Operation(1); targetEvent != 0 && targetEvent <= OperationAll; targetEvent <<= 1 {
+	for targetEvent := Operation(1); targetEvent != 0 && targetEvent <= OperationNotification; targetEvent <<= 1 {
 		if l.listenedOperations&targetEvent == 0 {
 			continue
 		}
@@ -143,7 +253,7 @@ func (l *Listener) addListenedEventIfNeeded(event Operation) error {
 		return nil
 	}
 
-	for targetEvent := Operation(1); targetEvent != 0 && targetEvent <= OperationAll; targetEvent <<= 1 {
+	for targetEvent := Operation(1); targetEvent != 0 && targetEvent <= OperationNotification; targetEvent <<= 1 {
 		if targetEvent&diff == 0 || targetEvent&event == 0 {
 			continue
 		}
@@ -195,3 +305,46 @@ func (l *Listener) hasListenersForEvent(event Operation) bool {
 	}
 	return false
 }
+
+// ConditionsSql returns the SQL expression matching all conditions on the row reference, e.g: NEW.
+// Used by trigger based drivers, values are compared as decoded, see ValuesEqual.
+func ConditionsSql(conditions []*ListenerCondition, rowRef string) (string, error) {
+	rawConditions := make([]string, len(conditions))
+
+	for i, condition := range conditions {
+		operator := " IS "
+		valueRepr := ""
+
+		switch condition.Value.(type) {
+		case nil:
+			valueRepr = "NULL"
+		case bool:
+			if condition.Value.(bool) == true {
+				valueRepr = "TRUE"
+			} else {
+				valueRepr = "FALSE"
+			}
+		case string:
+			operator = " IS NOT DISTINCT FROM "
+			valueRepr = pq.QuoteLiteral(condition.Value.(string))
+		case time.Time:
+			// Same representation as decoded values, see ValuesEqual
+			operator = " IS NOT DISTINCT FROM "
+			valueRepr = pq.QuoteLiteral(condition.Value.(time.Time).Format(time.RFC3339Nano))
+		case float32:
+			operator = " IS NOT DISTINCT FROM "
+			valueRepr = strconv.FormatFloat(float64(condition.Value.(float32)), 'g', -1, 32)
+		case float64:
+			operator = " IS NOT DISTINCT FROM "
+			valueRepr = strconv.FormatFloat(condition.Value.(float64), 'g', -1, 64)
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+			operator = " IS NOT DISTINCT FROM "
+			valueRepr = fmt.Sprintf(`%d`, condition.Value)
+		default:
+			return "", errors.New("could not convert condition value to sql")
+		}
+
+		rawConditions[i] = fmt.Sprintf(`%s."%s"%s%s`, rowRef, condition.Column, operator, valueRepr)
+	}
+	return strings.Join(rawConditions, " AND "), nil
+}
@@ -0,0 +1,105 @@
+package flash
+
+import "testing"
+
+func TestMessageListenerOperations(t *testing.T) {
+	callback := func(event Event) {}
+
+	messageListener, err := NewMessageListener("invoices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := messageListener.On(OperationMessage, callback); err != nil {
+		t.Errorf("expected OperationMessage to be accepted, got %v", err)
+	}
+	if _, err := messageListener.On(OperationInsert, callback); err == nil {
+		t.Errorf("expected table operations to be rejected by message listeners")
+	}
+
+	tableListener, _ := NewListener(&ListenerConfig{Table: "posts"})
+	if _, err := tableListener.On(OperationAll|OperationMessage, callback); err == nil {
+		t.Errorf("expected OperationMessage to be rejected by table listeners")
+	}
+
+	if _, err := NewMessageListener(""); err == nil {
+		t.Errorf("expected empty prefix to be rejected")
+	}
+}
+
+func TestChannelListenerOperations(t *testing.T) {
+	callback := func(event Event) {}
+
+	channelListener, err := NewChannelListener("invoice_ready")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := channelListener.On(OperationNotification, callback); err != nil {
+		t.Errorf("expected OperationNotification to be accepted, got %v", err)
+	}
+	if _, err := channelListener.On(OperationMessage, callback); err == nil {
+		t.Errorf("expected OperationMessage to be rejected by channel listeners")
+	}
+
+	tableListener, _ := NewListener(&ListenerConfig{Table: "posts"})
+	if _, err := tableListener.On(OperationNotification, callback); err == nil {
+		t.Errorf("expected OperationNotification to be rejected by table listeners")
+	}
+}
+
+func TestNotificationEventDecodePayload(t *testing.T) {
+	event := &NotificationEvent{Channel: "invoice_ready", Payload: `{"id":1}`}
+
+	var payload struct {
+		Id int `json:"id"`
+	}
+	if err := event.DecodePayload(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Id != 1 {
+		t.Errorf("expected decoded id 1, got %d", payload.Id)
+	}
+}
+
+func TestAcceptsOrigin(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   *ListenerConfig
+		origin   string
+		expected bool
+	}{
+		{"No filter", &ListenerConfig{}, "sync_writer", true},
+		{"Ignored", &ListenerConfig{IgnoredOrigins: []string{"sync_writer"}}, "sync_writer", false},
+		{"Not ignored", &ListenerConfig{IgnoredOrigins: []string{"sync_writer"}}, "", true},
+		{"Accepted", &ListenerConfig{AcceptedOrigins: []string{"", "replica"}}, "replica", true},
+		{"Accepted local", &ListenerConfig{AcceptedOrigins: []string{""}}, "", true},
+		{"Not accepted", &ListenerConfig{AcceptedOrigins: []string{""}}, "sync_writer", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if accepted := test.config.AcceptsOrigin(test.origin); accepted != test.expected {
+				t.Errorf("AcceptsOrigin(%q) = %v, expected %v", test.origin, accepted, test.expected)
+			}
+		})
+	}
+}
+
+func TestConditionsSql(t *testing.T) {
+	conditions := []*ListenerCondition{
+		{Column: "deleted_at", Value: nil},
+		{Column: "active", Value: true},
+		{Column: "slug", Value: "o'neil"},
+		{Column: "stock", Value: 3},
+	}
+	conditionsSql, err := ConditionsSql(conditions, "NEW")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `NEW."deleted_at" IS NULL AND NEW."active" IS TRUE AND NEW."slug" IS NOT DISTINCT FROM 'o''neil' AND NEW."stock" IS NOT DISTINCT FROM 3`
+	if conditionsSql != expected {
+		t.Errorf("ConditionsSql() = %s, expected %s", conditionsSql, expected)
+	}
+
+	if _, err := ConditionsSql([]*ListenerCondition{{Column: "tags", Value: []string{"a"}}}, "NEW"); err == nil {
+		t.Error("expected unsupported condition value to be rejected")
+	}
+}
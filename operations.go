@@ -12,6 +12,8 @@ const (
 	OperationUpdate
 	OperationDelete
 	OperationTruncate
+	OperationMessage      // Logical decoding messages, not included in OperationAll - see NewMessageListener
+	OperationNotification // NOTIFY on custom channels, not included in OperationAll - see NewChannelListener
 )
 const (
 	OperationAll = OperationInsert | OperationUpdate | OperationDelete | OperationTruncate
@@ -21,12 +23,14 @@ func (o Operation) IsAtomic() bool {
 	return o == OperationInsert ||
 		o == OperationUpdate ||
 		o == OperationDelete ||
-		o == OperationTruncate
+		o == OperationTruncate ||
+		o == OperationMessage ||
+		o == OperationNotification
 }
 
 func (o Operation) GetAtomics() []Operation {
 	var operations []Operation
-	for mask := OperationInsert; mask != 0 && mask <= OperationTruncate; mask <<= 1 {
+	for mask := OperationInsert; mask != 0 && mask <= OperationNotification; mask <<= 1 {
 		if o&mask != 0 {
 			operations = append(operations, mask)
 		}
@@ -55,6 +59,10 @@ func (o Operation) StrictName() (string, error) {
 		return "DELETE", nil
 	case OperationTruncate:
 		return "TRUNCATE", nil
+	case OperationMessage:
+		return "MESSAGE", nil
+	case OperationNotification:
+		return "NOTIFICATION", nil
 	default:
 		return "UNKNOWN", errors.New("unknown operation")
 	}
@@ -88,6 +96,10 @@ func OperationFromName(name string) (Operation, error) {
 		return OperationDelete, nil
 	case "TRUNCATE":
 		return OperationTruncate, nil
+	case "MESSAGE":
+		return OperationMessage, nil
+	case "NOTIFICATION":
+		return OperationNotification, nil
 	default:
 		return 0, errors.New("unknown operation name")
 	}
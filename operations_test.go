@@ -9,8 +9,10 @@ func TestIsAtomic(t *testing.T) {
 		expected bool
 	}{
 		{"Atomic Operation", OperationTruncate, true},
+		{"Message Operation", OperationMessage, true},
+		{"Notification Operation", OperationNotification, true},
 		{"Composite Operation", OperationInsert | OperationUpdate, false},
-		{"Atomic But Invalid", 32, false},
+		{"Atomic But Invalid", 64, false},
 		{"Empty Operation", 0, false},
 	}
 
@@ -33,7 +35,7 @@ func TestGetAtomics(t *testing.T) {
 		{"Composite Operation", OperationInsert | OperationUpdate, []Operation{OperationInsert, OperationUpdate}},
 		{"Composite All Operation", OperationAll, []Operation{OperationInsert, OperationUpdate, OperationDelete, OperationTruncate}},
 		{"Empty Operation", 0, []Operation{}},
-		{"Unknown Atomic", 32, []Operation{}},
+		{"Unknown Atomic", 64, []Operation{}},
 	}
 
 	for _, test := range tests {
@@ -62,8 +64,8 @@ func TestIncludeAll(t *testing.T) {
 		{"IncludeAll - true", OperationInsert | OperationUpdate | OperationDelete, OperationInsert | OperationUpdate, true},
 		{"IncludeAll - false", OperationInsert | OperationUpdate, OperationInsert | OperationUpdate | OperationDelete, false},
 		{"IncludeAll - empty operation", 0, OperationAll, false},
-		{"IncludeAll - unknown", 32, OperationAll, false},
-		{"IncludeAll - unknown", OperationAll, 32, false},
+		{"IncludeAll - unknown", 64, OperationAll, false},
+		{"IncludeAll - unknown", OperationAll, 64, false},
 	}
 
 	for _, test := range tests {
@@ -109,7 +111,7 @@ func TestStrictName(t *testing.T) {
 		{"Update Operation", OperationUpdate, "UPDATE", false},
 		{"Delete Operation", OperationDelete, "DELETE", false},
 		{"Truncate Operation", OperationTruncate, "TRUNCATE", false},
-		{"Unknown Operation", Operation(32), "UNKNOWN", true},
+		{"Unknown Operation", Operation(64), "UNKNOWN", true},
 		{"Composite Operation", OperationInsert | OperationUpdate, "UNKNOWN", true},
 	}
 
@@ -139,7 +141,7 @@ func TestString(t *testing.T) {
 		{"Single Atomic Operation", OperationInsert, "INSERT"},
 		{"Multiple Atomic Operations", OperationInsert | OperationUpdate | OperationTruncate, "INSERT | UPDATE | TRUNCATE"},
 		{"Empty Operation", 0, "UNKNOWN"},
-		{"Unknown Operation", 32, "UNKNOWN"},
+		{"Unknown Operation", 64, "UNKNOWN"},
 	}
 
 	for _, test := range tests {
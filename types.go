@@ -0,0 +1,298 @@
+package flash
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"strings"
+	"sync"
+)
+
+// TypeCodec decodes the text representation of a PostgreSQL value, as returned by the output function of its type
+type TypeCodec func(text string) (any, error)
+
+type TypeKind uint8
+
+const (
+	TypeKindBase      TypeKind = iota + 1 // Types of extensions, only decoded with a registered codec
+	TypeKindEnum                          // Decoded as string
+	TypeKindDomain                        // Decoded as the underlying type
+	TypeKindComposite                     // Decoded as map[string]any
+)
+
+// TypeInfo describes a user-defined type loaded from pg_type
+type TypeInfo struct {
+	Oid  uint32
+	Name string // Format: schema.name - e.g: public.mood
+	Kind TypeKind
+
+	BaseOid uint32       // Underlying type of domains
+	Fields  []*TypeField // Attributes of composites, in order
+}
+
+type TypeField struct {
+	Name string
+	Oid  uint32
+}
+
+// TypeRegistry decodes values of user-defined types in the same way across drivers.
+// Enums, domains and composites are loaded from pg_type, codecs can be registered for any type, e.g: extensions.
+// A nil registry decodes nothing.
+type TypeRegistry struct {
+	sync.RWMutex
+
+	codecs map[string]TypeCodec // key: type name, schema-qualified or not - e.g: public.hstore, hstore
+	types  map[uint32]*TypeInfo // key: oid
+}
+
+// NewTypeRegistry returns a registry containing the hstore codec
+func NewTypeRegistry() *TypeRegistry {
+	registry := &TypeRegistry{
+		codecs: make(map[string]TypeCodec),
+		types:  make(map[uint32]*TypeInfo),
+	}
+	registry.Register("hstore", DecodeHstore)
+	return registry
+}
+
+// Register defines the codec of a type, replacing previous one.
+// The name can be schema-qualified. Types registered after Load are only known after the next Load.
+func (r *TypeRegistry) Register(typeName string, codec TypeCodec) {
+	r.Lock()
+	defer r.Unlock()
+	r.codecs[typeName] = codec
+}
+
+// Load queries enums, domains, standalone composites and types having a registered codec from pg_type.
+// Called by drivers on Init, call it again after creating new types.
+func (r *TypeRegistry) Load(databaseCnx string) error {
+	if r == nil {
+		return nil
+	}
+	connector, err := pq.NewConnector(databaseCnx)
+	if err != nil {
+		return err
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	r.RLock()
+	names := make([]string, 0, len(r.codecs))
+	for name := range r.codecs {
+		names = append(names, name)
+	}
+	r.RUnlock()
+
+	rows, err := db.Query(getLoadTypesSql(), pq.Array(names))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	types := make(map[uint32]*TypeInfo)
+	for rows.Next() {
+		var info TypeInfo
+		var schema, name, kind string
+		var fieldNames []string
+		var fieldOids []int64
+		if err := rows.Scan(&info.Oid, &schema, &name, &kind, &info.BaseOid, pq.Array(&fieldNames), pq.Array(&fieldOids)); err != nil {
+			return err
+		}
+		info.Name = schema + "." + name
+		switch kind {
+		case "e":
+			info.Kind = TypeKindEnum
+		case "d":
+			info.Kind = TypeKindDomain
+		case "c":
+			info.Kind = TypeKindComposite
+			for i, fieldName := range fieldNames {
+				info.Fields = append(info.Fields, &TypeField{Name: fieldName, Oid: uint32(fieldOids[i])})
+			}
+		default:
+			info.Kind = TypeKindBase
+		}
+		types[info.Oid] = &info
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	r.Lock()
+	r.types = types
+	r.Unlock()
+	return nil
+}
+
+// Type returns the loaded type of the oid
+func (r *TypeRegistry) Type(oid uint32) (*TypeInfo, bool) {
+	if r == nil {
+		return nil, false
+	}
+	r.RLock()
+	defer r.RUnlock()
+	info, exists := r.types[oid]
+	return info, exists
+}
+
+// Codec returns the registered codec of the loaded type, using its schema-qualified name first
+func (r *TypeRegistry) Codec(oid uint32) (TypeCodec, bool) {
+	info, exists := r.Type(oid)
+	if !exists {
+		return nil, false
+	}
+	r.RLock()
+	defer r.RUnlock()
+	return r.codecOf(info)
+}
+
+func (r *TypeRegistry) codecOf(info *TypeInfo) (TypeCodec, bool) {
+	if codec, exists := r.codecs[info.Name]; exists {
+		return codec, true
+	}
+	codec, exists := r.codecs[info.Name[strings.IndexByte(info.Name, '.')+1:]]
+	return codec, exists
+}
+
+// AddType adds or replaces a type without querying the database, e.g: a type created after Load
+func (r *TypeRegistry) AddType(info *TypeInfo) {
+	r.Lock()
+	defer r.Unlock()
+	r.types[info.Oid] = info
+}
+
+// TextFormatRequiredBy returns the first loaded type of oids which must be received as text: composites and types having a codec.
+// Their binary representation differs from the text one. Domains are checked through their base type.
+func (r *TypeRegistry) TextFormatRequiredBy(oids []uint32) (*TypeInfo, bool) {
+	if r == nil {
+		return nil, false
+	}
+	r.RLock()
+	defer r.RUnlock()
+	for _, oid := range oids {
+		info, exists := r.types[oid]
+		for exists && info.Kind == TypeKindDomain {
+			if _, hasCodec := r.codecOf(info); hasCodec {
+				break
+			}
+			info, exists = r.types[info.BaseOid]
+		}
+		if !exists {
+			continue
+		}
+		if info.Kind == TypeKindComposite || info.Kind == TypeKindBase {
+			return info, true
+		}
+		if _, hasCodec := r.codecOf(info); hasCodec {
+			return info, true
+		}
+	}
+	return nil, false
+}
+
+// DecodeHstore decodes hstore values as map[string]any, values are string or nil
+func DecodeHstore(text string) (any, error) {
+	result := make(map[string]any)
+	for i := 0; i < len(text); {
+		if text[i] == ' ' || text[i] == ',' {
+			i++
+			continue
+		}
+		key, next, err := parseQuoted(text, i)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(text[next:], "=>") {
+			return nil, fmt.Errorf("invalid hstore %q: expected => at %d", text, next)
+		}
+		i = next + 2
+		if strings.HasPrefix(text[i:], "NULL") {
+			result[key] = nil
+			i += 4
+			continue
+		}
+		value, next, err := parseQuoted(text, i)
+		if err != nil {
+			return nil, err
+		}
+		result[key] = value
+		i = next
+	}
+	return result, nil
+}
+
+// parseQuoted reads the double-quoted string starting at start, backslash escapes the next character
+func parseQuoted(text string, start int) (string, int, error) {
+	if start >= len(text) || text[start] != '"' {
+		return "", 0, fmt.Errorf("invalid value %q: expected quote at %d", text, start)
+	}
+	var builder strings.Builder
+	for i := start + 1; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+			if i < len(text) {
+				builder.WriteByte(text[i])
+			}
+		case '"':
+			return builder.String(), i + 1, nil
+		default:
+			builder.WriteByte(text[i])
+		}
+	}
+	return "", 0, fmt.Errorf("invalid value %q: unterminated quote", text)
+}
+
+// parseRecord splits the text representation of a composite, e.g: (1,"a b",,"x""y") -> 1, a b, NULL, x"y
+func parseRecord(text string) ([]*string, error) {
+	if len(text) < 2 || text[0] != '(' || text[len(text)-1] != ')' {
+		return nil, errors.New("invalid record: " + text)
+	}
+	text = text[1 : len(text)-1]
+
+	var values []*string
+	var builder strings.Builder
+	quoted, inQuotes := false, false
+	for i := 0; i <= len(text); i++ {
+		if i == len(text) || (text[i] == ',' && !inQuotes) {
+			if !quoted && builder.Len() == 0 {
+				values = append(values, nil) // Unquoted empty value is NULL
+			} else {
+				value := builder.String()
+				values = append(values, &value)
+			}
+			builder.Reset()
+			quoted = false
+			continue
+		}
+		switch {
+		case text[i] == '"' && inQuotes && i+1 < len(text) && text[i+1] == '"':
+			builder.WriteByte('"') // Doubled quote
+			i++
+		case text[i] == '"':
+			inQuotes, quoted = !inQuotes, true
+		case text[i] == '\\' && i+1 < len(text):
+			i++
+			builder.WriteByte(text[i])
+		default:
+			builder.WriteByte(text[i])
+		}
+	}
+	return values, nil
+}
+
+func getLoadTypesSql() string {
+	return `
+		SELECT t.oid, n.nspname, t.typname, t.typtype, t.typbasetype,
+			COALESCE(ARRAY(SELECT a.attname FROM pg_attribute a WHERE a.attrelid = t.typrelid AND a.attnum > 0 AND NOT a.attisdropped ORDER BY a.attnum), '{}'),
+			COALESCE(ARRAY(SELECT a.atttypid::BIGINT FROM pg_attribute a WHERE a.attrelid = t.typrelid AND a.attnum > 0 AND NOT a.attisdropped ORDER BY a.attnum), '{}')
+		FROM pg_type t
+		JOIN pg_namespace n ON n.oid = t.typnamespace
+		WHERE n.nspname NOT IN ('pg_catalog', 'information_schema')
+			AND (
+				t.typtype IN ('e', 'd')
+				OR (t.typtype = 'c' AND (SELECT c.relkind FROM pg_class c WHERE c.oid = t.typrelid) = 'c')
+				OR t.typname = ANY($1) OR n.nspname || '.' || t.typname = ANY($1)
+			);`
+}
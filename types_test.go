@@ -0,0 +1,111 @@
+package flash
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRecord(t *testing.T) {
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		text     string
+		expected []*string
+	}{
+		{`(1,abc)`, []*string{str("1"), str("abc")}},
+		{`(1,,"")`, []*string{str("1"), nil, str("")}},
+		{`("a b","x""y","c\\d")`, []*string{str("a b"), str(`x"y`), str(`c\d`)}},
+		{`("(1,2)",3)`, []*string{str("(1,2)"), str("3")}},
+	}
+	for _, test := range tests {
+		values, err := parseRecord(test.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(values, test.expected) {
+			t.Errorf("parseRecord(%q) = %v, expected %v", test.text, values, test.expected)
+		}
+	}
+
+	if _, err := parseRecord("1,2"); err == nil {
+		t.Error("expected error for value without parentheses")
+	}
+}
+
+func TestDecodeHstore(t *testing.T) {
+	value, err := DecodeHstore(`"a"=>"1", "b c"=>NULL, "d"=>"e\"f"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]any{"a": "1", "b c": nil, "d": `e"f`}
+	if !reflect.DeepEqual(value, expected) {
+		t.Errorf("DecodeHstore() = %v, expected %v", value, expected)
+	}
+
+	if _, err := DecodeHstore(`"a"="1"`); err == nil {
+		t.Error("expected error for invalid hstore")
+	}
+}
+
+func TestTypeRegistryDecodeText(t *testing.T) {
+	registry := NewTypeRegistry()
+	registry.Register("public.upper_text", func(text string) (any, error) {
+		return strings.ToUpper(text), nil
+	})
+	registry.AddType(&TypeInfo{Oid: 100, Name: "public.mood", Kind: TypeKindEnum})
+	registry.AddType(&TypeInfo{Oid: 101, Name: "public.positive", Kind: TypeKindDomain, BaseOid: 23})
+	registry.AddType(&TypeInfo{Oid: 102, Name: "public.mood_domain", Kind: TypeKindDomain, BaseOid: 100})
+	registry.AddType(&TypeInfo{Oid: 103, Name: "public.upper_text", Kind: TypeKindBase})
+	registry.AddType(&TypeInfo{Oid: 104, Name: "public.address", Kind: TypeKindComposite, Fields: []*TypeField{
+		{Name: "number", Oid: 101},
+		{Name: "street", Oid: 25},
+		{Name: "mood", Oid: 100},
+		{Name: "label", Oid: 103},
+	}})
+	registry.AddType(&TypeInfo{Oid: 105, Name: "extensions.hstore", Kind: TypeKindBase})
+
+	tests := []struct {
+		name     string
+		oid      uint32
+		text     string
+		expected any
+	}{
+		{"Enum", 100, "happy", "happy"},
+		{"Domain", 101, "42", int64(42)},
+		{"Domain Of Enum", 102, "sad", "sad"},
+		{"Codec", 103, "abc", "ABC"},
+		{"Codec By Bare Name", 105, `"a"=>"1"`, map[string]any{"a": "1"}},
+		{"Composite", 104, `(7,"Main Street",happy,)`, map[string]any{"number": int64(7), "street": "Main Street", "mood": "happy", "label": nil}},
+		{"Unknown", 999, "text", "text"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, err := registry.DecodeText(test.oid, test.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(value, test.expected) {
+				t.Errorf("DecodeText() = %#v, expected %#v", value, test.expected)
+			}
+		})
+	}
+
+	if _, err := registry.DecodeText(104, "(1,2)"); err == nil {
+		t.Error("expected error for composite with missing fields")
+	}
+	if info, required := registry.TextFormatRequiredBy([]uint32{23, 100, 101, 104}); !required || info.Oid != 104 {
+		t.Errorf("TextFormatRequiredBy() = %v, expected the composite", info)
+	}
+	if info, required := registry.TextFormatRequiredBy([]uint32{23, 100, 101, 102}); required {
+		t.Errorf("TextFormatRequiredBy() = %v, expected binary for built-in types, enums and domains", info)
+	}
+
+	// A nil registry only decodes built-in types
+	var nilRegistry *TypeRegistry
+	if value, _ := nilRegistry.DecodeText(23, "42"); value != int64(42) {
+		t.Errorf("nil registry must decode built-in types, got %#v", value)
+	}
+	if _, required := nilRegistry.TextFormatRequiredBy([]uint32{104}); required {
+		t.Error("nil registry must not require text format")
+	}
+}
@@ -0,0 +1,375 @@
+package flash
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Oids of built-in types having a specific Go representation, see DecodeText
+const (
+	boolOid        = 16
+	byteaOid       = 17
+	int8Oid        = 20
+	int2Oid        = 21
+	int4Oid        = 23
+	oidOid         = 26
+	jsonOid        = 114
+	float4Oid      = 700
+	float8Oid      = 701
+	dateOid        = 1082
+	timestampOid   = 1114
+	timestamptzOid = 1184
+	jsonbOid       = 3802
+)
+
+// arrayElementOids maps built-in array types to their element type
+var arrayElementOids = map[uint32]uint32{
+	1000: boolOid,        // bool[]
+	1001: byteaOid,       // bytea[]
+	1005: int2Oid,        // int2[]
+	1007: int4Oid,        // int4[]
+	1016: int8Oid,        // int8[]
+	1028: oidOid,         // oid[]
+	199:  jsonOid,        // json[]
+	1021: float4Oid,      // float4[]
+	1022: float8Oid,      // float8[]
+	1182: dateOid,        // date[]
+	1115: timestampOid,   // timestamp[]
+	1185: timestamptzOid, // timestamptz[]
+	3807: jsonbOid,       // jsonb[]
+	1003: 19,             // name[]
+	1009: 25,             // text[]
+	1014: 1042,           // bpchar[]
+	1015: 1043,           // varchar[]
+	1183: 1083,           // time[]
+	1187: 1186,           // interval[]
+	1231: 1700,           // numeric[]
+	2951: 2950,           // uuid[]
+	1041: 869,            // inet[]
+	651:  650,            // cidr[]
+}
+
+// DecodeText decodes the text representation of a value, as sent by the output function of its type.
+// All drivers return values following this model:
+//
+//	bool                          -> bool
+//	smallint, integer, bigint, oid -> int64
+//	real, double precision        -> float64
+//	numeric                       -> string, exact decimal representation - e.g: "12.50", "NaN"
+//	bytea                         -> []byte
+//	timestamp, timestamptz, date  -> time.Time in UTC, or "infinity" and "-infinity" strings
+//	json, jsonb                   -> decoded as by json.Unmarshal, numbers are float64
+//	arrays of these types         -> []any, nested for multidimensional arrays
+//	registry types                -> see TypeRegistry.Register and TypeKind
+//	other types                   -> string, text representation - e.g: uuid, time, interval, inet
+func (r *TypeRegistry) DecodeText(oid uint32, text string) (any, error) {
+	if info, exists := r.Type(oid); exists {
+		if codec, exists := r.Codec(oid); exists {
+			return codec(text)
+		}
+		switch info.Kind {
+		case TypeKindEnum:
+			return text, nil
+		case TypeKindDomain:
+			return r.DecodeText(info.BaseOid, text)
+		case TypeKindComposite:
+			return r.decodeRecord(info, text)
+		}
+	}
+	if elementOid, isArray := arrayElementOids[oid]; isArray {
+		return r.decodeArray(elementOid, text)
+	}
+
+	switch oid {
+	case boolOid:
+		return text == "t" || text == "true", nil
+	case int2Oid, int4Oid, int8Oid, oidOid:
+		return strconv.ParseInt(text, 10, 64)
+	case float4Oid, float8Oid:
+		return strconv.ParseFloat(text, 64) // Accepts NaN, Infinity and -Infinity
+	case byteaOid:
+		if !strings.HasPrefix(text, `\x`) {
+			return nil, fmt.Errorf("unsupported bytea output format: %q", text)
+		}
+		return hex.DecodeString(text[2:])
+	case timestampOid, timestamptzOid, dateOid:
+		return parseTimestamp(text)
+	case jsonOid, jsonbOid:
+		var value any
+		err := json.Unmarshal([]byte(text), &value)
+		return value, err
+	}
+	return text, nil
+}
+
+// DecodeJSON decodes the JSON representation of a value, as returned by to_jsonb, into the same value as DecodeText.
+// The value must be decoded using json.Decoder.UseNumber to keep numbers exact.
+func (r *TypeRegistry) DecodeJSON(oid uint32, value any) (any, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if info, exists := r.Type(oid); exists {
+		if _, exists := r.Codec(oid); exists {
+			if text, ok := value.(string); ok {
+				return r.DecodeText(oid, text)
+			}
+			return normalizeJSON(value), nil // JSON representation of extensions, e.g: hstore -> object
+		}
+		switch info.Kind {
+		case TypeKindDomain:
+			return r.DecodeJSON(info.BaseOid, value)
+		case TypeKindComposite:
+			fields, ok := value.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("invalid composite %s: %v", info.Name, value)
+			}
+			composite := make(map[string]any, len(info.Fields))
+			for _, field := range info.Fields {
+				fieldValue, err := r.DecodeJSON(field.Oid, fields[field.Name])
+				if err != nil {
+					return nil, err
+				}
+				composite[field.Name] = fieldValue
+			}
+			return composite, nil
+		}
+	}
+	if oid == jsonOid || oid == jsonbOid {
+		return normalizeJSON(value), nil
+	}
+	if elementOid, isArray := arrayElementOids[oid]; isArray {
+		if elements, ok := value.([]any); ok {
+			return r.decodeJSONArray(elementOid, elements)
+		}
+	}
+
+	switch typedValue := value.(type) {
+	case string:
+		return r.DecodeText(oid, typedValue)
+	case json.Number:
+		return r.DecodeText(oid, typedValue.String())
+	case bool:
+		return typedValue, nil
+	}
+	return normalizeJSON(value), nil
+}
+
+// DecodeJSONRow decodes all values of a row returned by to_jsonb, using the type oid of each column.
+// Columns without known type are decoded as by json.Unmarshal.
+func (r *TypeRegistry) DecodeJSONRow(row map[string]any, columnTypes map[string]uint32) error {
+	for column, value := range row {
+		oid, known := columnTypes[column]
+		if !known {
+			row[column] = normalizeJSON(value)
+			continue
+		}
+		decoded, err := r.DecodeJSON(oid, value)
+		if err != nil {
+			return fmt.Errorf("could not decode column %s: %w", column, err)
+		}
+		row[column] = decoded
+	}
+	return nil
+}
+
+func (r *TypeRegistry) decodeJSONArray(elementOid uint32, elements []any) ([]any, error) {
+	decoded := make([]any, len(elements))
+	for i, element := range elements {
+		var err error
+		if nested, isNested := element.([]any); isNested && elementOid != jsonOid && elementOid != jsonbOid {
+			decoded[i], err = r.decodeJSONArray(elementOid, nested)
+		} else {
+			decoded[i], err = r.DecodeJSON(elementOid, element)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return decoded, nil
+}
+
+func (r *TypeRegistry) decodeRecord(info *TypeInfo, text string) (map[string]any, error) {
+	values, err := parseRecord(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != len(info.Fields) {
+		return nil, fmt.Errorf("composite %s has %d fields, got %d values", info.Name, len(info.Fields), len(values))
+	}
+	composite := make(map[string]any, len(values))
+	for i, field := range info.Fields {
+		if values[i] == nil {
+			composite[field.Name] = nil
+			continue
+		}
+		if composite[field.Name], err = r.DecodeText(field.Oid, *values[i]); err != nil {
+			return nil, err
+		}
+	}
+	return composite, nil
+}
+
+// decodeArray decodes array literals, e.g: {1,NULL,"a b"} or [0:1]={1,2}
+func (r *TypeRegistry) decodeArray(elementOid uint32, text string) ([]any, error) {
+	if strings.HasPrefix(text, "[") {
+		text = text[strings.IndexByte(text, '=')+1:] // Custom lower bounds are not kept
+	}
+	elements, rest, err := r.parseArray(elementOid, text)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("invalid array %q: unexpected %q", text, rest)
+	}
+	return elements, nil
+}
+
+// parseArray decodes the array at the beginning of text, and returns the remaining text
+func (r *TypeRegistry) parseArray(elementOid uint32, text string) ([]any, string, error) {
+	if text == "" || text[0] != '{' {
+		return nil, "", fmt.Errorf("invalid array %q: expected {", text)
+	}
+	elements := make([]any, 0)
+	if strings.HasPrefix(text, "{}") {
+		return elements, text[2:], nil
+	}
+
+	for i := 1; ; {
+		if i >= len(text) {
+			return nil, "", fmt.Errorf("invalid array %q: unterminated", text)
+		}
+		switch text[i] {
+		case '{':
+			nested, rest, err := r.parseArray(elementOid, text[i:])
+			if err != nil {
+				return nil, "", err
+			}
+			elements = append(elements, nested)
+			i = len(text) - len(rest)
+		case '"':
+			value, next, err := parseQuoted(text, i)
+			if err != nil {
+				return nil, "", err
+			}
+			element, err := r.DecodeText(elementOid, value)
+			if err != nil {
+				return nil, "", err
+			}
+			elements = append(elements, element)
+			i = next
+		default:
+			end := i
+			for end < len(text) && text[end] != ',' && text[end] != '}' {
+				end++
+			}
+			if raw := text[i:end]; strings.EqualFold(raw, "NULL") {
+				elements = append(elements, nil)
+			} else {
+				element, err := r.DecodeText(elementOid, raw)
+				if err != nil {
+					return nil, "", err
+				}
+				elements = append(elements, element)
+			}
+			i = end
+		}
+
+		if i >= len(text) {
+			return nil, "", fmt.Errorf("invalid array %q: unterminated", text)
+		}
+		switch text[i] {
+		case ',':
+			i++
+		case '}':
+			return elements, text[i+1:], nil
+		default:
+			return nil, "", fmt.Errorf("invalid array %q: unexpected %q at %d", text, text[i], i)
+		}
+	}
+}
+
+// parseTimestamp decodes dates and timestamps in ISO format, with or without time zone.
+// Both the text output (2024-01-02 03:04:05+00) and the JSON output (2024-01-02T03:04:05+00:00) are accepted.
+func parseTimestamp(text string) (any, error) {
+	if text == "infinity" || text == "-infinity" {
+		return text, nil
+	}
+	if len(text) > 10 && text[10] == 'T' {
+		text = text[:10] + " " + text[11:]
+	}
+	var err error
+	for _, layout := range []string{"2006-01-02 15:04:05Z07", "2006-01-02 15:04:05Z07:00", "2006-01-02 15:04:05Z07:00:00", "2006-01-02 15:04:05", "2006-01-02"} {
+		var value time.Time
+		if value, err = time.Parse(layout, text); err == nil {
+			return value.UTC(), nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported timestamp format %q: %w", text, err)
+}
+
+// normalizeJSON converts json.Number to float64, as decoded by json.Unmarshal
+func normalizeJSON(value any) any {
+	switch typedValue := value.(type) {
+	case json.Number:
+		number, _ := typedValue.Float64()
+		return number
+	case map[string]any:
+		for key, item := range typedValue {
+			typedValue[key] = normalizeJSON(item)
+		}
+	case []any:
+		for i, item := range typedValue {
+			typedValue[i] = normalizeJSON(item)
+		}
+	}
+	return value
+}
+
+// ValuesEqual compares a decoded value with a value provided by the user, e.g: the value of a ListenerCondition.
+// Integers and floats of any Go type are compared by value, times by instant, and numeric strings with numbers.
+func ValuesEqual(value any, expected any) bool {
+	value, expected = normalizeGoValue(value), normalizeGoValue(expected)
+
+	switch typedExpected := expected.(type) {
+	case time.Time:
+		typedValue, ok := value.(time.Time)
+		return ok && typedValue.Equal(typedExpected)
+	case int64, float64:
+		if text, isNumeric := value.(string); isNumeric {
+			valueNumber, ok := new(big.Rat).SetString(text)
+			expectedNumber, expectedOk := new(big.Rat).SetString(fmt.Sprint(typedExpected))
+			return ok && expectedOk && valueNumber.Cmp(expectedNumber) == 0
+		}
+		if valueInt, ok := value.(int64); ok {
+			if expectedFloat, ok := expected.(float64); ok {
+				return float64(valueInt) == expectedFloat
+			}
+		}
+		if valueFloat, ok := value.(float64); ok {
+			if expectedInt, ok := expected.(int64); ok {
+				return valueFloat == float64(expectedInt)
+			}
+		}
+	}
+	return reflect.DeepEqual(value, expected)
+}
+
+// normalizeGoValue converts integers to int64 and float32 to float64
+func normalizeGoValue(value any) any {
+	reflected := reflect.ValueOf(value)
+	switch reflected.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return reflected.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(reflected.Uint())
+	case reflect.Float32, reflect.Float64:
+		return reflected.Float()
+	}
+	return value
+}
@@ -0,0 +1,110 @@
+package flash
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// valueTests contain the text and the JSON representation of the same value, with the expected Go value
+var valueTests = []struct {
+	name     string
+	oid      uint32
+	text     string
+	json     string
+	expected any
+}{
+	{"Bool", boolOid, "t", `true`, true},
+	{"Int2", int2Oid, "-12", `-12`, int64(-12)},
+	{"Int8", int8Oid, "9007199254740993", `9007199254740993`, int64(9007199254740993)},
+	{"Float4", float4Oid, "1.1", `1.1`, 1.1},
+	{"Float8 NaN", float8Oid, "NaN", `"NaN"`, math.NaN()},
+	{"Numeric", 1700, "12.50", `12.50`, "12.50"},
+	{"Text", 25, "abc", `"abc"`, "abc"},
+	{"Bytea", byteaOid, `\x0102ff`, `"\\x0102ff"`, []byte{1, 2, 255}},
+	{"Timestamptz", timestamptzOid, "2024-01-02 08:34:05.123+05:30", `"2024-01-02T08:34:05.123+05:30"`, time.Date(2024, 1, 2, 3, 4, 5, 123000000, time.UTC)},
+	{"Timestamp", timestampOid, "2024-01-02 03:04:05", `"2024-01-02T03:04:05"`, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+	{"Timestamp Infinity", timestampOid, "infinity", `"infinity"`, "infinity"},
+	{"Date", dateOid, "2024-01-02", `"2024-01-02"`, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+	{"Interval", 1186, "1 day 02:00:00", `"1 day 02:00:00"`, "1 day 02:00:00"},
+	{"Jsonb", jsonbOid, `{"a": [1, "b"]}`, `{"a": [1, "b"]}`, map[string]any{"a": []any{1.0, "b"}}},
+	{"Int4 Array", 1007, "{1,NULL,3}", `[1, null, 3]`, []any{int64(1), nil, int64(3)}},
+	{"Int4 Array 2D", 1007, "{{1,2},{3,4}}", `[[1, 2], [3, 4]]`, []any{[]any{int64(1), int64(2)}, []any{int64(3), int64(4)}}},
+	{"Text Array", 1009, `{a,"b c","d\"e",NULL,"NULL"}`, `["a", "b c", "d\"e", null, "NULL"]`, []any{"a", "b c", `d"e`, nil, "NULL"}},
+	{"Empty Array", 1007, "{}", `[]`, []any{}},
+}
+
+func TestDecodeTextAndJSON(t *testing.T) {
+	var registry *TypeRegistry
+	for _, test := range valueTests {
+		t.Run(test.name, func(t *testing.T) {
+			textValue, err := registry.DecodeText(test.oid, test.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoder := json.NewDecoder(bytes.NewReader([]byte(test.json)))
+			decoder.UseNumber()
+			var rawJson any
+			if err := decoder.Decode(&rawJson); err != nil {
+				t.Fatal(err)
+			}
+			jsonValue, err := registry.DecodeJSON(test.oid, rawJson)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for name, value := range map[string]any{"text": textValue, "JSON": jsonValue} {
+				if expected, isFloat := test.expected.(float64); isFloat && math.IsNaN(expected) {
+					if typedValue, ok := value.(float64); !ok || !math.IsNaN(typedValue) {
+						t.Errorf("%s value = %#v, expected NaN", name, value)
+					}
+					continue
+				}
+				if !reflect.DeepEqual(value, test.expected) {
+					t.Errorf("%s value = %#v, expected %#v", name, value, test.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeJSONRow(t *testing.T) {
+	row := map[string]any{"id": json.Number("1"), "created_at": "2024-01-02", "extra": json.Number("2")}
+	if err := (*TypeRegistry)(nil).DecodeJSONRow(row, map[string]uint32{"id": int4Oid, "created_at": dateOid}); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]any{"id": int64(1), "created_at": time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), "extra": 2.0}
+	if !reflect.DeepEqual(row, expected) {
+		t.Errorf("DecodeJSONRow() = %#v, expected %#v", row, expected)
+	}
+}
+
+func TestValuesEqual(t *testing.T) {
+	tests := []struct {
+		value    any
+		expected any
+		equal    bool
+	}{
+		{int64(1), 1, true},
+		{int64(1), int32(1), true},
+		{int64(1), 1.0, true},
+		{1.5, float32(1.5), true},
+		{"12.50", 12.5, true},
+		{"12.50", 12, false},
+		{"12.50", "12.5", false},
+		{true, true, true},
+		{nil, nil, true},
+		{nil, false, false},
+		{[]byte("a"), []byte("a"), true},
+		{time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC), time.Date(2024, 1, 2, 4, 0, 0, 0, time.FixedZone("CET", 3600)), true},
+	}
+	for _, test := range tests {
+		if ValuesEqual(test.value, test.expected) != test.equal {
+			t.Errorf("ValuesEqual(%#v, %#v) = %v, expected %v", test.value, test.expected, !test.equal, test.equal)
+		}
+	}
+}